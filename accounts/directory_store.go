@@ -14,6 +14,7 @@ import (
 type DirectoryStore struct {
 	dirPath string
 	apps    map[string]*mastodon.Application
+	tokens  map[string]string
 
 	sync.Mutex
 }
@@ -27,6 +28,7 @@ func NewDirectoryStorage(dirPath string) (*DirectoryStore, error) {
 	return &DirectoryStore{
 		dirPath: dirPath,
 		apps:    make(map[string]*mastodon.Application),
+		tokens:  make(map[string]string),
 	}, nil
 }
 
@@ -60,11 +62,12 @@ func (ds *DirectoryStore) GetByServerName(serverName string) (*mastodon.Applicat
 	}
 
 	// Try to reload
-	apps, err := ds.loadAll()
+	apps, tokens, err := ds.loadAll()
 	if err != nil {
 		return nil, err
 	}
 	ds.apps = apps
+	ds.tokens = tokens
 
 	// Try from existing apps again
 	app, ok = ds.apps[serverName]
@@ -94,8 +97,18 @@ func (ds *DirectoryStore) GetAll() (map[string]*mastodon.Application, error) {
 	return apps, nil
 }
 
+// GetAccessToken returns the user token stored for a server, if any, as of
+// the last load.
+func (ds *DirectoryStore) GetAccessToken(serverName string) (string, bool) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	token, ok := ds.tokens[serverName]
+	return token, ok
+}
+
 func (ds *DirectoryStore) LoadAll() error {
-	apps, err := ds.loadAll()
+	apps, tokens, err := ds.loadAll()
 	if err != nil {
 		return err
 	}
@@ -103,28 +116,33 @@ func (ds *DirectoryStore) LoadAll() error {
 	ds.Lock()
 	defer ds.Unlock()
 	ds.apps = apps
+	ds.tokens = tokens
 
 	return nil
 }
 
-func (ds *DirectoryStore) loadAll() (map[string]*mastodon.Application, error) {
+func (ds *DirectoryStore) loadAll() (map[string]*mastodon.Application, map[string]string, error) {
 	credPaths, err := filepath.Glob(filepath.Join(ds.dirPath, "*.json"))
 	if err != nil {
-		return nil, fmt.Errorf("unable to find credentials file paths: %v", err)
+		return nil, nil, fmt.Errorf("unable to find credentials file paths: %v", err)
 	}
 
 	// Technically this is kinda wrong if you are going to store multiple credentials
 	// for each server but i am not so for now too bad.
 	apps := make(map[string]*mastodon.Application)
+	tokens := make(map[string]string)
 	for _, credPath := range credPaths {
 		pair, err := ds.LoadFromPath(credPath)
 		if err != nil {
-			return nil, fmt.Errorf("unable to load app from %s: %v", credPath, err)
+			return nil, nil, fmt.Errorf("unable to load app from %s: %v", credPath, err)
 		}
 		apps[pair.ServerName] = pair.App
+		if pair.AccessToken != "" {
+			tokens[pair.ServerName] = pair.AccessToken
+		}
 	}
 
-	return apps, nil
+	return apps, tokens, nil
 }
 
 func (ds *DirectoryStore) WriteApp(serverName string, app *mastodon.Application) (string, error) {
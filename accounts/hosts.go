@@ -0,0 +1,29 @@
+package accounts
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// HostOf returns the lowercased host of a server name or URI, which are
+// sometimes bare hosts.
+func HostOf(server string) string {
+	if u, err := url.Parse(server); err == nil && u.Host != "" {
+		return strings.ToLower(u.Host)
+	}
+	return strings.ToLower(strings.TrimSuffix(server, "/"))
+}
+
+// MatchHost reports whether the host of a server name or URI matches any of
+// the path.Match glob patterns, e.g. "*.social". Hosts are compared without
+// regard to case.
+func MatchHost(patterns []string, server string) bool {
+	host := HostOf(server)
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
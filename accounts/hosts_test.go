@@ -0,0 +1,24 @@
+package accounts
+
+import "testing"
+
+func TestMatchHost(t *testing.T) {
+	patterns := []string{"mastodon.social", "*.Example"}
+
+	for server, want := range map[string]bool{
+		"mastodon.social":               true,
+		"https://Mastodon.Social/":      true,
+		"https://a.example":             true,
+		"https://example":               false,
+		"https://mastodon.social.other": false,
+		"https://hachyderm.io":          false,
+	} {
+		if got := MatchHost(patterns, server); got != want {
+			t.Errorf("MatchHost(%q) = %v, want %v", server, got, want)
+		}
+	}
+
+	if got := HostOf("https://A.Example/@user/1"); got != "a.example" {
+		t.Errorf("HostOf = %q", got)
+	}
+}
@@ -5,4 +5,7 @@ import "github.com/mattn/go-mastodon"
 type NamedApplication struct {
 	ServerName string                `json:"server_name"`
 	App        *mastodon.Application `json:"app"`
+
+	// AccessToken is an optional user token, added by hand for now.
+	AccessToken string `json:"access_token,omitempty"`
 }
@@ -0,0 +1,133 @@
+package accounts
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-mastodon"
+)
+
+//go:embed opt-out.txt
+var builtinOptOuts string
+
+// OptOutList is the servers that asked not to be crawled.
+type OptOutList struct {
+	patterns []string
+	sync.Mutex
+}
+
+// ParseOptOutList reads one host or glob per line. Blank lines and lines
+// starting with # are ignored.
+func ParseOptOutList(r io.Reader) (*OptOutList, error) {
+	list := &OptOutList{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		pattern = HostOf(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("line %d: %q: %w", line, pattern, err)
+		}
+		list.patterns = append(list.patterns, pattern)
+	}
+	return list, scanner.Err()
+}
+
+// LoadOptOutList returns the opt-outs built into probo plus those in the
+// given files.
+func LoadOptOutList(filePaths ...string) (*OptOutList, error) {
+	list, err := ParseOptOutList(strings.NewReader(builtinOptOuts))
+	if err != nil {
+		return nil, fmt.Errorf("built-in opt-out list: %w", err)
+	}
+
+	for _, filePath := range filePaths {
+		fp, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		more, err := ParseOptOutList(fp)
+		_ = fp.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filePath, err)
+		}
+		list.patterns = append(list.patterns, more.patterns...)
+	}
+	return list, nil
+}
+
+// Excludes reports whether a server, given as a host or URL, opted out.
+func (l *OptOutList) Excludes(server string) bool {
+	if l == nil {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	return MatchHost(l.patterns, server)
+}
+
+// Add opts a server out for as long as the list is in use, e.g. once its
+// rules turn out to forbid collection.
+func (l *OptOutList) Add(server string) {
+	l.Lock()
+	defer l.Unlock()
+	l.patterns = append(l.patterns, HostOf(server))
+}
+
+// ExcludeOptOuts hides opted-out servers from a store, so nothing built on
+// it ever sees them.
+func ExcludeOptOuts(store Store, list *OptOutList) Store {
+	return &optOutStore{store: store, list: list}
+}
+
+type optOutStore struct {
+	store Store
+	list  *OptOutList
+}
+
+func (s *optOutStore) LoadByClientID(clientID string) (*NamedApplication, error) {
+	app, err := s.store.LoadByClientID(clientID)
+	if err != nil {
+		return nil, err
+	}
+	if s.list.Excludes(app.ServerName) {
+		return nil, fmt.Errorf("server %s opted out", app.ServerName)
+	}
+	return app, nil
+}
+
+func (s *optOutStore) GetByServerName(serverName string) (*mastodon.Application, error) {
+	if s.list.Excludes(serverName) {
+		return nil, fmt.Errorf("server %s opted out", serverName)
+	}
+	return s.store.GetByServerName(serverName)
+}
+
+func (s *optOutStore) GetAll() (map[string]*mastodon.Application, error) {
+	apps, err := s.store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for serverName := range apps {
+		if s.list.Excludes(serverName) {
+			delete(apps, serverName)
+		}
+	}
+	return apps, nil
+}
+
+func (s *optOutStore) GetAccessToken(serverName string) (string, bool) {
+	tokens, ok := s.store.(TokenStore)
+	if !ok || s.list.Excludes(serverName) {
+		return "", false
+	}
+	return tokens.GetAccessToken(serverName)
+}
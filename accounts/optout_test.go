@@ -0,0 +1,68 @@
+package accounts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-mastodon"
+)
+
+func TestOptOutList_Excludes(t *testing.T) {
+	list, err := ParseOptOutList(strings.NewReader(`
+# comment
+quiet.example
+*.private.example
+https://Shouty.Example/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for server, want := range map[string]bool{
+		"quiet.example":               true,
+		"https://quiet.example":       true,
+		"https://a.private.example":   true,
+		"https://private.example":     false,
+		"shouty.example":              true,
+		"https://mastodon.social":     false,
+		"https://quiet.example.other": false,
+	} {
+		if got := list.Excludes(server); got != want {
+			t.Errorf("Excludes(%q) = %v, want %v", server, got, want)
+		}
+	}
+
+	if _, err := ParseOptOutList(strings.NewReader("[bad")); err == nil {
+		t.Error("expected an error for a malformed glob")
+	}
+}
+
+type mapStore map[string]*mastodon.Application
+
+func (s mapStore) LoadByClientID(string) (*NamedApplication, error) { return nil, nil }
+func (s mapStore) GetByServerName(name string) (*mastodon.Application, error) {
+	return s[name], nil
+}
+func (s mapStore) GetAll() (map[string]*mastodon.Application, error) {
+	all := make(map[string]*mastodon.Application)
+	for k, v := range s {
+		all[k] = v
+	}
+	return all, nil
+}
+
+func TestExcludeOptOuts(t *testing.T) {
+	list, _ := ParseOptOutList(strings.NewReader("quiet.example"))
+	store := ExcludeOptOuts(mapStore{
+		"https://quiet.example": {},
+		"https://loud.example":  {},
+	}, list)
+
+	all, _ := store.GetAll()
+	if len(all) != 1 || all["https://loud.example"] == nil {
+		t.Errorf("GetAll() = %v", all)
+	}
+	if _, err := store.GetByServerName("https://quiet.example"); err == nil {
+		t.Error("expected opted-out server to be refused")
+	}
+}
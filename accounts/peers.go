@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/abreka/proboscideans/ratelimit"
 	"github.com/mattn/go-mastodon"
 )
 
@@ -83,6 +84,7 @@ func GetPeers(
 		ClientID:     app.ClientID,
 		ClientSecret: app.ClientSecret,
 	})
+	client.Client = *ratelimit.Client
 
 	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
@@ -136,6 +138,7 @@ func RegisterAll(
 					defer timeout()
 
 					app, err := mastodon.RegisterApp(ctx, &mastodon.AppConfig{
+						Client:     *ratelimit.Client,
 						Server:     server,
 						ClientName: clientName,
 						Scopes:     requiredAppScopes,
@@ -7,3 +7,9 @@ type Store interface {
 	GetByServerName(serverName string) (*mastodon.Application, error)
 	GetAll() (map[string]*mastodon.Application, error)
 }
+
+// TokenStore is implemented by stores that also keep a user access token
+// for some servers, which is needed for user and list streams.
+type TokenStore interface {
+	GetAccessToken(serverName string) (string, bool)
+}
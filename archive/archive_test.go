@@ -0,0 +1,154 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2022, 11, 20, 9, 0, 0, 0, time.UTC)
+
+// writeSegment writes n envelopes in blocks of about three.
+func writeSegment(t *testing.T, n int) ([]byte, *Writer) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	require.NoError(t, err)
+	w.BlockSize = 1 << 20
+
+	for i := 0; i < n; i++ {
+		require.NoError(t, w.Encode(&streaming.Envelope{
+			Server:     "https://a.example",
+			ReceivedAt: start.Add(time.Duration(i) * time.Second),
+			Stream:     streaming.PublicStream(true),
+			Event:      &mastodon.UpdateEvent{Status: &mastodon.Status{ID: mastodon.ID(fmt.Sprint(i))}},
+		}))
+		if i%3 == 2 {
+			require.NoError(t, w.Flush())
+		}
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes(), w
+}
+
+func readAll(t *testing.T, segment []byte) ([]mastodon.ID, error) {
+	r, err := NewReader(bytes.NewReader(segment))
+	require.NoError(t, err)
+	var ids []mastodon.ID
+	for {
+		envelope, err := r.Decode()
+		if errors.Is(err, io.EOF) {
+			return ids, nil
+		}
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+	}
+}
+
+func ids(from, to int) []mastodon.ID {
+	var ids []mastodon.ID
+	for i := from; i < to; i++ {
+		ids = append(ids, mastodon.ID(fmt.Sprint(i)))
+	}
+	return ids
+}
+
+func TestWriterReader(t *testing.T) {
+	segment, w := writeSegment(t, 10)
+
+	got, err := readAll(t, segment)
+	require.NoError(t, err)
+	require.Equal(t, ids(0, 10), got)
+
+	index, err := ReadIndex(bytes.NewReader(segment), int64(len(segment)))
+	require.NoError(t, err)
+	require.Equal(t, w.Index(), index)
+	require.Len(t, index, 4)
+	require.Equal(t, BlockInfo{Offset: index[1].Offset, Records: 3, First: start.Add(3 * time.Second).UnixNano(), Last: start.Add(5 * time.Second).UnixNano()}, index[1])
+
+	records, err := ReadBlock(bytes.NewReader(segment), index[3])
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+}
+
+func TestReader_Truncated(t *testing.T) {
+	segment, w := writeSegment(t, 10)
+	index := w.Index()
+
+	// Cut in the middle of the third block.
+	torn := segment[:index[2].Offset+10]
+	got, err := readAll(t, torn)
+	require.ErrorIs(t, err, ErrTruncated)
+	require.Equal(t, ids(0, 6), got)
+
+	_, err = ReadIndex(bytes.NewReader(torn), int64(len(torn)))
+	require.ErrorIs(t, err, ErrNoIndex)
+}
+
+func TestRepair(t *testing.T) {
+	segment, w := writeSegment(t, 10)
+	index := w.Index()
+
+	for name, test := range map[string]struct {
+		damage func([]byte) []byte
+		want   []mastodon.ID
+		report RepairReport
+	}{
+		"intact": {
+			damage: func(b []byte) []byte { return b },
+			want:   ids(0, 10),
+			report: RepairReport{Blocks: 4, Records: 10, Indexed: true},
+		},
+		"torn at the end of a block": {
+			damage: func(b []byte) []byte { return b[:index[3].Offset] },
+			want:   ids(0, 9),
+			report: RepairReport{Blocks: 3, Records: 9},
+		},
+		"torn mid block": {
+			damage: func(b []byte) []byte { return b[:index[3].Offset-3] },
+			// Deflate output comes in pieces, so the torn block still
+			// gives up its first two records.
+			want:   ids(0, 8),
+			report: RepairReport{Blocks: 2, DamagedBlocks: 1, Records: 8, Salvaged: 2, SkippedBytes: int64(index[3].Offset - 3 - index[2].Offset)},
+		},
+		"corrupt block in the middle": {
+			damage: func(b []byte) []byte {
+				b = append([]byte(nil), b...)
+				b[index[1].Offset+blockHeaderSize+2] ^= 0xff
+				return b
+			},
+			want: append(ids(0, 3), ids(6, 10)...),
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var repaired bytes.Buffer
+			rw, err := NewWriter(&repaired)
+			require.NoError(t, err)
+
+			report, err := Repair(bytes.NewReader(test.damage(segment)), rw)
+			require.NoError(t, err)
+			if test.report != (RepairReport{}) {
+				require.Equal(t, test.report, report)
+			}
+
+			got, err := readAll(t, repaired.Bytes())
+			require.NoError(t, err)
+			require.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestRepair_NotASegment(t *testing.T) {
+	rw, err := NewWriter(io.Discard)
+	require.NoError(t, err)
+	_, err = Repair(bytes.NewReader([]byte("hello there, not a segment")), rw)
+	require.ErrorIs(t, err, ErrCorrupt)
+}
@@ -0,0 +1,77 @@
+// Package archive is probo's segment format, built to survive being killed
+// mid-write.
+//
+// A segment is a header, a run of blocks and, once it has been closed
+// cleanly, an index:
+//
+//	header  "PROBOARC" version:u32
+//	block   "BLK1" size:u32 records:u32 crc:u32 payload[size]
+//	index   "IDX1" blocks:u32 entries crc:u32
+//	trailer indexOffset:u64 "PROBOEND"
+//
+// Every block's payload is deflated on its own, so a torn block only loses
+// itself. Decompressed, a payload is a run of records:
+//
+//	record  size:u32 crc:u32 data[size]
+//
+// where data is one envelope as JSON. Index entries are offset:u64
+// records:u32 first:i64 last:i64, the last two being the earliest and
+// latest ReceivedAt in the block as Unix nanoseconds. Integers are little
+// endian and checksums are CRC-32C.
+package archive
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// Version is the format version written in the header.
+const Version = 1
+
+const (
+	headerMagic  = "PROBOARC"
+	blockMagic   = "BLK1"
+	indexMagic   = "IDX1"
+	trailerMagic = "PROBOEND"
+
+	headerSize       = 8 + 4
+	blockHeaderSize  = 4 + 4 + 4 + 4
+	recordHeaderSize = 4 + 4
+	indexEntrySize   = 8 + 4 + 8 + 8
+	trailerSize      = 8 + 8
+
+	// maxBlockSize bounds what we'll believe a block header about, so a
+	// corrupt size can't make us allocate gigabytes.
+	maxBlockSize = 64 * 1024 * 1024
+)
+
+var (
+	// ErrCorrupt is returned for anything that fails a checksum or
+	// doesn't parse.
+	ErrCorrupt = errors.New("archive: corrupt segment")
+	// ErrTruncated is returned when a segment ends before its index, e.g.
+	// because it is still being written or its writer was killed.
+	ErrTruncated = errors.New("archive: segment ends without an index")
+	// ErrNoIndex is returned by ReadIndex when a segment has no intact
+	// index.
+	ErrNoIndex = errors.New("archive: no index")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func checksum(b []byte) uint32 {
+	return crc32.Checksum(b, castagnoli)
+}
+
+var le = binary.LittleEndian
+
+// BlockInfo is a block's entry in the index.
+type BlockInfo struct {
+	Offset  int64
+	Records int
+	// First and Last are the earliest and latest ReceivedAt in the block,
+	// in Unix nanoseconds.
+	First int64
+	Last  int64
+}
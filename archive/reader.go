@@ -0,0 +1,235 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/abreka/proboscideans/streaming"
+)
+
+// Reader reads a segment front to back, refusing anything that doesn't
+// check out. Use Repair to get what it can out of a damaged one.
+type Reader struct {
+	r      *bufio.Reader
+	offset int64
+
+	records [][]byte
+	done    bool
+}
+
+// NewReader checks the segment header and returns a Reader for the records
+// after it.
+func NewReader(r io.Reader) (*Reader, error) {
+	sr := &Reader{r: bufio.NewReader(r)}
+	if err := readHeader(sr.r); err != nil {
+		return nil, err
+	}
+	sr.offset = headerSize
+	return sr, nil
+}
+
+func readHeader(r io.Reader) error {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrTruncated
+		}
+		return err
+	}
+	if string(header[:len(headerMagic)]) != headerMagic {
+		return fmt.Errorf("%w: not a segment", ErrCorrupt)
+	}
+	if version := le.Uint32(header[len(headerMagic):]); version != Version {
+		return fmt.Errorf("archive: unsupported version %d", version)
+	}
+	return nil
+}
+
+// Next returns the next record, io.EOF at the index, or ErrTruncated if the
+// segment ends before it.
+func (r *Reader) Next() ([]byte, error) {
+	for len(r.records) == 0 {
+		if r.done {
+			return nil, io.EOF
+		}
+		if err := r.readBlock(); err != nil {
+			return nil, err
+		}
+	}
+	record := r.records[0]
+	r.records = r.records[1:]
+	return record, nil
+}
+
+// Decode returns the next envelope, or io.EOF once there are none left.
+func (r *Reader) Decode() (*streaming.Envelope, error) {
+	record, err := r.Next()
+	if err != nil {
+		return nil, err
+	}
+	var envelope streaming.Envelope
+	if err := json.Unmarshal(record, &envelope); err != nil {
+		return nil, fmt.Errorf("%w: record: %v", ErrCorrupt, err)
+	}
+	return &envelope, nil
+}
+
+func (r *Reader) readBlock() error {
+	magic, err := r.r.Peek(len(blockMagic))
+	switch {
+	case errors.Is(err, io.EOF):
+		return ErrTruncated
+	case err != nil:
+		return err
+	case string(magic) == indexMagic:
+		r.done = true
+		return nil
+	case string(magic) != blockMagic:
+		return fmt.Errorf("%w: no block at offset %d", ErrCorrupt, r.offset)
+	}
+
+	header := make([]byte, blockHeaderSize)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return truncated(err)
+	}
+	size, count, sum := parseBlockHeader(header)
+	if size > maxBlockSize {
+		return fmt.Errorf("%w: block at offset %d claims %d bytes", ErrCorrupt, r.offset, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r.r, payload); err != nil {
+		return truncated(err)
+	}
+	records, err := decodeBlock(r.offset, count, sum, payload)
+	if err != nil {
+		return err
+	}
+
+	r.offset += int64(blockHeaderSize + size)
+	r.records = records
+	return nil
+}
+
+// decodeBlock checks a block's payload against its header and splits it
+// into records.
+func decodeBlock(offset int64, count int, sum uint32, payload []byte) ([][]byte, error) {
+	if checksum(payload) != sum {
+		return nil, fmt.Errorf("%w: bad checksum on block at offset %d", ErrCorrupt, offset)
+	}
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: block at offset %d: %v", ErrCorrupt, offset, err)
+	}
+	records, ok := parseRecords(data)
+	if !ok || len(records) != count {
+		return nil, fmt.Errorf("%w: bad records in block at offset %d", ErrCorrupt, offset)
+	}
+	return records, nil
+}
+
+func parseBlockHeader(header []byte) (size int, count int, sum uint32) {
+	return int(le.Uint32(header[4:])), int(le.Uint32(header[8:])), le.Uint32(header[12:])
+}
+
+// parseRecords splits a decompressed block into records. It stops at the
+// first record that is cut short or fails its checksum, since the lengths
+// after that can't be trusted, and reports whether it got to the end.
+func parseRecords(data []byte) ([][]byte, bool) {
+	var records [][]byte
+	for len(data) > 0 {
+		if len(data) < recordHeaderSize {
+			return records, false
+		}
+		size := int(le.Uint32(data[:4]))
+		sum := le.Uint32(data[4:8])
+		data = data[recordHeaderSize:]
+		if size > len(data) || checksum(data[:size]) != sum {
+			return records, false
+		}
+		records = append(records, data[:size:size])
+		data = data[size:]
+	}
+	return records, true
+}
+
+func truncated(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrTruncated
+	}
+	return err
+}
+
+// ReadIndex reads the index at the end of a segment of the given size. It
+// returns ErrNoIndex if the segment wasn't closed cleanly.
+func ReadIndex(r io.ReaderAt, size int64) ([]BlockInfo, error) {
+	if size < int64(headerSize+trailerSize) {
+		return nil, ErrNoIndex
+	}
+	trailer := make([]byte, trailerSize)
+	if _, err := r.ReadAt(trailer, size-trailerSize); err != nil {
+		return nil, err
+	}
+	if string(trailer[8:]) != trailerMagic {
+		return nil, ErrNoIndex
+	}
+
+	indexOffset := int64(le.Uint64(trailer))
+	indexSize := size - trailerSize - indexOffset
+	if indexOffset < headerSize || indexSize < int64(len(indexMagic)+8) || indexSize > maxBlockSize {
+		return nil, fmt.Errorf("%w: bad index offset %d", ErrCorrupt, indexOffset)
+	}
+	index := make([]byte, indexSize)
+	if _, err := r.ReadAt(index, indexOffset); err != nil {
+		return nil, err
+	}
+	if string(index[:len(indexMagic)]) != indexMagic {
+		return nil, fmt.Errorf("%w: no index at offset %d", ErrCorrupt, indexOffset)
+	}
+
+	body := index[len(indexMagic) : len(index)-4]
+	if checksum(body) != le.Uint32(index[len(index)-4:]) {
+		return nil, fmt.Errorf("%w: bad index checksum", ErrCorrupt)
+	}
+	count := int(le.Uint32(body))
+	entries := body[4:]
+	if len(entries) != count*indexEntrySize {
+		return nil, fmt.Errorf("%w: index has %d bytes for %d blocks", ErrCorrupt, len(entries), count)
+	}
+
+	blocks := make([]BlockInfo, count)
+	for i := range blocks {
+		entry := entries[i*indexEntrySize:]
+		blocks[i] = BlockInfo{
+			Offset:  int64(le.Uint64(entry[0:])),
+			Records: int(le.Uint32(entry[8:])),
+			First:   int64(le.Uint64(entry[12:])),
+			Last:    int64(le.Uint64(entry[20:])),
+		}
+	}
+	return blocks, nil
+}
+
+// ReadBlock reads the records of one block, e.g. one found in the index.
+func ReadBlock(r io.ReaderAt, info BlockInfo) ([][]byte, error) {
+	header := make([]byte, blockHeaderSize)
+	if _, err := r.ReadAt(header, info.Offset); err != nil {
+		return nil, truncated(err)
+	}
+	if string(header[:len(blockMagic)]) != blockMagic {
+		return nil, fmt.Errorf("%w: no block at offset %d", ErrCorrupt, info.Offset)
+	}
+	size, count, sum := parseBlockHeader(header)
+	if size > maxBlockSize {
+		return nil, fmt.Errorf("%w: block at offset %d claims %d bytes", ErrCorrupt, info.Offset, size)
+	}
+	payload := make([]byte, size)
+	if _, err := r.ReadAt(payload, info.Offset+blockHeaderSize); err != nil {
+		return nil, truncated(err)
+	}
+	return decodeBlock(info.Offset, count, sum, payload)
+}
@@ -0,0 +1,150 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+// RepairReport says what Repair found in a segment.
+type RepairReport struct {
+	// Blocks counts the blocks that were intact, and DamagedBlocks the ones
+	// that were torn or failed their checksum.
+	Blocks        int `json:"blocks"`
+	DamagedBlocks int `json:"damaged_blocks"`
+
+	// Records counts every record written to the repaired segment, and
+	// Salvaged the ones among them that came out of damaged blocks.
+	Records  int `json:"records"`
+	Salvaged int `json:"salvaged"`
+
+	// SkippedBytes counts bytes that didn't belong to any block we could
+	// find, e.g. garbage after a crash.
+	SkippedBytes int64 `json:"skipped_bytes"`
+
+	// Indexed is set if the segment had been closed cleanly.
+	Indexed bool `json:"indexed"`
+}
+
+// Repair copies every complete record it can find in a segment to w, which
+// ends up a clean segment of its own. Intact blocks are copied whole. From
+// a damaged block it keeps as many records as decompress and pass their
+// checksums, then goes looking for the next block.
+func Repair(r io.Reader, w *Writer) (RepairReport, error) {
+	var report RepairReport
+
+	br := bufio.NewReaderSize(r, blockHeaderSize+maxBlockSize)
+	if err := readHeader(br); err != nil {
+		return report, err
+	}
+
+	appendAll := func(records [][]byte) error {
+		for _, record := range records {
+			if err := w.Append(record, receivedAt(record)); err != nil {
+				return err
+			}
+		}
+		report.Records += len(records)
+		return nil
+	}
+
+	for {
+		magic, err := br.Peek(len(blockMagic))
+		if errors.Is(err, io.EOF) {
+			// Whatever was left was shorter than a block header.
+			report.SkippedBytes += int64(len(magic))
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+
+		if string(magic) == indexMagic {
+			report.Indexed = true
+			break
+		}
+		if string(magic) != blockMagic {
+			if _, err := br.Discard(1); err != nil {
+				return report, err
+			}
+			report.SkippedBytes++
+			continue
+		}
+
+		header, err := br.Peek(blockHeaderSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return report, err
+		}
+		if len(header) < blockHeaderSize {
+			report.DamagedBlocks++
+			report.SkippedBytes += int64(len(header))
+			break
+		}
+		size, count, sum := parseBlockHeader(header)
+		if size > maxBlockSize {
+			// Not a real block header, or a mangled one.
+			if _, err := br.Discard(1); err != nil {
+				return report, err
+			}
+			report.SkippedBytes++
+			continue
+		}
+
+		block, err := br.Peek(blockHeaderSize + size)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return report, err
+		}
+		payload := block[blockHeaderSize:]
+
+		if len(payload) == size {
+			if records, err := decodeBlock(0, count, sum, payload); err == nil {
+				if err := appendAll(records); err != nil {
+					return report, err
+				}
+				report.Blocks++
+				if _, err := br.Discard(len(block)); err != nil {
+					return report, err
+				}
+				continue
+			}
+		}
+
+		// Torn or corrupt: keep what we can, then look for the next block
+		// just past this one's magic in case its size was wrong. A size
+		// running past the end is as likely to be garbage as a torn tail.
+		report.DamagedBlocks++
+		salvaged := salvageRecords(payload)
+		if err := appendAll(salvaged); err != nil {
+			return report, err
+		}
+		report.Salvaged += len(salvaged)
+		if _, err := br.Discard(len(blockMagic)); err != nil {
+			return report, err
+		}
+		report.SkippedBytes += int64(len(blockMagic))
+	}
+
+	return report, w.Close()
+}
+
+// salvageRecords decompresses as much of a damaged payload as it can and
+// keeps the records that are whole.
+func salvageRecords(payload []byte) [][]byte {
+	data, _ := io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+	records, _ := parseRecords(data)
+	return records
+}
+
+// receivedAt digs the time out of a record for the index, or returns the
+// zero time if it isn't there.
+func receivedAt(record []byte) time.Time {
+	var envelope struct {
+		ReceivedAt time.Time `json:"received_at"`
+	}
+	_ = json.Unmarshal(record, &envelope)
+	return envelope.ReceivedAt
+}
@@ -0,0 +1,183 @@
+package archive
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/abreka/proboscideans/streaming"
+)
+
+// DefaultBlockSize is how much uncompressed data a Writer collects before
+// writing a block.
+const DefaultBlockSize = 256 * 1024
+
+// Writer writes a segment. Records are collected into a block in memory
+// and only reach w once the block is full or Flush is called, so that is
+// what bounds how much a crash can lose.
+type Writer struct {
+	// BlockSize is the uncompressed size at which a block is written.
+	BlockSize int
+
+	w      io.Writer
+	offset int64
+	err    error
+
+	block   bytes.Buffer
+	records int
+	first   int64
+	last    int64
+	index   []BlockInfo
+
+	compressed bytes.Buffer
+	deflate    *flate.Writer
+}
+
+// NewWriter writes a segment header to w and returns a Writer for the rest
+// of the segment.
+func NewWriter(w io.Writer) (*Writer, error) {
+	deflate, err := flate.NewWriter(nil, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	sw := &Writer{BlockSize: DefaultBlockSize, w: w, deflate: deflate}
+
+	header := make([]byte, headerSize)
+	copy(header, headerMagic)
+	le.PutUint32(header[len(headerMagic):], Version)
+	if err := sw.write(header); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+// Encode appends an envelope.
+func (w *Writer) Encode(envelope *streaming.Envelope) error {
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return w.Append(b, envelope.ReceivedAt)
+}
+
+// Append adds a record received at the given time to the current block.
+func (w *Writer) Append(record []byte, receivedAt time.Time) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	var header [recordHeaderSize]byte
+	le.PutUint32(header[:4], uint32(len(record)))
+	le.PutUint32(header[4:], checksum(record))
+	w.block.Write(header[:])
+	w.block.Write(record)
+
+	at := receivedAt.UnixNano()
+	if w.records == 0 || at < w.first {
+		w.first = at
+	}
+	if w.records == 0 || at > w.last {
+		w.last = at
+	}
+	w.records++
+
+	if w.block.Len() >= w.BlockSize {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Flush writes out the current block, if it has anything in it. It
+// doesn't sync; that's up to whoever owns w.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.records == 0 {
+		return nil
+	}
+
+	w.compressed.Reset()
+	w.deflate.Reset(&w.compressed)
+	if _, err := w.deflate.Write(w.block.Bytes()); err != nil {
+		return err
+	}
+	if err := w.deflate.Close(); err != nil {
+		return err
+	}
+	payload := w.compressed.Bytes()
+
+	header := make([]byte, blockHeaderSize)
+	copy(header, blockMagic)
+	le.PutUint32(header[4:], uint32(len(payload)))
+	le.PutUint32(header[8:], uint32(w.records))
+	le.PutUint32(header[12:], checksum(payload))
+
+	info := BlockInfo{Offset: w.offset, Records: w.records, First: w.first, Last: w.last}
+	if err := w.write(header); err != nil {
+		return err
+	}
+	if err := w.write(payload); err != nil {
+		return err
+	}
+	w.index = append(w.index, info)
+
+	w.block.Reset()
+	w.records = 0
+	return nil
+}
+
+// Close flushes the last block and writes the index. It doesn't close w.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	indexOffset := w.offset
+	index := make([]byte, len(indexMagic)+4, len(indexMagic)+4+len(w.index)*indexEntrySize+4+trailerSize)
+	copy(index, indexMagic)
+	le.PutUint32(index[len(indexMagic):], uint32(len(w.index)))
+	for _, info := range w.index {
+		var entry [indexEntrySize]byte
+		le.PutUint64(entry[0:], uint64(info.Offset))
+		le.PutUint32(entry[8:], uint32(info.Records))
+		le.PutUint64(entry[12:], uint64(info.First))
+		le.PutUint64(entry[20:], uint64(info.Last))
+		index = append(index, entry[:]...)
+	}
+	var tail [4 + trailerSize]byte
+	le.PutUint32(tail[0:], checksum(index[len(indexMagic):]))
+	le.PutUint64(tail[4:], uint64(indexOffset))
+	copy(tail[12:], trailerMagic)
+	index = append(index, tail[:]...)
+
+	if err := w.write(index); err != nil {
+		return err
+	}
+	w.err = errors.New("archive: writer is closed")
+	return nil
+}
+
+// Index returns the blocks written so far.
+func (w *Writer) Index() []BlockInfo {
+	return append([]BlockInfo(nil), w.index...)
+}
+
+// Size returns how many bytes have been written to w.
+func (w *Writer) Size() int64 {
+	return w.offset
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.offset += int64(n)
+	if err != nil {
+		// Whatever is on disk now ends mid-block; writing more after it
+		// would only bury good blocks behind a bad one.
+		w.err = err
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/abreka/proboscideans/archive"
+	"github.com/abreka/proboscideans/sink"
+	"github.com/spf13/cobra"
+)
+
+var repairOutput string
+
+func initArchiveCmd() {
+	archiveCmd.AddCommand(archiveRepairCmd)
+	archiveRepairCmd.Flags().StringVarP(&repairOutput, "output", "o", "", "Where to write the repaired segment (only with a single segment)")
+}
+
+var archiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "work with archive segments",
+}
+
+var archiveRepairCmd = &cobra.Command{
+	Use:   "repair segment-or-dir...",
+	Short: "salvage every complete record from torn or damaged segments",
+	Long: `repair copies every complete record out of a segment into a new, clean one.
+
+A segment left as ` + "`name.probo" + sink.PartialSuffix + "`" + ` by a crash is repaired to ` + "`name.probo`" + `,
+anything else to ` + "`name.repaired.probo`" + `. Directories are searched for
+` + sink.PartialSuffix + ` segments. Originals are left alone.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var segments []string
+		for _, arg := range args {
+			info, err := os.Stat(arg)
+			if err != nil {
+				cmd.PrintErrf("Unable to read %s: %s\n", arg, err)
+				os.Exit(1)
+			}
+			if !info.IsDir() {
+				segments = append(segments, arg)
+				continue
+			}
+			partials, err := filepath.Glob(filepath.Join(arg, "*"+sink.FormatBlocks.Ext()+sink.PartialSuffix))
+			if err != nil {
+				cmd.PrintErrf("Unable to list %s: %s\n", arg, err)
+				os.Exit(1)
+			}
+			segments = append(segments, partials...)
+		}
+		if repairOutput != "" && len(segments) != 1 {
+			cmd.PrintErrln("--output needs exactly one segment")
+			os.Exit(1)
+		}
+
+		failed := false
+		for _, segment := range segments {
+			output := repairOutput
+			if output == "" {
+				output = repairedPath(segment)
+			}
+			report, err := repairSegment(segment, output)
+			if err != nil {
+				cmd.PrintErrf("Unable to repair %s: %s\n", segment, err)
+				failed = true
+				continue
+			}
+
+			asJson, err := json.Marshal(struct {
+				Segment string `json:"segment"`
+				Output  string `json:"output"`
+				archive.RepairReport
+			}{segment, output, report})
+			if err != nil {
+				cmd.PrintErrf("Unable to marshal report: %s\n", err)
+				os.Exit(1)
+			}
+			cmd.Println(string(asJson))
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func repairedPath(segment string) string {
+	if strings.HasSuffix(segment, sink.PartialSuffix) {
+		return strings.TrimSuffix(segment, sink.PartialSuffix)
+	}
+	ext := sink.FormatBlocks.Ext()
+	return strings.TrimSuffix(segment, ext) + ".repaired" + ext
+}
+
+// repairSegment writes the repaired segment next to its final path and
+// only renames it into place once it's complete.
+func repairSegment(segment, output string) (archive.RepairReport, error) {
+	if _, err := os.Stat(output); err == nil {
+		return archive.RepairReport{}, fmt.Errorf("%s already exists", output)
+	}
+
+	in, err := os.Open(segment)
+	if err != nil {
+		return archive.RepairReport{}, err
+	}
+	defer func() { _ = in.Close() }()
+
+	tmpPath := output + ".tmp"
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return archive.RepairReport{}, err
+	}
+	defer func() { _ = os.Remove(tmpPath) }()
+	defer func() { _ = out.Close() }()
+
+	w, err := archive.NewWriter(out)
+	if err != nil {
+		return archive.RepairReport{}, err
+	}
+	report, err := archive.Repair(in, w)
+	if err != nil {
+		return report, err
+	}
+	if err := out.Sync(); err != nil {
+		return report, err
+	}
+	if err := out.Close(); err != nil {
+		return report, err
+	}
+	return report, os.Rename(tmpPath, output)
+}
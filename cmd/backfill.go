@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/spf13/cobra"
+)
+
+var (
+	backfillUntil       string
+	backfillStream      string
+	backfillProgress    string
+	backfillInterval    time.Duration
+	backfillConcurrency int
+)
+
+func initBackfillCmd() {
+	backfillCmd.Flags().StringVar(&backfillUntil, "until", "", "Page back to statuses created at this date or time (YYYY-MM-DD or RFC 3339)")
+	backfillCmd.Flags().StringVar(&backfillStream, "stream", "local", "Timeline to page through: local, federated, hashtag:tag, ...")
+	backfillCmd.Flags().StringVar(&backfillProgress, "progress", "backfill-progress.json", "File recording how far back each server got, to resume from")
+	backfillCmd.Flags().DurationVar(&backfillInterval, "interval", time.Second, "Least time between requests to the same server")
+	backfillCmd.Flags().IntVar(&backfillConcurrency, "concurrency", 8, "Servers to page through at once")
+	backfillCmd.Flags().StringVar(&optedOut, "opted-out", string(streaming.OptOutDrop), "What to do with statuses from accounts that opted out of indexing: drop or redact")
+	addArchiveFlags(backfillCmd, backfillNameTemplate)
+	backfillCmd.Flags().StringVar(&policyReport, "policy-report", "", "Write counts of everything dropped or redacted for opt-outs to this path (rewritten every minute and on exit)")
+	_ = backfillCmd.MarkFlagRequired("until")
+}
+
+// backfillNameTemplate keeps backfilled segments apart from streamed ones in
+// the same directory.
+const backfillNameTemplate = `backfill-{{.Start.Format "20060102T150405Z"}}-{{.Seq}}{{.Ext}}`
+
+var backfillCmd = &cobra.Command{
+	Use:   "backfill [credentials-dir]",
+	Short: "fetch the history of public timelines from multiple instances",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		warnIfNoContact(cmd)
+
+		until, err := parseDate(backfillUntil)
+		if err != nil {
+			cmd.PrintErrf("Invalid --until: %s\n", err)
+			os.Exit(1)
+		}
+		spec, err := streaming.ParseStreamSpec(backfillStream)
+		if err != nil {
+			cmd.PrintErrf("Invalid --stream: %s\n", err)
+			os.Exit(1)
+		}
+
+		dirStore, err := accounts.NewDirectoryStorage(args[0])
+		if err != nil {
+			cmd.PrintErrf("Unable to create directory storage: %s\n", err)
+			os.Exit(1)
+		}
+		ds := accounts.ExcludeOptOuts(dirStore, optOutList)
+
+		progress, err := streaming.OpenHistoryProgress(backfillProgress)
+		if err != nil {
+			cmd.PrintErrf("Unable to load progress: %s\n", err)
+			os.Exit(1)
+		}
+
+		archive := openArchive(cmd)
+
+		sd := newShutdown(cmd)
+		defer sd.Done()
+		go maintainArchive(sd.Deadline, cmd, archive)
+
+		// Servers are only paged through once we know their rules allow it.
+		policy := newPolicy(cmd, nil)
+		history := streaming.NewHistory(until)
+		history.Spec = spec
+		history.Interval = backfillInterval
+		history.Concurrency = backfillConcurrency
+		history.Check = func(ctx context.Context, serverName string) error {
+			if err := policy.Wait(ctx, serverName); err != nil {
+				return err
+			}
+			if rule, forbidden := policy.ForbiddingRule(serverName); forbidden {
+				return fmt.Errorf("its rules say: %q", rule)
+			}
+			return nil
+		}
+		emit := func(envelope *streaming.Envelope) error {
+			if envelope = policy.Apply(sd.Stopping, envelope); envelope == nil {
+				return nil
+			}
+			return archive.Write(envelope)
+		}
+		// Progress is only saved once what it covers is on disk.
+		history.Flush = archive.Flush
+
+		if policyReport != "" {
+			go writeReports(sd.Stopping, cmd, "policy", policyReport, time.Minute, func() interface{} { return policy.Stats() })
+		}
+
+		results, err := history.Run(sd.Stopping, ds, progress, emit)
+		if err != nil {
+			cmd.PrintErrf("Unable to start backfill: %s\n", err)
+			os.Exit(1)
+		}
+
+		for result := range results {
+			switch {
+			case result.Err != nil:
+				cmd.PrintErrf("%s: stopped after %d statuses: %s\n", result.Server, result.Statuses, result.Err)
+			case result.Cursor.Oldest.IsZero():
+				cmd.PrintErrf("%s: done, %d statuses\n", result.Server, result.Statuses)
+			default:
+				cmd.PrintErrf("%s: done, %d statuses back to %s\n", result.Server, result.Statuses, result.Cursor.Oldest.Format(time.RFC3339))
+			}
+		}
+
+		if policyReport != "" {
+			if err := writeReport(policyReport, policy.Stats()); err != nil {
+				cmd.PrintErrf("Unable to write policy report: %s\n", err)
+			}
+		}
+
+		// Every server has stopped writing by now.
+		if err := archive.Close(); err != nil {
+			cmd.PrintErrf("Unable to close archive: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// parseDate accepts a bare date, taken as midnight UTC, or an RFC 3339 time.
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/spf13/cobra"
+)
+
+// Flags for the commands that stream from many servers through a Mux.
+var (
+	maxRetries    int
+	maxBackoff    time.Duration
+	watchInterval time.Duration
+	federated     bool
+	hashtag       string
+	userStream    bool
+	subscriptions string
+	dedupWindow   time.Duration
+	dedupHold     time.Duration
+	dedupMax      int
+
+	stallTimeout time.Duration
+	stallFactor  float64
+
+	bufferPerServer int
+	bufferGlobal    int
+	overflow        string
+
+	websocketServers []string
+	fallbackAfter    int
+	pollMinInterval  time.Duration
+	pollMaxInterval  time.Duration
+
+	checkpointsPath string
+	backfillPages   int
+
+	optedOut string
+)
+
+func addMuxFlags(c *cobra.Command) {
+	c.Flags().IntVar(&maxRetries, "max-retries", streaming.DefaultRetryPolicy.MaxRetries, "Consecutive failures before giving up on a server (negative retries forever)")
+	c.Flags().DurationVar(&maxBackoff, "max-backoff", streaming.DefaultRetryPolicy.MaxBackoff, "Upper bound on the wait between reconnects")
+	c.Flags().DurationVar(&watchInterval, "watch-interval", 0, "How often to check the credentials dir for new servers (0 disables)")
+	c.Flags().BoolVar(&federated, "federated", false, "Stream the federated timeline instead of the local one")
+	c.Flags().StringVar(&hashtag, "hashtag", "", "Follow this hashtag instead of the public timeline (local unless --federated)")
+	c.Flags().BoolVar(&userStream, "user", false, "Follow the user stream on servers with an access token instead of the public timeline")
+	c.Flags().StringVar(&subscriptions, "subscriptions", "", "JSON file choosing the streams to follow on each server (reloaded every --watch-interval)")
+	c.Flags().DurationVar(&dedupWindow, "dedup-window", 0, "Drop copies of a status seen again within this window (0 disables)")
+	c.Flags().DurationVar(&dedupHold, "dedup-hold", 0, "Hold statuses this long to record every server that delivered them")
+	c.Flags().IntVar(&dedupMax, "dedup-max-entries", 1000000, "Maximum number of statuses remembered for deduplication")
+	c.Flags().DurationVar(&stallTimeout, "stall-timeout", streaming.DefaultStallPolicy.MaxIdle, "Reconnect streams that send nothing for this long (0 disables)")
+	c.Flags().Float64Var(&stallFactor, "stall-factor", streaming.DefaultStallPolicy.Factor, "Reconnect busy streams sooner, after this many times their usual gap between events (0 disables)")
+	c.Flags().IntVar(&bufferPerServer, "buffer-per-server", streaming.DefaultBufferPolicy.PerServer, "Events buffered for each server")
+	c.Flags().IntVar(&bufferGlobal, "buffer-global", streaming.DefaultBufferPolicy.Global, "Events buffered across all servers")
+	c.Flags().StringVar(&overflow, "overflow", string(streaming.DefaultBufferPolicy.Overflow), "What to do when a server's buffer is full: block, drop-oldest or drop-newest")
+	c.Flags().StringSliceVar(&websocketServers, "websocket", nil, "Stream from servers whose host matches these globs over one WebSocket each (\"*\" for all)")
+	c.Flags().IntVar(&fallbackAfter, "fallback-after", 3, "Poll timelines instead after this many failed stream attempts in a row (0 only on refusals, negative never)")
+	c.Flags().DurationVar(&pollMinInterval, "poll-min-interval", streaming.DefaultPollingTransport.MinInterval, "Shortest wait between polls of a busy timeline")
+	c.Flags().DurationVar(&pollMaxInterval, "poll-max-interval", streaming.DefaultPollingTransport.MaxInterval, "Longest wait between polls of a quiet timeline")
+	c.Flags().StringVar(&checkpointsPath, "checkpoints", "", "Keep the last status written out on every stream in this file so restarts can backfill")
+	c.Flags().IntVar(&backfillPages, "backfill-pages", streaming.DefaultBackfillPolicy.MaxPages, "Pages of statuses to fetch after a reconnect to fill the gap (0 disables)")
+	c.Flags().StringVar(&optedOut, "opted-out", string(streaming.OptOutDrop), "What to do with statuses from accounts that opted out of indexing: drop or redact")
+}
+
+// openMux sets up a Mux for every server in the store as the mux flags say.
+func openMux(cmd *cobra.Command, ds accounts.Store) *streaming.Mux {
+	mux, err := streaming.NewMuxFromCredentialsDir(ds)
+	if err != nil {
+		cmd.PrintErrf("Unable to create mux: %s\n", err)
+		os.Exit(1)
+	}
+	mux.RetryPolicy.MaxRetries = maxRetries
+	mux.RetryPolicy.MaxBackoff = maxBackoff
+
+	mux.StallPolicy.MaxIdle = stallTimeout
+	mux.StallPolicy.Factor = stallFactor
+
+	if len(websocketServers) > 0 {
+		ws := streaming.NewWebSocketTransport()
+		mux.TransportFor = func(serverName string) streaming.Transport {
+			if accounts.MatchHost(websocketServers, serverName) {
+				return ws
+			}
+			return nil
+		}
+	}
+
+	mux.FallbackAfter = fallbackAfter
+	if fallbackAfter < 0 {
+		mux.Fallback = nil
+	} else {
+		if pollMinInterval <= 0 || pollMaxInterval < pollMinInterval {
+			cmd.PrintErrln("--poll-min-interval must be positive and no longer than --poll-max-interval")
+			os.Exit(1)
+		}
+		mux.Fallback = &streaming.PollingTransport{
+			MinInterval: pollMinInterval,
+			MaxInterval: pollMaxInterval,
+			Limit:       streaming.DefaultPollingTransport.Limit,
+		}
+	}
+
+	mux.Backfill.MaxPages = backfillPages
+	if checkpointsPath != "" {
+		mux.Checkpoints, err = streaming.OpenCheckpoints(checkpointsPath)
+		if err != nil {
+			cmd.PrintErrf("Unable to load checkpoints: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	overflowPolicy, err := streaming.ParseOverflowPolicy(overflow)
+	if err != nil {
+		cmd.PrintErrf("Invalid --overflow: %s\n", err)
+		os.Exit(1)
+	}
+	mux.BufferPolicy = streaming.DefaultBufferPolicy
+	mux.BufferPolicy.PerServer = bufferPerServer
+	mux.BufferPolicy.Global = bufferGlobal
+	mux.BufferPolicy.Overflow = overflowPolicy
+	// What's buffered when we're told to stop gets as long to drain as the
+	// rest of the shutdown.
+	mux.BufferPolicy.Drain = shutdownTimeout
+
+	return mux
+}
+
+// startStreams starts following whatever the flags picked on every server,
+// until ctx is done. It also keeps the checkpoints saved and, with
+// --watch-interval, picks up new servers and subscription changes.
+func startStreams(ctx context.Context, cmd *cobra.Command, mux *streaming.Mux, ds accounts.Store) (<-chan *streaming.Envelope, <-chan *streaming.StreamError) {
+	var events <-chan *streaming.Envelope
+	var errs <-chan *streaming.StreamError
+	switch {
+	case subscriptions != "":
+		if userStream || hashtag != "" {
+			cmd.PrintErrln("--subscriptions can't be combined with --user or --hashtag")
+			os.Exit(1)
+		}
+		spec, err := streaming.LoadSubscriptionSpec(subscriptions)
+		if err != nil {
+			cmd.PrintErrf("Unable to load subscriptions: %s\n", err)
+			os.Exit(1)
+		}
+		events, errs = mux.Subscribe(ctx, spec)
+		if watchInterval > 0 {
+			go watchSubscriptions(ctx, cmd, mux)
+		}
+	case userStream:
+		events, errs = mux.StreamUser(ctx)
+	case hashtag != "":
+		events, errs = mux.StreamHashtag(ctx, strings.TrimPrefix(hashtag, "#"), !federated)
+	default:
+		events, errs = mux.StreamPublic(ctx, !federated)
+	}
+
+	if checkpointsPath != "" {
+		go func() {
+			for err := range mux.Checkpoints.Run(ctx, time.Minute) {
+				cmd.PrintErrf("Unable to save checkpoints: %s\n", err)
+			}
+		}()
+	}
+
+	if watchInterval > 0 {
+		go func() {
+			for update := range mux.WatchStore(ctx, ds, watchInterval) {
+				if update.Err != nil {
+					cmd.PrintErrf("Unable to reload credentials: %s\n", update.Err)
+					continue
+				}
+				cmd.PrintErrf("Streaming new server %s\n", update.Server)
+			}
+		}()
+	}
+
+	return events, errs
+}
+
+// newPolicy returns the opt-out policy for --opted-out. Servers whose rules
+// turn out to forbid collection are dropped from the mux, if there is one,
+// for good.
+func newPolicy(cmd *cobra.Command, mux *streaming.Mux) *streaming.Policy {
+	optOutAction, err := streaming.ParseOptOutAction(optedOut)
+	if err != nil {
+		cmd.PrintErrf("Invalid --opted-out: %s\n", err)
+		os.Exit(1)
+	}
+
+	policy := streaming.NewPolicy()
+	policy.Action = optOutAction
+	policy.Excluded = optOutList.Excludes
+	policy.OnForbidden = func(server string) {
+		rule, _ := policy.ForbiddingRule(server)
+		cmd.PrintErrf("Not collecting from %s, its rules say: %q\n", server, rule)
+		// The Mux keeps it out by itself, but the rest of probo should too.
+		optOutList.Add(server)
+		if mux != nil {
+			_ = mux.RemoveServer(server)
+		}
+	}
+	return policy
+}
+
+// dedupStage deduplicates events if the dedup flags ask for it.
+func dedupStage(ctx context.Context, events <-chan *streaming.Envelope) <-chan *streaming.Envelope {
+	if dedupWindow <= 0 && dedupHold <= 0 {
+		return events
+	}
+	dedup := &streaming.Deduplicator{Hold: dedupHold, Window: dedupWindow, MaxEntries: dedupMax}
+	return dedup.Run(ctx, events)
+}
+
+// watchSubscriptions reloads the subscriptions file whenever it changes.
+func watchSubscriptions(ctx context.Context, cmd *cobra.Command, mux *streaming.Mux) {
+	var lastMod time.Time
+	if info, err := os.Stat(subscriptions); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(subscriptions)
+		if err != nil {
+			cmd.PrintErrf("Unable to check subscriptions: %s\n", err)
+			continue
+		}
+		if !info.ModTime().After(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		spec, err := streaming.LoadSubscriptionSpec(subscriptions)
+		if err != nil {
+			cmd.PrintErrf("Unable to reload subscriptions, keeping the old ones: %s\n", err)
+			continue
+		}
+		mux.UpdateSubscriptions(spec)
+		cmd.PrintErrf("Reloaded subscriptions from %s\n", subscriptions)
+	}
+}
@@ -1,7 +1,6 @@
 package cmd
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"os"
@@ -21,6 +20,8 @@ var registerAllCmd = &cobra.Command{
 	Short: "register all instances by crawling peers breadth-first",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
+		warnIfNoContact(cmd)
+
 		// TODO: cleanup refactor
 		// This code is ugly as shit
 		ds, err := accounts.NewDirectoryStorage(args[0])
@@ -29,7 +30,9 @@ var registerAllCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		existing, err := ds.GetAll()
+		store := accounts.ExcludeOptOuts(ds, optOutList)
+
+		existing, err := store.GetAll()
 		if err != nil {
 			cmd.PrintErrf("Unable to get existing accounts: %s\n", err)
 			os.Exit(1)
@@ -54,6 +57,12 @@ var registerAllCmd = &cobra.Command{
 			cmd.PrintErrf("Unable to open snapshot file: %s\n", err)
 			os.Exit(1)
 		}
+		defer func() { _ = snapshotFp.Close() }()
+
+		// On a signal, finish writing what has come back and stop.
+		sd := newShutdown(cmd)
+		defer sd.Done()
+		ctx := sd.Stopping
 
 		for {
 			skip := make(map[string]bool)
@@ -65,12 +74,16 @@ var registerAllCmd = &cobra.Command{
 			}
 
 			peersCh := accounts.GetAllPeers(
-				context.Background(), existing, concurrency, visited, 10*time.Second,
+				ctx, existing, concurrency, visited, 10*time.Second,
 			)
 
 			for peer := range peersCh {
 				visited[peer.Server] = true
 
+				if peer.Err != nil && ctx.Err() != nil {
+					// Cut short by the shutdown rather than the server.
+					continue
+				}
 				if peer.Err != nil {
 					cmd.PrintErrf("Error getting peers for %s: %s\n", peer.Server, peer.Err)
 					errored[peer.Server] = true
@@ -98,12 +111,17 @@ var registerAllCmd = &cobra.Command{
 						peer = "https://" + peer
 					}
 
-					if existing[peer] == nil && !errored[peer] {
+					if existing[peer] == nil && !errored[peer] && !optOutList.Excludes(peer) {
 						frontier[peer] = true
 					}
 				}
 			}
 
+			if ctx.Err() != nil {
+				cmd.Printf("Stopped with %d peers left to visit\n", len(frontier))
+				break
+			}
+
 			// If the frontier is empty, we're done.
 			if len(frontier) == 0 {
 				cmd.Printf("No more peers to visit. Done.\n")
@@ -113,7 +131,7 @@ var registerAllCmd = &cobra.Command{
 			cmd.Printf("Visiting %d new peers\n", len(frontier))
 
 			registrations := accounts.RegisterAll(
-				context.Background(),
+				ctx,
 				frontier,
 				concurrency,
 				10*time.Second,
@@ -125,6 +143,9 @@ var registerAllCmd = &cobra.Command{
 			nAttemped := 0
 			for registration := range registrations {
 				nAttemped++
+				if registration.Err != nil && ctx.Err() != nil {
+					continue
+				}
 				if registration.Err != nil {
 					cmd.PrintErrf("Error registering %s: %s\n", registration.Server, registration.Err)
 					errored[registration.Server] = true
@@ -141,12 +162,15 @@ var registerAllCmd = &cobra.Command{
 			}
 
 			cmd.Printf("Attempted to register %d peers\n", nAttemped)
+			if ctx.Err() != nil {
+				break
+			}
 
 			// Clear the frontier.
 			frontier = make(map[string]bool)
 
 			// Refresh
-			existing, err = ds.GetAll()
+			existing, err = store.GetAll()
 			if err != nil {
 				cmd.PrintErrf("Unable to get existing accounts: %s\n", err)
 				os.Exit(1)
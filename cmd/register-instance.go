@@ -6,6 +6,8 @@ import (
 	"os"
 
 	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/identity"
+	"github.com/abreka/proboscideans/ratelimit"
 
 	"github.com/mattn/go-mastodon"
 	"github.com/spf13/cobra"
@@ -26,7 +28,7 @@ func initRegisterFlags(cmd *cobra.Command) {
 	cmd.Flags().StringVar(&server, "server", "https://mastodon.social", "The server to register the app with")
 	cmd.Flags().StringVar(&clientName, "client-name", "proboscideans", "The name of the app")
 	cmd.Flags().StringVar(&requiredAppScopes, "scopes", "read", "The scopes required by the app")
-	cmd.Flags().StringVar(&appWebsite, "website", "https://twitter.com/generativist", "The website of the app")
+	cmd.Flags().StringVar(&appWebsite, "website", identity.ProjectURL, "The website of the app")
 }
 
 // registerInstanceCmd represents the register command
@@ -35,9 +37,16 @@ var registerInstanceCmd = &cobra.Command{
 	Short: "register a new app with an instance",
 	Args:  cobra.MaximumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		warnIfNoContact(cmd)
+
 		var err error
 		var ds *accounts.DirectoryStore
 
+		if optOutList.Excludes(server) {
+			cmd.PrintErrf("%s has opted out of probo\n", server)
+			os.Exit(1)
+		}
+
 		if len(args) == 1 {
 			ds, err = accounts.NewDirectoryStorage(args[0])
 			if err != nil {
@@ -47,6 +56,7 @@ var registerInstanceCmd = &cobra.Command{
 		}
 
 		app, err := mastodon.RegisterApp(context.Background(), &mastodon.AppConfig{
+			Client:     *ratelimit.Client,
 			Server:     server,
 			ClientName: clientName,
 			Scopes:     requiredAppScopes,
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/abreka/proboscideans/hub"
+	"github.com/abreka/proboscideans/replay"
+	"github.com/abreka/proboscideans/sink"
+	"github.com/spf13/cobra"
+)
+
+var (
+	replaySpeed     float64
+	replayServers   []string
+	replayFrom      string
+	replayTo        string
+	replayServe     bool
+	replayConsumers int
+)
+
+func initReplayCmd() {
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 1, "Replay this many times faster than the events were received (0 for as fast as possible)")
+	replayCmd.Flags().StringSliceVar(&replayServers, "server", nil, "Only replay events from servers whose host matches these globs")
+	replayCmd.Flags().StringVar(&replayFrom, "from", "", "Only replay events received at or after this date or time (YYYY-MM-DD or RFC 3339)")
+	replayCmd.Flags().StringVar(&replayTo, "to", "", "Only replay events received before this date or time (YYYY-MM-DD or RFC 3339)")
+	replayCmd.Flags().BoolVar(&replayServe, "serve", false, "Rebroadcast the events like probo serve instead of printing them")
+	replayCmd.Flags().IntVar(&replayConsumers, "consumers", 1, "With --serve, wait for this many consumers before starting")
+	addHubFlags(replayCmd)
+}
+
+var replayCmd = &cobra.Command{
+	Use:   "replay archive-or-dir...",
+	Short: "play archived events back as if they were live",
+	Long: `Reads .probo and .json.gz archives, including unfinished .part ones, and
+emits their events paced by when they were received. Directories stand for
+the archives in them. Archives are played one after the other, ordered by
+their first event. Archives that don't say when events were received go by
+when their statuses were created.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		paths, err := replay.Find(args)
+		if err != nil {
+			cmd.PrintErrf("Unable to find archives: %s\n", err)
+			os.Exit(1)
+		}
+		if replaySpeed < 0 {
+			cmd.PrintErrln("--speed can't be negative")
+			os.Exit(1)
+		}
+
+		r := &replay.Replay{Speed: replaySpeed, Servers: replayServers}
+		if replayFrom != "" {
+			if r.From, err = parseDate(replayFrom); err != nil {
+				cmd.PrintErrf("Invalid --from: %s\n", err)
+				os.Exit(1)
+			}
+		}
+		if replayTo != "" {
+			if r.To, err = parseDate(replayTo); err != nil {
+				cmd.PrintErrf("Invalid --to: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		sd := newShutdown(cmd)
+		defer sd.Done()
+
+		var out sink.Sink = sink.NewWriter(cmd.OutOrStdout())
+		closeOut := func() {}
+		if replayServe {
+			h, listener := listenHub(cmd)
+			server := &http.Server{Handler: hub.NewHandler(h)}
+			go serveHub(cmd, sd, server, listener)
+			// Consumers see everything after they connect, so don't start
+			// before they have.
+			waitForConsumers(sd.Stopping, cmd, h, replayConsumers)
+			closeOut = func() { closeHub(cmd, sd, server, h) }
+			out = h
+		}
+
+		stats, err := r.Run(sd.Stopping, paths, out.Write)
+		for _, path := range stats.Truncated {
+			cmd.PrintErrf("%s ends early, replayed what was there\n", path)
+		}
+		cmd.PrintErrf("Replayed %d events from %d archives (%d filtered out)\n", stats.Events, stats.Files, stats.Filtered)
+		failed := err != nil && !errors.Is(err, context.Canceled)
+		if failed {
+			cmd.PrintErrf("Unable to replay: %s\n", err)
+		}
+
+		// Consumers get whatever they still have buffered before they're
+		// disconnected.
+		closeOut()
+		sd.Done()
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// waitForConsumers waits until the hub has n consumers or ctx is done.
+func waitForConsumers(ctx context.Context, cmd *cobra.Command, h *hub.Hub, n int) {
+	if n <= 0 {
+		return
+	}
+	cmd.PrintErrf("Waiting for %d consumers...\n", n)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for h.Stats().Consumers < n {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
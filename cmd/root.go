@@ -4,10 +4,19 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/identity"
 	"github.com/spf13/cobra"
 )
 
+var (
+	contact     string
+	optOutFiles []string
+	optOutList  *accounts.OptOutList
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "probo",
 	Short: "tools for consuming mastodons",
@@ -15,6 +24,24 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println(cmd.UsageString())
 	},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		identity.SetContact(contact)
+
+		var err error
+		optOutList, err = accounts.LoadOptOutList(optOutFiles...)
+		if err != nil {
+			cmd.PrintErrf("Unable to load opt-out list: %s\n", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// warnIfNoContact warns, in commands that talk to servers, that their
+// admins won't be able to reach whoever is running probo.
+func warnIfNoContact(cmd *cobra.Command) {
+	if contact == "" {
+		cmd.PrintErrln("Warning: no --contact set; admins of the servers you crawl won't be able to reach you.")
+	}
 }
 
 func init() {
@@ -25,11 +52,24 @@ func init() {
 	rootCmd.AddCommand(registerAllCmd)
 	rootCmd.AddCommand(streamInstanceCmd)
 	rootCmd.AddCommand(streamDistributedCmd)
+	rootCmd.AddCommand(backfillCmd)
 	rootCmd.AddCommand(whoisCmd)
+	rootCmd.AddCommand(archiveCmd)
+	rootCmd.AddCommand(serveCmd)
+	rootCmd.AddCommand(replayCmd)
 
 	// Add flags
+	rootCmd.PersistentFlags().StringVar(&contact, "contact", os.Getenv("PROBO_CONTACT"), "Email or URL put in the User-Agent so admins can reach you (default $PROBO_CONTACT)")
+	rootCmd.PersistentFlags().StringSliceVar(&optOutFiles, "opt-out", nil, "Extra files of servers to leave alone, on top of the built-in opt-out list")
+	rootCmd.PersistentFlags().DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to spend draining and flushing after SIGINT or SIGTERM before giving up")
 	initRegisterCmd()
 	initRegisterAllCmd()
+	initStreamInstanceCmd()
+	initStreamDistributedCmd()
+	initBackfillCmd()
+	initArchiveCmd()
+	initServeCmd()
+	initReplayCmd()
 }
 
 // Execute runs the CLI app
@@ -0,0 +1,142 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/hub"
+	"github.com/spf13/cobra"
+)
+
+var (
+	listenAddr     string
+	hubHistory     int
+	consumerBuffer int
+)
+
+func initServeCmd() {
+	addMuxFlags(serveCmd)
+	addHubFlags(serveCmd)
+}
+
+func addHubFlags(c *cobra.Command) {
+	c.Flags().StringVar(&listenAddr, "listen", "localhost:8080", "Address to serve consumers on")
+	c.Flags().IntVar(&hubHistory, "history", hub.DefaultHistory, "Recent events kept for consumers to resume from")
+	c.Flags().IntVar(&consumerBuffer, "consumer-buffer", hub.DefaultBuffer, "Events a consumer may fall behind by before it is disconnected")
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [credentials-dir]",
+	Short: "stream from multiple instances and rebroadcast the events to local consumers",
+	Long: `Streams from every instance like stream-distributed, once, and serves the
+merged events to any number of local consumers:
+
+  GET /events   server-sent events, resumable with Last-Event-ID
+  GET /ws       a WebSocket, one {"seq": ..., "envelope": ...} per event
+  GET /stats    consumer counts
+  GET /servers  how each instance is doing
+
+Consumers filter with query parameters (server, stream, type, tag, lang,
+each repeatable or comma-separated) and resume with since=seq. A consumer
+that falls more than --consumer-buffer events behind is disconnected.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		warnIfNoContact(cmd)
+
+		dirStore, err := accounts.NewDirectoryStorage(args[0])
+		if err != nil {
+			cmd.PrintErrf("Unable to create directory storage: %s\n", err)
+			os.Exit(1)
+		}
+		ds := accounts.ExcludeOptOuts(dirStore, optOutList)
+
+		mux := openMux(cmd, ds)
+		policy := newPolicy(cmd, mux)
+
+		h, listener := listenHub(cmd)
+		routes := http.NewServeMux()
+		routes.Handle("/", hub.NewHandler(h))
+		routes.HandleFunc("/servers", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(mux.Status())
+		})
+		server := &http.Server{Handler: routes}
+
+		sd := newShutdown(cmd)
+		defer sd.Done()
+		go serveHub(cmd, sd, server, listener)
+
+		events, errs := startStreams(sd.Stopping, cmd, mux, ds)
+		events = policy.Run(sd.Deadline, events)
+		events = dedupStage(sd.Deadline, events)
+
+		for events != nil || errs != nil {
+			select {
+			case serverError, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				cmd.PrintErrln(serverError)
+				// Consumers get to see outages too.
+				_ = h.Write(serverError.Envelope())
+
+			case envelope, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				if err := h.Write(envelope); err != nil {
+					cmd.PrintErrf("Unable to rebroadcast event: %s\n", err)
+					continue
+				}
+				mux.Checkpoints.Commit(envelope)
+			}
+		}
+
+		closeHub(cmd, sd, server, h)
+		if err := mux.Checkpoints.Save(); err != nil {
+			cmd.PrintErrf("Unable to save checkpoints: %s\n", err)
+		}
+		printServerStats(cmd, mux.Status())
+	},
+}
+
+// listenHub sets up a hub as the hub flags say and starts listening, so
+// that a bad address is reported before anything else starts.
+func listenHub(cmd *cobra.Command) (*hub.Hub, net.Listener) {
+	h := hub.New(hubHistory)
+	h.Buffer = consumerBuffer
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		cmd.PrintErrf("Unable to listen: %s\n", err)
+		os.Exit(1)
+	}
+	cmd.PrintErrf("Serving on http://%s\n", listener.Addr())
+	return h, listener
+}
+
+// serveHub serves until the server is shut down, and starts shutting
+// everything else down if it stops for any other reason.
+func serveHub(cmd *cobra.Command, sd *shutdown, server *http.Server, listener net.Listener) {
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		cmd.PrintErrf("Unable to serve: %s\n", err)
+		sd.Stop()
+	}
+}
+
+// closeHub disconnects the consumers, which ends their requests, then waits
+// for the server to finish up.
+func closeHub(cmd *cobra.Command, sd *shutdown, server *http.Server, h *hub.Hub) {
+	_ = h.Close()
+	if err := server.Shutdown(sd.Deadline); err != nil {
+		cmd.PrintErrf("Unable to shut down server: %s\n", err)
+	}
+	stats := h.Stats()
+	cmd.PrintErrf("Rebroadcast %d events to %d consumers (%d disconnected for falling behind)\n", stats.Seq, stats.Connected, stats.Slow)
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/spf13/cobra"
+)
+
+var shutdownTimeout time.Duration
+
+// shutdown coordinates stopping on SIGINT or SIGTERM. The first signal
+// cancels Stopping, which is what collection should run under. Draining,
+// flushing and closing afterwards run under Deadline, which is cancelled
+// shutdownTimeout later. If that doesn't get things to finish either, or a
+// second signal arrives, we exit on the spot.
+type shutdown struct {
+	Stopping context.Context
+	Deadline context.Context
+
+	stop     context.CancelFunc
+	giveUp   context.CancelFunc
+	signals  chan os.Signal
+	finished chan struct{}
+	done     bool
+}
+
+func newShutdown(cmd *cobra.Command) *shutdown {
+	s := &shutdown{
+		signals:  make(chan os.Signal, 2),
+		finished: make(chan struct{}),
+	}
+	s.Stopping, s.stop = context.WithCancel(context.Background())
+	s.Deadline, s.giveUp = context.WithCancel(context.Background())
+	signal.Notify(s.signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-s.signals:
+			cmd.PrintErrf("Got %s, shutting down (up to %s)...\n", sig, shutdownTimeout)
+		case <-s.Stopping.Done():
+		case <-s.finished:
+			return
+		}
+		s.stop()
+
+		timer := time.NewTimer(shutdownTimeout)
+		defer timer.Stop()
+		select {
+		case sig := <-s.signals:
+			cmd.PrintErrf("Got %s again, exiting now\n", sig)
+			os.Exit(1)
+		case <-timer.C:
+			cmd.PrintErrln("Shutdown deadline passed, abandoning whatever is left")
+		case <-s.finished:
+			return
+		}
+		s.giveUp()
+
+		// Everything should stop promptly once its context is gone; if
+		// something is stuck anyway, don't hang around for it.
+		select {
+		case <-s.signals:
+		case <-time.After(5 * time.Second):
+			cmd.PrintErrln("Still not done, exiting")
+		case <-s.finished:
+			return
+		}
+		os.Exit(1)
+	}()
+
+	return s
+}
+
+// Stop starts shutting down as if we'd been signalled, e.g. because the
+// work is done.
+func (s *shutdown) Stop() {
+	s.stop()
+}
+
+// Wait blocks until shutdown starts.
+func (s *shutdown) Wait() {
+	<-s.Stopping.Done()
+}
+
+// Done releases the signal handler once everything has been cleaned up.
+func (s *shutdown) Done() {
+	if s.done {
+		return
+	}
+	s.done = true
+	signal.Stop(s.signals)
+	close(s.finished)
+	s.stop()
+	s.giveUp()
+}
+
+// printServerStats prints how each server fared, for the end of a run.
+func printServerStats(cmd *cobra.Command, statuses []streaming.ServerStatus) {
+	for _, status := range statuses {
+		cmd.PrintErrf("%s: %s, %d events, %d errors, %d dropped\n", status.Server, status.State, status.Events, status.Errors, status.Dropped)
+	}
+}
@@ -1,83 +1,224 @@
 package cmd
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/json"
-	"fmt"
 	"os"
 	"time"
 
 	"github.com/abreka/proboscideans/accounts"
 
+	"github.com/abreka/proboscideans/sink"
 	"github.com/abreka/proboscideans/streaming"
 	"github.com/spf13/cobra"
 )
 
+var (
+	latencyReport   string
+	latencyInterval time.Duration
+
+	policyReport string
+
+	archiveDir     string
+	archiveName    string
+	archiveFormat  string
+	rotateSize     int64
+	rotateInterval time.Duration
+)
+
+func initStreamDistributedCmd() {
+	addMuxFlags(streamDistributedCmd)
+	streamDistributedCmd.Flags().StringVar(&latencyReport, "latency-report", "", "Measure federation latency and write a JSON report to this path")
+	streamDistributedCmd.Flags().DurationVar(&latencyInterval, "latency-interval", time.Minute, "How often to rewrite the latency report")
+	addArchiveFlags(streamDistributedCmd, sink.DefaultNameTemplate)
+	streamDistributedCmd.Flags().StringVar(&policyReport, "policy-report", "", "Write counts of everything dropped or redacted for opt-outs to this path (rewritten every minute and on exit)")
+}
+
 var streamDistributedCmd = &cobra.Command{
 	Use:   "stream-distributed [credentials-dir]",
 	Short: "stream events from multiple instances",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		// TODO: make this not stupid
-		// open a gzip file for writing.
-		fp, err := os.Create(fmt.Sprintf("stream-%d.json.gz", time.Now().Unix()))
-		if err != nil {
-			cmd.PrintErrf("error opening file: %v", err)
-			os.Exit(1)
-		}
-		defer fp.Close()
-		gzWriter := gzip.NewWriter(fp)
-		defer gzWriter.Close()
+		warnIfNoContact(cmd)
+
+		archive := openArchive(cmd)
+		out := sink.Multi{sink.NewWriter(cmd.OutOrStdout()), archive}
 
-		ds, err := accounts.NewDirectoryStorage(args[0])
+		dirStore, err := accounts.NewDirectoryStorage(args[0])
 		if err != nil {
 			cmd.PrintErrf("Unable to create directory storage: %s\n", err)
 			os.Exit(1)
 		}
+		ds := accounts.ExcludeOptOuts(dirStore, optOutList)
 
-		mux, err := streaming.NewMuxFromCredentialsDir(ds)
-		if err != nil {
-			cmd.PrintErrf("Unable to create mux: %s\n", err)
-			os.Exit(1)
+		mux := openMux(cmd, ds)
+		policy := newPolicy(cmd, mux)
+		// Checkpoints are only saved for what the archive has on disk.
+		mux.Checkpoints.Flush = archive.Flush
+
+		// Streams stop on the first signal; everything after the Mux keeps
+		// going until it has drained or the shutdown deadline passes.
+		sd := newShutdown(cmd)
+		defer sd.Done()
+		go maintainArchive(sd.Deadline, cmd, archive)
+		events, errs := startStreams(sd.Stopping, cmd, mux, ds)
+
+		// Nothing downstream gets to see what people opted out of.
+		events = policy.Run(sd.Deadline, events)
+		if policyReport != "" {
+			go writeReports(sd.Stopping, cmd, "policy", policyReport, time.Minute, func() interface{} { return policy.Stats() })
+		}
+
+		// Latency has to see every copy of a status so it goes before dedup.
+		var tracker *streaming.LatencyTracker
+		if latencyReport != "" {
+			tracker = streaming.NewLatencyTracker()
+			events = tracker.Run(sd.Deadline, events)
+			go writeReports(sd.Stopping, cmd, "latency", latencyReport, latencyInterval, func() interface{} { return tracker.Report() })
 		}
+		events = dedupStage(sd.Deadline, events)
+
+		failed := writeAll(cmd, sd, events, errs, out, archive, mux.Checkpoints)
 
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		events, errs := mux.StreamPublic(ctx, true)
-		go func() {
-			for {
-				select {
-				case serverError := <-errs:
-					errJson, err := json.Marshal(serverError)
-					if err != nil {
-						cmd.PrintErrf("Unable to marshal error: %s\n", err)
-						os.Exit(1)
-					}
-					cmd.Println(string(errJson))
-
-				case event := <-events:
-					eventJson, err := json.Marshal(event)
-					if err != nil {
-						cmd.PrintErrf("Unable to marshal event: %s\n", err)
-						os.Exit(1)
-					}
-					asString := string(eventJson)
-					// TODO: figure out what these are (keep alives?)
-					if asString != "{}" {
-						eventJson = append(eventJson, []byte("\n")...)
-						cmd.Print(string(eventJson))
-						_, err = gzWriter.Write(eventJson)
-						if err != nil {
-							cmd.PrintErrf("Unable to write to file: %s\n", err)
-							os.Exit(1)
-						}
-					}
-				}
+		if err := out.Close(); err != nil {
+			cmd.PrintErrf("Unable to close archive: %s\n", err)
+			failed = true
+		}
+		if err := mux.Checkpoints.Save(); err != nil {
+			cmd.PrintErrf("Unable to save checkpoints: %s\n", err)
+		}
+		if policyReport != "" {
+			if err := writeReport(policyReport, policy.Stats()); err != nil {
+				cmd.PrintErrf("Unable to write policy report: %s\n", err)
 			}
-		}()
+		}
+		if tracker != nil {
+			if err := writeReport(latencyReport, tracker.Report()); err != nil {
+				cmd.PrintErrf("Unable to write latency report: %s\n", err)
+			}
+		}
+		printServerStats(cmd, mux.Status())
 
-		waitForInterrupt()
+		sd.Done()
+		if failed {
+			os.Exit(1)
+		}
 	},
 }
+
+func addArchiveFlags(c *cobra.Command, nameTemplate string) {
+	c.Flags().StringVar(&archiveDir, "archive-dir", ".", "Directory to archive events in")
+	c.Flags().StringVar(&archiveName, "archive-name", nameTemplate, "Template for archive segment names, given .Start (UTC), .Seq and .Ext")
+	c.Flags().StringVar(&archiveFormat, "archive-format", string(sink.FormatBlocks), "Archive segment format: blocks (crash-safe, fixable with probo archive repair) or gzip")
+	c.Flags().Int64Var(&rotateSize, "rotate-size", sink.DefaultRotationPolicy.MaxSize, "Start a new archive segment after this many compressed bytes (0 disables)")
+	c.Flags().DurationVar(&rotateInterval, "rotate-interval", sink.DefaultRotationPolicy.Interval, "Start a new archive segment on every multiple of this interval (0 disables)")
+}
+
+// openArchive opens the archive the archive flags describe.
+func openArchive(cmd *cobra.Command) *sink.Archive {
+	format, err := sink.ParseSegmentFormat(archiveFormat)
+	if err != nil {
+		cmd.PrintErrf("Invalid --archive-format: %s\n", err)
+		os.Exit(1)
+	}
+	archive, err := sink.OpenArchive(archiveDir, archiveName, sink.RotationPolicy{
+		MaxSize:  rotateSize,
+		Interval: rotateInterval,
+	})
+	if err != nil {
+		cmd.PrintErrf("Unable to open archive: %s\n", err)
+		os.Exit(1)
+	}
+	archive.Format = format
+	return archive
+}
+
+// maintainArchive keeps the archive flushed and rotated on time, even when
+// nothing is coming in, until ctx is done.
+func maintainArchive(ctx context.Context, cmd *cobra.Command, archive *sink.Archive) {
+	for err := range archive.Run(ctx, time.Second) {
+		cmd.PrintErrf("Unable to write to archive: %s\n", err)
+	}
+}
+
+// writeAll writes events to out, committing them to the checkpoints, and
+// errors to stdout and the archive, until the Mux has drained and both
+// channels are closed. On a write error it starts shutting down, and reports
+// that it failed.
+func writeAll(cmd *cobra.Command, sd *shutdown, events <-chan *streaming.Envelope, errs <-chan *streaming.StreamError, out sink.Sink, archive sink.Sink, checkpoints *streaming.Checkpoints) bool {
+	failed := false
+	for events != nil || errs != nil {
+		select {
+		case serverError, ok := <-errs:
+			if !ok {
+				errs = nil
+				continue
+			}
+			errJson, err := json.Marshal(serverError)
+			if err != nil {
+				cmd.PrintErrf("Unable to marshal error: %s\n", err)
+				continue
+			}
+			cmd.Println(string(errJson))
+
+			// Keep a record of outages in the archive too.
+			if failed {
+				continue
+			}
+			if err := archive.Write(serverError.Envelope()); err != nil {
+				cmd.PrintErrf("Unable to write to archive: %s\n", err)
+				failed = true
+				sd.Stop()
+			}
+
+		case envelope, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if failed {
+				continue
+			}
+			if err := out.Write(envelope); err != nil {
+				cmd.PrintErrf("Unable to write event: %s\n", err)
+				failed = true
+				sd.Stop()
+				continue
+			}
+			checkpoints.Commit(envelope)
+		}
+	}
+	return failed
+}
+
+// writeReports rewrites a JSON report every interval until ctx is done.
+func writeReports(ctx context.Context, cmd *cobra.Command, name, reportPath string, interval time.Duration, report func() interface{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := writeReport(reportPath, report()); err != nil {
+			cmd.PrintErrf("Unable to write %s report: %s\n", name, err)
+		}
+	}
+}
+
+func writeReport(reportPath string, report interface{}) error {
+	asJson, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so readers never see half a report.
+	tmpPath := reportPath + ".tmp"
+	if err := os.WriteFile(tmpPath, asJson, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, reportPath)
+}
@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/mattn/go-mastodon"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSink keeps what it is given, and holds the first write until
+// release is closed.
+type recordingSink struct {
+	release chan struct{}
+
+	sync.Mutex
+	ids []mastodon.ID
+}
+
+func (s *recordingSink) Write(envelope *streaming.Envelope) error {
+	<-s.release
+	s.Lock()
+	defer s.Unlock()
+	s.ids = append(s.ids, envelope.Status().ID)
+	return nil
+}
+
+func (s *recordingSink) Close() error {
+	return nil
+}
+
+func TestWriteAll_DrainsAfterStop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 1; i <= 5; i++ {
+			_, _ = fmt.Fprintf(w, "event: update\ndata: {\"id\":\"%d\"}\n\n", i)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ds, err := accounts.NewDirectoryStorage(t.TempDir())
+	require.NoError(t, err)
+
+	// Keep events in the server's own buffer, which is what has to drain.
+	defer func(global int) { bufferGlobal = global }(bufferGlobal)
+	bufferGlobal = 0
+
+	cmd := &cobra.Command{}
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	mux := openMux(cmd, ds)
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	sd := newShutdown(cmd)
+	defer sd.Done()
+	events, errs := mux.StreamPublic(sd.Stopping, true)
+
+	out := &recordingSink{release: make(chan struct{})}
+	done := make(chan bool)
+	go func() { done <- writeAll(cmd, sd, events, errs, out, out, mux.Checkpoints) }()
+
+	// Everything is in the Mux's buffers, with the sink holding things up,
+	// when we're told to stop.
+	require.Eventually(t, func() bool {
+		status := mux.Status()
+		return len(status) == 1 && status[0].Events == 5
+	}, 5*time.Second, 10*time.Millisecond)
+	sd.Stop()
+	close(out.release)
+
+	select {
+	case failed := <-done:
+		require.False(t, failed)
+	case <-time.After(5 * time.Second):
+		t.Fatal("writeAll didn't return")
+	}
+	require.Equal(t, []mastodon.ID{"1", "2", "3", "4", "5"}, out.ids)
+	require.Equal(t, int64(0), mux.Status()[0].Dropped)
+}
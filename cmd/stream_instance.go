@@ -1,15 +1,12 @@
 package cmd
 
 import (
-	"context"
 	"encoding/json"
 	"os"
-	"os/signal"
 
 	"github.com/abreka/proboscideans/accounts"
 
 	"github.com/abreka/proboscideans/streaming"
-	"github.com/mattn/go-mastodon"
 	"github.com/spf13/cobra"
 )
 
@@ -18,6 +15,8 @@ var streamInstanceCmd = &cobra.Command{
 	Short: "stream events from a single instance",
 	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
+		warnIfNoContact(cmd)
+
 		dirPath := args[0]
 		serverName := args[1]
 
@@ -26,8 +25,9 @@ var streamInstanceCmd = &cobra.Command{
 			cmd.PrintErrf("Unable to create directory storage: %s\n", err)
 			os.Exit(1)
 		}
+		store := accounts.ExcludeOptOuts(ds, optOutList)
 
-		app, err := ds.GetByServerName(serverName)
+		app, err := store.GetByServerName(serverName)
 		if err != nil {
 			cmd.PrintErrf("Unable to get app: %s\n", err)
 			os.Exit(1)
@@ -39,41 +39,51 @@ var streamInstanceCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		client := mastodon.NewClient(&mastodon.Config{
-			Server:       server,
-			ClientID:     app.ClientID,
-			ClientSecret: app.ClientSecret,
-		})
-
-		ctx, cancel := context.WithCancel(context.Background())
-		defer cancel()
-
-		// NOTE: I don't think you need to attach app credentials to stream.
-		// However, it definitely seems much more polite.
-		events, err := client.StreamingPublic(ctx, true)
-		if err != nil {
-			cmd.PrintErrf("Unable to stream: %s\n", err)
+		// A Mux of one, for its retries, breaker and stall watchdog rather
+		// than go-mastodon's tight loop.
+		mux := streaming.NewMux()
+		if err := mux.AddServer(server, app); err != nil {
+			cmd.PrintErrf("Unable to add server: %s\n", err)
 			os.Exit(1)
 		}
+		policy := newPolicy(cmd, mux)
+
+		sd := newShutdown(cmd)
+		defer sd.Done()
+
+		events, errs := mux.StreamPublic(sd.Stopping, true)
+		events = policy.Run(sd.Deadline, events)
 
-		go func() {
-			for event := range events {
+		// Both channels close once the stream has stopped and drained.
+		count := 0
+		for events != nil || errs != nil {
+			select {
+			case serverError, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				cmd.PrintErrln(serverError)
+
+			case envelope, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
 				// Marshal as json and print it
-				jsonEvent, err := json.Marshal(event)
+				jsonEvent, err := json.Marshal(envelope.Event)
 				if err != nil {
 					cmd.PrintErrf("Unable to marshal event: %s\n", err)
-					os.Exit(1)
+					continue
 				}
 				cmd.Println(string(jsonEvent))
+				count++
 			}
-		}()
-
-		waitForInterrupt()
+		}
+		cmd.PrintErrf("%s: %d events\n", serverName, count)
 	},
 }
 
-func waitForInterrupt() {
-	killSignal := make(chan os.Signal, 1)
-	signal.Notify(killSignal, os.Interrupt)
-	<-killSignal
+func initStreamInstanceCmd() {
+	streamInstanceCmd.Flags().StringVar(&optedOut, "opted-out", string(streaming.OptOutDrop), "What to do with statuses from accounts that opted out of indexing: drop or redact")
 }
@@ -6,6 +6,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/abreka/proboscideans/ratelimit"
 	"github.com/mattn/go-mastodon"
 	"github.com/spf13/cobra"
 )
@@ -15,9 +16,17 @@ var whoisCmd = &cobra.Command{
 	Short: "whois an instance",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		warnIfNoContact(cmd)
+
+		if optOutList.Excludes(args[0]) {
+			cmd.PrintErrf("%s has opted out of probo\n", args[0])
+			os.Exit(1)
+		}
+
 		client := mastodon.NewClient(&mastodon.Config{
 			Server: args[0],
 		})
+		client.Client = *ratelimit.Client
 
 		ctx, timeout := context.WithTimeout(context.Background(), 10*time.Second)
 		defer timeout()
@@ -0,0 +1,138 @@
+package hub
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/streaming"
+)
+
+// Filter picks the events a consumer gets. Each field left empty matches
+// everything; otherwise an event has to match one of its entries, and
+// every field that is set.
+type Filter struct {
+	// Servers are globs matched against the host of the server the event
+	// came from, e.g. "*.social".
+	Servers []string `json:"servers,omitempty"`
+	// Streams are the streams the event may have come in on.
+	Streams []streaming.StreamSpec `json:"streams,omitempty"`
+	// Types are wire types, e.g. "update" or "delete".
+	Types []string `json:"types,omitempty"`
+	// Tags and Languages only match statuses (or what they boost) that
+	// have one of the hashtags, without the #, or are in one of the
+	// languages.
+	Tags      []string `json:"tags,omitempty"`
+	Languages []string `json:"languages,omitempty"`
+}
+
+var eventTypes = map[string]bool{
+	streaming.TypeUpdate:         true,
+	streaming.TypeStatusUpdate:   true,
+	streaming.TypeDelete:         true,
+	streaming.TypeNotification:   true,
+	streaming.TypeFiltersChanged: true,
+	streaming.TypeError:          true,
+}
+
+// ParseFilter reads a filter from query parameters: server, stream, type,
+// tag and lang. Each can be repeated or hold a comma-separated list.
+func ParseFilter(query url.Values) (Filter, error) {
+	var f Filter
+
+	for _, pattern := range values(query, "server") {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return Filter{}, fmt.Errorf("bad server pattern %q: %w", pattern, err)
+		}
+		f.Servers = append(f.Servers, pattern)
+	}
+	for _, s := range values(query, "stream") {
+		spec, err := streaming.ParseStreamSpec(s)
+		if err != nil {
+			return Filter{}, err
+		}
+		f.Streams = append(f.Streams, spec)
+	}
+	for _, eventType := range values(query, "type") {
+		if !eventTypes[eventType] {
+			return Filter{}, fmt.Errorf("unknown event type %q", eventType)
+		}
+		f.Types = append(f.Types, eventType)
+	}
+	for _, tag := range values(query, "tag") {
+		f.Tags = append(f.Tags, strings.ToLower(strings.TrimPrefix(tag, "#")))
+	}
+	f.Languages = values(query, "lang")
+
+	return f, nil
+}
+
+func values(query url.Values, key string) []string {
+	var out []string
+	for _, value := range query[key] {
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// Match reports whether the filter lets an event through.
+func (f Filter) Match(event *Event) bool {
+	envelope := event.Envelope
+
+	if len(f.Servers) > 0 && !accounts.MatchHost(f.Servers, envelope.Server) {
+		return false
+	}
+	if len(f.Streams) > 0 && !f.matchStream(envelope.Stream) {
+		return false
+	}
+	if len(f.Types) > 0 && !contains(f.Types, event.Type) {
+		return false
+	}
+
+	if len(f.Tags) == 0 && len(f.Languages) == 0 {
+		return true
+	}
+	status := envelope.Status()
+	if status == nil {
+		return false
+	}
+	if status.Reblog != nil {
+		status = status.Reblog
+	}
+	if len(f.Languages) > 0 && !contains(f.Languages, status.Language) {
+		return false
+	}
+	if len(f.Tags) > 0 {
+		for _, tag := range status.Tags {
+			if contains(f.Tags, strings.ToLower(tag.Name)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func (f Filter) matchStream(spec streaming.StreamSpec) bool {
+	for _, s := range f.Streams {
+		if s == spec {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
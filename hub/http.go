@@ -0,0 +1,209 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// DefaultHeartbeat is how often an idle connection is pinged so proxies
+// don't time it out and dead consumers are noticed.
+const DefaultHeartbeat = 30 * time.Second
+
+// writeTimeout bounds how long a WebSocket consumer gets to take a message.
+const writeTimeout = 10 * time.Second
+
+// Handler serves a Hub over HTTP:
+//
+//	GET /events  the events as text/event-stream
+//	GET /ws      the events over a WebSocket
+//	GET /stats   the hub's Stats as JSON
+//
+// The event endpoints take a Filter as query parameters (see ParseFilter)
+// and since=seq to resume. Server-sent events carry their sequence number
+// as their id, so an EventSource resumes by itself through Last-Event-ID.
+type Handler struct {
+	Hub       *Hub
+	Heartbeat time.Duration
+
+	mux      *http.ServeMux
+	upgrader websocket.Upgrader
+}
+
+// NewHandler returns a Handler for hub.
+func NewHandler(hub *Hub) *Handler {
+	h := &Handler{Hub: hub, Heartbeat: DefaultHeartbeat}
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("/events", h.serveSSE)
+	h.mux.HandleFunc("/ws", h.serveWebSocket)
+	h.mux.HandleFunc("/stats", h.serveStats)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// subscribe subscribes for a request, or writes the error and returns nil.
+func (h *Handler) subscribe(w http.ResponseWriter, r *http.Request) *Consumer {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	filter, err := ParseFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	lastID := r.URL.Query().Get("since")
+	if lastID == "" {
+		lastID = r.Header.Get("Last-Event-ID")
+	}
+	var since uint64
+	if lastID != "" {
+		since, err = strconv.ParseUint(lastID, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad sequence number %q", lastID), http.StatusBadRequest)
+			return nil
+		}
+	}
+
+	c, err := h.Hub.Subscribe(filter, since)
+	switch {
+	case errors.Is(err, ErrCantResume):
+		http.Error(w, err.Error(), http.StatusGone)
+		return nil
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	}
+	return c
+}
+
+func (h *Handler) serveSSE(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	c := h.subscribe(w, r)
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+
+		case event, ok := <-c.Events():
+			if !ok {
+				if err := c.Err(); err != nil {
+					msg, _ := json.Marshal(map[string]string{"error": err.Error()})
+					_, _ = fmt.Fprintf(w, "event: hub.error\ndata: %s\n\n", msg)
+					flusher.Flush()
+				}
+				return
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, event.Data); err != nil {
+				return
+			}
+			// Send whatever else is ready before flushing.
+			if len(c.Events()) == 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// wsMessage is what a WebSocket consumer gets for every event.
+type wsMessage struct {
+	Seq      uint64          `json:"seq"`
+	Envelope json.RawMessage `json:"envelope"`
+}
+
+func (h *Handler) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	c := h.subscribe(w, r)
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already replied.
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	// Consumers don't send us anything, but reading is how we see them
+	// close and answer their pings.
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-gone:
+			return
+
+		case <-heartbeat.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeTimeout)); err != nil {
+				return
+			}
+
+		case event, ok := <-c.Events():
+			if !ok {
+				code, reason := websocket.CloseNormalClosure, ""
+				switch err := c.Err(); {
+				case errors.Is(err, ErrSlow):
+					code, reason = websocket.CloseTryAgainLater, err.Error()
+				case errors.Is(err, ErrClosed):
+					code, reason = websocket.CloseGoingAway, err.Error()
+				}
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeTimeout))
+				return
+			}
+			_ = conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteJSON(wsMessage{Seq: event.Seq, Envelope: event.Data}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *Handler) serveStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.Hub.Stats())
+}
@@ -0,0 +1,240 @@
+// Package hub rebroadcasts one merged stream to any number of local
+// consumers, each with its own filter, so that they can share a single set
+// of connections to the servers.
+//
+// Every envelope written to a Hub gets the next sequence number. The most
+// recent ones are kept so that a consumer that drops its connection can
+// pick up where it left off.
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/abreka/proboscideans/streaming"
+)
+
+const (
+	// DefaultHistory is how many recent events a Hub keeps for consumers
+	// to resume from.
+	DefaultHistory = 10000
+	// DefaultBuffer is how far a consumer may fall behind before it is
+	// disconnected.
+	DefaultBuffer = 1024
+)
+
+var (
+	// ErrSlow is why a consumer that fell more than its buffer behind was
+	// disconnected.
+	ErrSlow = errors.New("hub: consumer fell too far behind")
+	// ErrClosed is why consumers are disconnected when the hub closes.
+	ErrClosed = errors.New("hub: closed")
+	// ErrCantResume is returned by Subscribe for a sequence number the hub
+	// no longer has, or never had, e.g. because it has restarted since.
+	ErrCantResume = errors.New("hub: can't resume from that sequence number")
+)
+
+// Event is an envelope as the hub hands it to consumers.
+type Event struct {
+	Seq      uint64
+	Type     string
+	Envelope *streaming.Envelope
+	// Data is Envelope as JSON, encoded once for every consumer.
+	Data []byte
+}
+
+// Hub fans envelopes out to consumers. It is a sink, so it can be written
+// to like an archive.
+type Hub struct {
+	// Buffer is how many events each consumer may fall behind by.
+	Buffer int
+
+	mu        sync.Mutex
+	seq       uint64
+	history   []*Event
+	next      int
+	consumers map[*Consumer]struct{}
+	closed    bool
+	stats     Stats
+}
+
+// Stats counts what a Hub has done so far.
+type Stats struct {
+	// Seq is the sequence number of the latest event and Oldest that of
+	// the oldest one that can still be resumed from.
+	Seq    uint64 `json:"seq"`
+	Oldest uint64 `json:"oldest"`
+
+	Consumers    int   `json:"consumers"`
+	Connected    int64 `json:"connected"`
+	Disconnected int64 `json:"disconnected"`
+	Slow         int64 `json:"slow"`
+}
+
+// New returns a Hub that keeps the last history events.
+func New(history int) *Hub {
+	if history < 1 {
+		history = 1
+	}
+	return &Hub{
+		Buffer:    DefaultBuffer,
+		history:   make([]*Event, history),
+		consumers: make(map[*Consumer]struct{}),
+	}
+}
+
+// Write numbers an envelope and sends it to every consumer whose filter it
+// matches. Consumers that have no room for it are disconnected rather than
+// allowed to hold everyone else up.
+func (h *Hub) Write(envelope *streaming.Envelope) error {
+	eventType, err := streaming.EventType(envelope.Event)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+
+	h.seq++
+	event := &Event{Seq: h.seq, Type: eventType, Envelope: envelope, Data: data}
+	h.history[h.next] = event
+	h.next = (h.next + 1) % len(h.history)
+
+	for c := range h.consumers {
+		if !c.filter.Match(event) {
+			continue
+		}
+		select {
+		case c.events <- event:
+		default:
+			h.stats.Slow++
+			h.disconnectLocked(c, ErrSlow)
+		}
+	}
+	return nil
+}
+
+// Close disconnects every consumer. Writes after it fail with ErrClosed.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	for c := range h.consumers {
+		h.disconnectLocked(c, ErrClosed)
+	}
+	return nil
+}
+
+// Subscribe adds a consumer for the events matching filter. With since set,
+// it first gets every matching event the hub still has after since, and
+// ErrCantResume is returned if the hub doesn't have all of them. Since 0
+// means from now on.
+func (h *Hub) Subscribe(filter Filter, since uint64) (*Consumer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+
+	var backlog []*Event
+	if since > 0 {
+		if since > h.seq || since+1 < h.oldestLocked() {
+			return nil, ErrCantResume
+		}
+		h.eachLocked(func(event *Event) {
+			if event.Seq > since && filter.Match(event) {
+				backlog = append(backlog, event)
+			}
+		})
+	}
+
+	c := &Consumer{
+		hub:    h,
+		filter: filter,
+		events: make(chan *Event, h.Buffer+len(backlog)),
+	}
+	for _, event := range backlog {
+		c.events <- event
+	}
+	h.consumers[c] = struct{}{}
+	h.stats.Connected++
+	return c, nil
+}
+
+// Stats returns the hub's counts so far.
+func (h *Hub) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.stats
+	stats.Seq = h.seq
+	stats.Oldest = h.oldestLocked()
+	stats.Consumers = len(h.consumers)
+	return stats
+}
+
+// oldestLocked returns the sequence number of the oldest event kept, or the
+// next one if there are none.
+func (h *Hub) oldestLocked() uint64 {
+	if h.seq < uint64(len(h.history)) {
+		return 1
+	}
+	return h.seq - uint64(len(h.history)) + 1
+}
+
+// eachLocked calls fn on the events kept, oldest first.
+func (h *Hub) eachLocked(fn func(*Event)) {
+	for i := range h.history {
+		if event := h.history[(h.next+i)%len(h.history)]; event != nil {
+			fn(event)
+		}
+	}
+}
+
+func (h *Hub) disconnectLocked(c *Consumer, err error) {
+	delete(h.consumers, c)
+	h.stats.Disconnected++
+	c.err = err
+	close(c.events)
+}
+
+// Consumer is one subscriber to a Hub.
+type Consumer struct {
+	hub    *Hub
+	filter Filter
+	events chan *Event
+	err    error
+}
+
+// Events returns the consumer's events. It is closed when the consumer is
+// disconnected, after which Err says why.
+func (c *Consumer) Events() <-chan *Event {
+	return c.events
+}
+
+// Err returns why the consumer was disconnected: ErrSlow, ErrClosed, or nil
+// if it closed itself. It is only meaningful once Events is closed.
+func (c *Consumer) Err() error {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	return c.err
+}
+
+// Close unsubscribes the consumer.
+func (c *Consumer) Close() {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	if _, ok := c.hub.consumers[c]; ok {
+		c.hub.disconnectLocked(c, nil)
+	}
+}
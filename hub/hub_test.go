@@ -0,0 +1,227 @@
+package hub
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/gorilla/websocket"
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func update(server, id string, tags ...string) *streaming.Envelope {
+	status := &mastodon.Status{ID: mastodon.ID(id), Language: "en"}
+	for _, tag := range tags {
+		status.Tags = append(status.Tags, mastodon.Tag{Name: tag})
+	}
+	return &streaming.Envelope{
+		Server: server,
+		Stream: streaming.PublicStream(true),
+		Event:  &mastodon.UpdateEvent{Status: status},
+	}
+}
+
+func deletion(server, id string) *streaming.Envelope {
+	return &streaming.Envelope{
+		Server: server,
+		Stream: streaming.PublicStream(true),
+		Event:  &mastodon.DeleteEvent{ID: mastodon.ID(id)},
+	}
+}
+
+func received(t *testing.T, c *Consumer, n int) []uint64 {
+	t.Helper()
+	var seqs []uint64
+	for i := 0; i < n; i++ {
+		select {
+		case event, ok := <-c.Events():
+			require.True(t, ok, "consumer disconnected: %v", c.Err())
+			seqs = append(seqs, event.Seq)
+		case <-time.After(time.Second):
+			t.Fatalf("only got %v", seqs)
+		}
+	}
+	return seqs
+}
+
+func TestHub_Resume(t *testing.T) {
+	h := New(3)
+	_, err := h.Subscribe(Filter{}, 1)
+	require.ErrorIs(t, err, ErrCantResume)
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, h.Write(update("https://a.example", strconv.Itoa(i))))
+	}
+	require.Equal(t, Stats{Seq: 5, Oldest: 3}, h.Stats())
+
+	c, err := h.Subscribe(Filter{}, 3)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{4, 5}, received(t, c, 2))
+
+	_, err = h.Subscribe(Filter{}, 1)
+	require.ErrorIs(t, err, ErrCantResume)
+	_, err = h.Subscribe(Filter{}, 6)
+	require.ErrorIs(t, err, ErrCantResume)
+
+	live, err := h.Subscribe(Filter{}, 0)
+	require.NoError(t, err)
+	require.NoError(t, h.Write(update("https://a.example", "6")))
+	require.Equal(t, []uint64{6}, received(t, live, 1))
+	require.Equal(t, []uint64{6}, received(t, c, 1))
+
+	require.NoError(t, h.Close())
+	_, ok := <-c.Events()
+	require.False(t, ok)
+	require.ErrorIs(t, c.Err(), ErrClosed)
+	require.ErrorIs(t, h.Write(update("https://a.example", "7")), ErrClosed)
+}
+
+func TestHub_SlowConsumer(t *testing.T) {
+	h := New(10)
+	h.Buffer = 2
+
+	slow, err := h.Subscribe(Filter{}, 0)
+	require.NoError(t, err)
+	fast, err := h.Subscribe(Filter{}, 0)
+	require.NoError(t, err)
+	quiet, err := h.Subscribe(Filter{Types: []string{streaming.TypeDelete}}, 0)
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, h.Write(update("https://a.example", strconv.Itoa(i))))
+		if i <= 2 {
+			received(t, fast, 1)
+		}
+	}
+
+	// The slow consumer gets what fit before it was cut off.
+	require.Equal(t, []uint64{1, 2}, received(t, slow, 2))
+	_, ok := <-slow.Events()
+	require.False(t, ok)
+	require.ErrorIs(t, slow.Err(), ErrSlow)
+
+	require.Equal(t, []uint64{3, 4}, received(t, fast, 2))
+	require.Len(t, quiet.Events(), 0)
+
+	stats := h.Stats()
+	require.Equal(t, int64(1), stats.Slow)
+	require.Equal(t, 2, stats.Consumers)
+}
+
+func TestFilter(t *testing.T) {
+	match := func(query string, envelope *streaming.Envelope) bool {
+		values, err := url.ParseQuery(query)
+		require.NoError(t, err)
+		f, err := ParseFilter(values)
+		require.NoError(t, err)
+		eventType, err := streaming.EventType(envelope.Event)
+		require.NoError(t, err)
+		return f.Match(&Event{Type: eventType, Envelope: envelope})
+	}
+
+	tagged := update("https://mastodon.example", "1", "Fediverse")
+	require.True(t, match("", tagged))
+	require.True(t, match("server=*.example", tagged))
+	require.False(t, match("server=other.example", tagged))
+	require.True(t, match("server=other.example,mastodon.example", tagged))
+	require.True(t, match("stream=local", tagged))
+	require.False(t, match("stream=federated", tagged))
+	require.True(t, match("type=update&type=delete", tagged))
+	require.True(t, match("tag=%23fediverse", tagged))
+	require.False(t, match("tag=other", tagged))
+	require.True(t, match("lang=de,en", tagged))
+	require.False(t, match("lang=de", tagged))
+
+	reblog := update("https://mastodon.example", "2")
+	reblog.Status().Reblog = &mastodon.Status{Language: "de"}
+	require.True(t, match("lang=de", reblog))
+
+	deleted := deletion("https://mastodon.example", "1")
+	require.True(t, match("type=delete", deleted))
+	require.False(t, match("tag=fediverse", deleted))
+
+	for _, query := range []string{"type=bogus", "stream=bogus", "server=["} {
+		values, _ := url.ParseQuery(query)
+		_, err := ParseFilter(values)
+		require.Error(t, err, query)
+	}
+}
+
+func TestHandler_SSE(t *testing.T) {
+	h := New(10)
+	require.NoError(t, h.Write(update("https://a.example", "1")))
+	require.NoError(t, h.Write(deletion("https://b.example", "2")))
+	require.NoError(t, h.Write(update("https://b.example", "3")))
+
+	srv := httptest.NewServer(NewHandler(h))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/events?server=b.example&since=99")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusGone, resp.StatusCode)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events?server=b.example", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "1")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() string {
+		require.True(t, lines.Scan())
+		return lines.Text()
+	}
+	require.Equal(t, "id: 2", next())
+	require.Equal(t, "event: delete", next())
+	require.True(t, strings.HasPrefix(next(), "data: {"))
+	require.Equal(t, "", next())
+	require.Equal(t, "id: 3", next())
+	require.Equal(t, "event: update", next())
+	data := strings.TrimPrefix(next(), "data: ")
+	var envelope streaming.Envelope
+	require.NoError(t, json.Unmarshal([]byte(data), &envelope))
+	require.Equal(t, mastodon.ID("3"), envelope.Status().ID)
+	require.Equal(t, "", next())
+
+	require.NoError(t, h.Close())
+	require.Equal(t, "event: hub.error", next())
+	require.Equal(t, `data: {"error":"hub: closed"}`, next())
+}
+
+func TestHandler_WebSocket(t *testing.T) {
+	h := New(10)
+	srv := httptest.NewServer(NewHandler(h))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?type=update", nil)
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	require.Eventually(t, func() bool { return h.Stats().Consumers == 1 }, time.Second, 10*time.Millisecond)
+	require.NoError(t, h.Write(deletion("https://a.example", "1")))
+	require.NoError(t, h.Write(update("https://a.example", "2")))
+
+	var msg struct {
+		Seq      uint64              `json:"seq"`
+		Envelope *streaming.Envelope `json:"envelope"`
+	}
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, uint64(2), msg.Seq)
+	require.Equal(t, "https://a.example", msg.Envelope.Server)
+
+	require.NoError(t, h.Close())
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+}
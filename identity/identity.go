@@ -0,0 +1,83 @@
+// Package identity says who is behind every request probo makes, so instance
+// admins can tell what is crawling them and who to talk to about it.
+package identity
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ProjectURL is where admins can read about probo and ask to be excluded.
+const ProjectURL = "https://github.com/abreka/proboscideans"
+
+// Identity is what goes in the User-Agent.
+type Identity struct {
+	Product string
+	Version string
+	URL     string
+
+	// Contact is an email address or URL for whoever is running probo.
+	Contact string
+}
+
+// UserAgent formats the identity like other fediverse software does, e.g.
+// "probo/dev (+https://github.com/abreka/proboscideans; mailto:me@example.com)".
+func (id Identity) UserAgent() string {
+	var details []string
+	if id.URL != "" {
+		details = append(details, "+"+id.URL)
+	}
+	if id.Contact != "" {
+		contact := id.Contact
+		if strings.Contains(contact, "@") && !strings.Contains(contact, ":") {
+			contact = "mailto:" + contact
+		}
+		details = append(details, contact)
+	}
+
+	ua := id.Product + "/" + id.Version
+	if len(details) > 0 {
+		ua += fmt.Sprintf(" (%s)", strings.Join(details, "; "))
+	}
+	return ua
+}
+
+var (
+	current = Identity{Product: "probo", Version: "dev", URL: ProjectURL}
+	mu      sync.Mutex
+)
+
+// Current returns the identity requests are sent with.
+func Current() Identity {
+	mu.Lock()
+	defer mu.Unlock()
+	return current
+}
+
+// SetContact sets the contact address sent with every request from now on.
+func SetContact(contact string) {
+	mu.Lock()
+	defer mu.Unlock()
+	current.Contact = contact
+}
+
+// Transport is an http.RoundTripper that sets the User-Agent of every
+// request that doesn't have one already.
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", Current().UserAgent())
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return base.RoundTrip(req)
+}
@@ -0,0 +1,37 @@
+package identity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdentity_UserAgent(t *testing.T) {
+	id := Identity{Product: "probo", Version: "dev", URL: ProjectURL}
+	require.Equal(t, "probo/dev (+https://github.com/abreka/proboscideans)", id.UserAgent())
+
+	id.Contact = "me@example.com"
+	require.Equal(t, "probo/dev (+https://github.com/abreka/proboscideans; mailto:me@example.com)", id.UserAgent())
+
+	id.Contact = "https://example.com/about"
+	require.Equal(t, "probo/dev (+https://github.com/abreka/proboscideans; https://example.com/about)", id.UserAgent())
+}
+
+func TestTransport(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer server.Close()
+
+	SetContact("me@example.com")
+	defer SetContact("")
+
+	client := &http.Client{Transport: &Transport{}}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, Current().UserAgent(), got)
+}
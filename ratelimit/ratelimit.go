@@ -0,0 +1,223 @@
+// Package ratelimit keeps HTTP clients inside the rate limits Mastodon
+// servers advertise, so a crawl across thousands of them stays polite.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/abreka/proboscideans/identity"
+)
+
+// DefaultBackoff is how long a host is left alone after a 429 that doesn't
+// say when to come back.
+const DefaultBackoff = 30 * time.Second
+
+// HostState is what a host last told us about its rate limit.
+type HostState struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+
+	// BlockedUntil is set by a 429 or a 503 with Retry-After.
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+}
+
+// Error is returned instead of waiting longer than a Transport's MaxWait.
+type Error struct {
+	Host  string
+	Until time.Time
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: rate limited until %s", e.Host, e.Until.Format(time.RFC3339))
+}
+
+// Transport is an http.RoundTripper that tracks each host's rate limit from
+// the X-RateLimit-* headers and holds requests back before it runs out, and
+// after a 429 until Retry-After (or the limit's reset) has passed. It never
+// retries anything itself; a 429 is still returned to the caller.
+type Transport struct {
+	Base http.RoundTripper
+
+	// Reserve is how many requests are left unused in every window, for
+	// other clients sharing our address.
+	Reserve int
+
+	// MaxWait bounds how long a request is held back. Requests that would
+	// wait longer fail with an *Error instead. Zero waits as long as it
+	// takes, or until the request's context is done.
+	MaxWait time.Duration
+
+	hosts map[string]*HostState
+	sync.Mutex
+}
+
+func NewTransport(base http.RoundTripper) *Transport {
+	return &Transport{Base: base, Reserve: 2}
+}
+
+// Default is the transport every request should go through, so that limits
+// are shared across everything talking to the same host. It also says who
+// we are.
+var Default = NewTransport(&identity.Transport{Base: http.DefaultTransport})
+
+// Client is an http.Client using Default.
+var Client = &http.Client{Transport: Default}
+
+// State returns what is known about a host's rate limit.
+func (t *Transport) State(host string) (HostState, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		return HostState{}, false
+	}
+	return *state, true
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.Wait(req.Context(), req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.Observe(req.URL.Host, resp)
+	return resp, nil
+}
+
+// Wait blocks until a request to host may go ahead and counts it against
+// the host's remaining requests. Only requests that bypass the Transport,
+// like WebSocket handshakes, need to call it themselves.
+func (t *Transport) Wait(ctx context.Context, host string) error {
+	for {
+		wait, err := t.reserve(host, time.Now())
+		if err != nil || wait <= 0 {
+			return err
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve takes one of host's remaining requests, or says how long to wait
+// for one.
+func (t *Transport) reserve(host string, now time.Time) (time.Duration, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		return 0, nil
+	}
+
+	var until time.Time
+	switch {
+	case state.BlockedUntil.After(now):
+		until = state.BlockedUntil
+	case state.Limit > 0 && state.Reset.After(now) && state.Remaining <= t.Reserve:
+		until = state.Reset
+	}
+
+	if until.IsZero() {
+		if state.Reset.After(now) {
+			state.Remaining--
+		}
+		return 0, nil
+	}
+
+	wait := until.Sub(now)
+	if t.MaxWait > 0 && wait > t.MaxWait {
+		return 0, &Error{Host: host, Until: until}
+	}
+	return wait, nil
+}
+
+// Observe updates a host's state from a response's headers. Only requests
+// that bypass the Transport need to call it themselves.
+func (t *Transport) Observe(host string, resp *http.Response) {
+	now := time.Now()
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.hosts == nil {
+		t.hosts = make(map[string]*HostState)
+	}
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &HostState{}
+	}
+
+	limit, limitErr := strconv.Atoi(resp.Header.Get("X-RateLimit-Limit"))
+	remaining, remainingErr := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	reset, resetErr := parseReset(resp.Header.Get("X-RateLimit-Reset"), now)
+	if limitErr == nil && remainingErr == nil && resetErr == nil {
+		state.Limit = limit
+		state.Remaining = remaining
+		state.Reset = reset
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+		if !ok && resetErr == nil && reset.After(now) {
+			until, ok = reset, true
+		}
+		if !ok {
+			until = now.Add(DefaultBackoff)
+		}
+		state.BlockedUntil = until
+	case http.StatusServiceUnavailable:
+		if until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now); ok {
+			state.BlockedUntil = until
+		}
+	}
+
+	if state.Limit == 0 && state.BlockedUntil.IsZero() {
+		// Nothing worth remembering.
+		return
+	}
+	t.hosts[host] = state
+}
+
+// parseReset reads X-RateLimit-Reset, which Mastodon sends as a timestamp
+// but some servers send as seconds from now.
+func parseReset(s string, now time.Time) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return now.Add(time.Duration(seconds * float64(time.Second))), nil
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// parseRetryAfter reads Retry-After in seconds or as an HTTP date.
+func parseRetryAfter(s string, now time.Time) (time.Time, bool) {
+	if s == "" {
+		return time.Time{}, false
+	}
+	if seconds, err := strconv.Atoi(s); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if at, err := http.ParseTime(s); err == nil {
+		return at, true
+	}
+	return time.Time{}, false
+}
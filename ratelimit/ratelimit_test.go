@@ -0,0 +1,100 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransport_holdsBackBeforeExhaustion(t *testing.T) {
+	var mu sync.Mutex
+	remaining := 3
+	reset := time.Now().Add(300 * time.Millisecond)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Now().After(reset) {
+			remaining = 3
+			reset = time.Now().Add(300 * time.Millisecond)
+		}
+		remaining--
+		w.Header().Set("X-RateLimit-Limit", "3")
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", reset.UTC().Format(time.RFC3339Nano))
+	}))
+	defer server.Close()
+
+	transport := NewTransport(http.DefaultTransport)
+	transport.Reserve = 1
+	client := &http.Client{Transport: transport}
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+	}
+	require.Less(t, time.Since(start), 200*time.Millisecond)
+
+	state, ok := transport.State(server.Listener.Addr().String())
+	require.True(t, ok)
+	require.Equal(t, 1, state.Remaining)
+
+	// Only the reserve is left, so this one waits for the reset.
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+}
+
+func TestTransport_honoursRetryAfter(t *testing.T) {
+	var mu sync.Mutex
+	var hits []time.Time
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits = append(hits, time.Now())
+		first := len(hits) == 1
+		mu.Unlock()
+
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	transport := NewTransport(http.DefaultTransport)
+	client := &http.Client{Transport: transport}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, hits, 2)
+	require.GreaterOrEqual(t, hits[1].Sub(hits[0]), 900*time.Millisecond)
+
+	// Past MaxWait requests fail instead of waiting.
+	transport.MaxWait = time.Millisecond
+	transport.Observe("other.example", &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"60"}}})
+	err = transport.Wait(context.Background(), "other.example")
+	var limitErr *Error
+	require.True(t, errors.As(err, &limitErr))
+	require.Equal(t, "other.example", limitErr.Host)
+}
@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/abreka/proboscideans/archive"
+	"github.com/abreka/proboscideans/streaming"
+)
+
+// File is an archive open for reading, in either format stream-distributed
+// writes, or one backfill writes.
+type File struct {
+	Path string
+
+	fp     *os.File
+	gz     *gzip.Reader
+	decode func() (*streaming.Envelope, error)
+}
+
+// IsArchive reports whether a file name looks like an archive, finished
+// (.probo, .json.gz) or not (.part).
+func IsArchive(name string) bool {
+	name = strings.TrimSuffix(name, ".part")
+	return strings.HasSuffix(name, ".probo") || strings.HasSuffix(name, ".json.gz")
+}
+
+// Open opens an archive, telling the format from its name.
+func Open(path string) (*File, error) {
+	name := strings.TrimSuffix(path, ".part")
+	if !IsArchive(name) {
+		return nil, fmt.Errorf("%s: not a .probo or .json.gz archive", path)
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Path: path, fp: fp}
+
+	if strings.HasSuffix(name, ".probo") {
+		r, err := archive.NewReader(fp)
+		if err != nil {
+			_ = fp.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		f.decode = r.Decode
+		return f, nil
+	}
+
+	f.gz, err = gzip.NewReader(fp)
+	if err != nil {
+		_ = fp.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	dec := streaming.NewDecoder(f.gz)
+	f.decode = func() (*streaming.Envelope, error) {
+		envelope, err := dec.Decode()
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			// The last line of a gzip stream that was never finished is
+			// usually cut short too, and only fails to decode. It's the last
+			// one if the stream ends right after it.
+			if _, next := dec.Decode(); errors.Is(next, io.ErrUnexpectedEOF) {
+				err = next
+			}
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// A gzip stream that was never finished.
+			return nil, archive.ErrTruncated
+		}
+		return envelope, err
+	}
+	return f, nil
+}
+
+// Decode returns the next envelope, io.EOF at the end of the archive, or
+// archive.ErrTruncated if the archive ends early, e.g. because it is still
+// being written.
+func (f *File) Decode() (*streaming.Envelope, error) {
+	envelope, err := f.decode()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, archive.ErrTruncated) {
+		return nil, fmt.Errorf("%s: %w", f.Path, err)
+	}
+	return envelope, err
+}
+
+func (f *File) Close() error {
+	if f.gz != nil {
+		_ = f.gz.Close()
+	}
+	return f.fp.Close()
+}
+
+// Find expands directories among paths into the archives in them, sorted
+// by name. Other paths are kept as they are.
+func Find(paths []string) ([]string, error) {
+	var found []string
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			found = append(found, path)
+			continue
+		}
+
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, entry := range entries {
+			if !entry.IsDir() && IsArchive(entry.Name()) {
+				names = append(names, filepath.Join(path, entry.Name()))
+			}
+		}
+		sort.Strings(names)
+		found = append(found, names...)
+	}
+	return found, nil
+}
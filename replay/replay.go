@@ -0,0 +1,187 @@
+// Package replay plays archives back as though they were being received,
+// for testing whatever consumes the live stream.
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/archive"
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/mattn/go-mastodon"
+)
+
+// Replay plays archives back in order.
+type Replay struct {
+	// Speed scales the time between envelopes: 1 is as they were received,
+	// 10 ten times faster. 0 doesn't wait at all.
+	Speed float64
+
+	// From and To, when set, limit the replay to envelopes received at or
+	// after From and before To. Envelopes with no time at all, which only
+	// archives from before envelopes can have, are left out when they are
+	// set.
+	From time.Time
+	To   time.Time
+
+	// Servers, when set, limits the replay to envelopes from servers whose
+	// host matches one of these globs.
+	Servers []string
+}
+
+// Stats counts what a replay went through.
+type Stats struct {
+	Files    int `json:"files"`
+	Events   int `json:"events"`
+	Filtered int `json:"filtered"`
+	// Truncated lists the archives that ended early, which is expected of
+	// ones still being written.
+	Truncated []string `json:"truncated,omitempty"`
+}
+
+// Run hands every envelope in the archives at paths to emit, pacing them
+// by when they were received. The archives are played one after the other,
+// ordered by when their first envelope was received. It stops at the first
+// error from an archive or from emit, or once ctx is done.
+//
+// Archives written before stream-distributed had envelopes don't say when
+// anything was received, so their statuses are timed by when they were
+// created, and other events by the status before them.
+func (r *Replay) Run(ctx context.Context, paths []string, emit func(*streaming.Envelope) error) (Stats, error) {
+	var stats Stats
+
+	paths, err := inOrder(paths)
+	if err != nil {
+		return stats, err
+	}
+
+	var base, start time.Time
+	for _, p := range paths {
+		f, err := Open(p)
+		if err != nil {
+			return stats, err
+		}
+		stats.Files++
+
+		var last time.Time
+		for {
+			envelope, err := f.Decode()
+			if errors.Is(err, archive.ErrTruncated) {
+				stats.Truncated = append(stats.Truncated, p)
+				break
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				_ = f.Close()
+				return stats, err
+			}
+
+			at := receivedAt(envelope, last)
+			last = at
+			if !r.match(envelope, at) {
+				stats.Filtered++
+				continue
+			}
+
+			if r.Speed > 0 && !at.IsZero() {
+				if base.IsZero() {
+					base, start = at, time.Now()
+				}
+				offset := time.Duration(float64(at.Sub(base)) / r.Speed)
+				if err := sleepUntil(ctx, start.Add(offset)); err != nil {
+					_ = f.Close()
+					return stats, err
+				}
+			} else if err := ctx.Err(); err != nil {
+				_ = f.Close()
+				return stats, err
+			}
+
+			if err := emit(envelope); err != nil {
+				_ = f.Close()
+				return stats, err
+			}
+			stats.Events++
+		}
+
+		if err := f.Close(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (r *Replay) match(envelope *streaming.Envelope, at time.Time) bool {
+	if !r.From.IsZero() && (at.IsZero() || at.Before(r.From)) {
+		return false
+	}
+	if !r.To.IsZero() && (at.IsZero() || !at.Before(r.To)) {
+		return false
+	}
+	return len(r.Servers) == 0 || accounts.MatchHost(r.Servers, envelope.Server)
+}
+
+// receivedAt returns when an envelope was received or, if the archive
+// didn't record it, when its status or notification was created. Anything
+// else is taken to have come at the same time as the envelope before it.
+func receivedAt(envelope *streaming.Envelope, last time.Time) time.Time {
+	if !envelope.ReceivedAt.IsZero() {
+		return envelope.ReceivedAt
+	}
+	if status := envelope.Status(); status != nil && !status.CreatedAt.IsZero() {
+		return status.CreatedAt
+	}
+	if event, ok := envelope.Event.(*mastodon.NotificationEvent); ok && event.Notification != nil && !event.Notification.CreatedAt.IsZero() {
+		return event.Notification.CreatedAt
+	}
+	return last
+}
+
+// inOrder sorts archives by when their first envelope was received. Ones
+// without any, or whose first envelope has no time, keep their place at the
+// front.
+func inOrder(paths []string) ([]string, error) {
+	firsts := make(map[string]time.Time, len(paths))
+	for _, p := range paths {
+		f, err := Open(p)
+		if err != nil {
+			return nil, err
+		}
+		envelope, err := f.Decode()
+		_ = f.Close()
+		switch {
+		case err == nil:
+			firsts[p] = receivedAt(envelope, time.Time{})
+		case errors.Is(err, io.EOF), errors.Is(err, archive.ErrTruncated):
+		default:
+			return nil, err
+		}
+	}
+
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return firsts[sorted[i]].Before(firsts[sorted[j]])
+	})
+	return sorted, nil
+}
+
+func sleepUntil(ctx context.Context, at time.Time) error {
+	wait := time.Until(at)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,204 @@
+package replay
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/abreka/proboscideans/archive"
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+var t0 = time.Date(2022, 11, 20, 9, 0, 0, 0, time.UTC)
+
+func envelopeAt(server string, id string, seconds int) *streaming.Envelope {
+	return &streaming.Envelope{
+		Server:     server,
+		ReceivedAt: t0.Add(time.Duration(seconds) * time.Second),
+		Stream:     streaming.PublicStream(true),
+		Event:      &mastodon.UpdateEvent{Status: &mastodon.Status{ID: mastodon.ID(id)}},
+	}
+}
+
+func writeGzip(t *testing.T, path string, envelopes ...*streaming.Envelope) {
+	fp, err := os.Create(path)
+	require.NoError(t, err)
+	gz := gzip.NewWriter(fp)
+	enc := streaming.NewEncoder(gz)
+	for _, envelope := range envelopes {
+		require.NoError(t, enc.Encode(envelope))
+	}
+	require.NoError(t, gz.Close())
+	require.NoError(t, fp.Close())
+}
+
+// writeBlocks writes a segment, leaving it without an index unless closed.
+func writeBlocks(t *testing.T, path string, closed bool, envelopes ...*streaming.Envelope) {
+	fp, err := os.Create(path)
+	require.NoError(t, err)
+	w, err := archive.NewWriter(fp)
+	require.NoError(t, err)
+	for _, envelope := range envelopes {
+		require.NoError(t, w.Encode(envelope))
+	}
+	if closed {
+		require.NoError(t, w.Close())
+	} else {
+		require.NoError(t, w.Flush())
+	}
+	require.NoError(t, fp.Close())
+}
+
+func ids(envelopes []*streaming.Envelope) []mastodon.ID {
+	var out []mastodon.ID
+	for _, envelope := range envelopes {
+		out = append(out, envelope.Status().ID)
+	}
+	return out
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	// Named out of order on purpose: replay goes by what's inside.
+	writeGzip(t, filepath.Join(dir, "a.json.gz"),
+		envelopeAt("https://a.example", "4", 4),
+		envelopeAt("https://b.example", "5", 5))
+	writeBlocks(t, filepath.Join(dir, "b.probo"), true,
+		envelopeAt("https://a.example", "1", 1),
+		envelopeAt("https://b.example", "2", 2))
+	writeBlocks(t, filepath.Join(dir, "c.probo.part"), false,
+		envelopeAt("https://a.example", "3", 3))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644))
+
+	paths, err := Find([]string{dir})
+	require.NoError(t, err)
+	require.Len(t, paths, 3)
+
+	var got []*streaming.Envelope
+	emit := func(envelope *streaming.Envelope) error {
+		got = append(got, envelope)
+		return nil
+	}
+
+	r := &Replay{}
+	stats, err := r.Run(context.Background(), paths, emit)
+	require.NoError(t, err)
+	require.Equal(t, []mastodon.ID{"1", "2", "3", "4", "5"}, ids(got))
+	require.Equal(t, Stats{Files: 3, Events: 5, Truncated: []string{filepath.Join(dir, "c.probo.part")}}, stats)
+
+	got = nil
+	r = &Replay{Servers: []string{"a.*"}, From: t0.Add(2 * time.Second), To: t0.Add(5 * time.Second)}
+	stats, err = r.Run(context.Background(), paths, emit)
+	require.NoError(t, err)
+	require.Equal(t, []mastodon.ID{"3", "4"}, ids(got))
+	require.Equal(t, 3, stats.Filtered)
+}
+
+func TestReplay_Pacing(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "stream.json.gz")
+	writeGzip(t, path,
+		envelopeAt("https://a.example", "1", 0),
+		envelopeAt("https://a.example", "2", 10),
+		envelopeAt("https://a.example", "3", 20))
+
+	var at []time.Time
+	emit := func(*streaming.Envelope) error {
+		at = append(at, time.Now())
+		return nil
+	}
+
+	// 20s of events at 200x takes 100ms.
+	r := &Replay{Speed: 200}
+	_, err := r.Run(context.Background(), []string{path}, emit)
+	require.NoError(t, err)
+	require.Len(t, at, 3)
+	require.GreaterOrEqual(t, at[1].Sub(at[0]), 45*time.Millisecond)
+	require.GreaterOrEqual(t, at[2].Sub(at[0]), 95*time.Millisecond)
+
+	// Cancelling stops it mid-wait.
+	ctx, cancel := context.WithCancel(context.Background())
+	at = nil
+	r = &Replay{Speed: 1}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	stats, err := r.Run(ctx, []string{path}, emit)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, stats.Events)
+}
+
+func TestReplay_TornGzip(t *testing.T) {
+	dir := t.TempDir()
+	full := filepath.Join(dir, "full.json.gz")
+	var envelopes []*streaming.Envelope
+	for i := 1; i <= 200; i++ {
+		envelopes = append(envelopes, envelopeAt("https://a.example", fmt.Sprint(i), i))
+	}
+	writeGzip(t, full, envelopes...)
+	b, err := os.ReadFile(full)
+	require.NoError(t, err)
+
+	// Wherever a killed run stopped writing, what's there is played and the
+	// rest is put down to the archive being torn.
+	for _, size := range []int{len(b) / 2, len(b) * 3 / 4, len(b) - 9, len(b) - 1} {
+		path := filepath.Join(dir, fmt.Sprintf("stream-%d.json.gz.part", size))
+		require.NoError(t, os.WriteFile(path, b[:size], 0644))
+
+		var got []*streaming.Envelope
+		stats, err := (&Replay{}).Run(context.Background(), []string{path}, func(envelope *streaming.Envelope) error {
+			got = append(got, envelope)
+			return nil
+		})
+		require.NoError(t, err, "cut at %d", size)
+		require.Equal(t, []string{path}, stats.Truncated)
+		require.Equal(t, ids(envelopes[:len(got)]), ids(got))
+	}
+}
+
+func TestReplay_Baseline(t *testing.T) {
+	dir := t.TempDir()
+	// stream-distributed's output from before envelopes: bare events with
+	// no server and no time received.
+	fp, err := os.Create(filepath.Join(dir, "z-baseline.json.gz"))
+	require.NoError(t, err)
+	gz := gzip.NewWriter(fp)
+	for _, line := range []string{
+		`{"Status":{"id":"1","created_at":"2022-11-20T09:00:01Z"}}`,
+		`{"ID":"1"}`,
+		`{"Status":{"id":"3","created_at":"2022-11-20T09:00:03Z"}}`,
+	} {
+		_, err := fmt.Fprintln(gz, line)
+		require.NoError(t, err)
+	}
+	require.NoError(t, gz.Close())
+	require.NoError(t, fp.Close())
+	writeGzip(t, filepath.Join(dir, "a.json.gz"), envelopeAt("https://a.example", "9", 10))
+
+	paths, err := Find([]string{dir})
+	require.NoError(t, err)
+
+	var got []*streaming.Envelope
+	var at []time.Time
+	r := &Replay{Speed: 200, From: t0.Add(2 * time.Second), To: t0.Add(20 * time.Second)}
+	stats, err := r.Run(context.Background(), paths, func(envelope *streaming.Envelope) error {
+		got = append(got, envelope)
+		at = append(at, time.Now())
+		return nil
+	})
+	require.NoError(t, err)
+
+	// Statuses go by when they were created, the delete with the status
+	// before it, and the baseline archive before the newer one.
+	require.Equal(t, []mastodon.ID{"3", "9"}, ids(got))
+	require.Equal(t, 2, stats.Filtered)
+	// 7s at 200x.
+	require.GreaterOrEqual(t, at[1].Sub(at[0]), 30*time.Millisecond)
+}
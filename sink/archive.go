@@ -0,0 +1,397 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/abreka/proboscideans/archive"
+	"github.com/abreka/proboscideans/streaming"
+)
+
+// PartialSuffix marks a segment that is still being written, or was when
+// probo died.
+const PartialSuffix = ".part"
+
+// DefaultNameTemplate names segments after the time they were opened, in
+// UTC, so they sort in order.
+const DefaultNameTemplate = `stream-{{.Start.Format "20060102T150405Z"}}-{{.Seq}}{{.Ext}}`
+
+// DefaultFlushInterval bounds how much a crash can lose from a quiet
+// archive.
+const DefaultFlushInterval = 10 * time.Second
+
+// SegmentFormat is how an Archive lays out its segments.
+type SegmentFormat string
+
+const (
+	// FormatBlocks is the crash-safe format of the archive package.
+	FormatBlocks SegmentFormat = "blocks"
+	// FormatGzip is gzipped newline-delimited JSON. A segment that was
+	// being written when probo died is unreadable past some point.
+	FormatGzip SegmentFormat = "gzip"
+)
+
+func ParseSegmentFormat(s string) (SegmentFormat, error) {
+	switch format := SegmentFormat(s); format {
+	case FormatBlocks, FormatGzip:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown segment format %q", s)
+	}
+}
+
+// Ext is the file extension for segments in the format.
+func (f SegmentFormat) Ext() string {
+	if f == FormatGzip {
+		return ".json.gz"
+	}
+	return ".probo"
+}
+
+// RotationPolicy decides when an Archive starts a new segment.
+type RotationPolicy struct {
+	// MaxSize is the most compressed bytes written to a segment before
+	// the next one is started. Zero means no limit.
+	MaxSize int64
+
+	// Interval rotates segments on wall-clock boundaries, e.g. on the hour.
+	// Zero means never.
+	Interval time.Duration
+}
+
+var DefaultRotationPolicy = RotationPolicy{
+	MaxSize:  1 << 30,
+	Interval: time.Hour,
+}
+
+// SegmentName is what a name template gets to work with.
+type SegmentName struct {
+	// Start is when the segment was opened, in UTC.
+	Start time.Time
+	// Seq counts the segments opened by this Archive, starting at 0.
+	Seq int
+	// Ext is the file extension for the archive's format.
+	Ext string
+}
+
+// Archive writes envelopes to a series of segments in Dir. A segment is
+// written under its name plus PartialSuffix and only gets its real name
+// once it has been flushed, synced and closed, so anything without the
+// suffix is complete.
+type Archive struct {
+	Dir      string
+	Rotation RotationPolicy
+	Format   SegmentFormat
+
+	// FlushInterval is how often buffered envelopes are written out and
+	// synced. Zero leaves it to rotation and Flush. Without Run it's only
+	// checked on Write.
+	FlushInterval time.Duration
+
+	name *template.Template
+	seq  int
+
+	file      *os.File
+	path      string
+	seg       segment
+	written   *countingWriter
+	rotate    time.Time
+	lastFlush time.Time
+	dirty     bool
+	closed    bool
+
+	// now is swapped out by tests.
+	now func() time.Time
+
+	sync.Mutex
+}
+
+// OpenArchive returns an Archive writing to dir, creating it if needed.
+// nameTemplate is a text/template executed with a SegmentName, and may
+// put segments in subdirectories.
+func OpenArchive(dir, nameTemplate string, rotation RotationPolicy) (*Archive, error) {
+	name, err := template.New("segment").Option("missingkey=error").Parse(nameTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("bad segment name template: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Archive{
+		Dir:           dir,
+		Rotation:      rotation,
+		Format:        FormatBlocks,
+		FlushInterval: DefaultFlushInterval,
+		name:          name,
+		now:           time.Now,
+	}, nil
+}
+
+// Write appends an envelope to the current segment, first starting a new
+// one if the current one is due to rotate.
+func (a *Archive) Write(envelope *streaming.Envelope) error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.closed {
+		return errors.New("archive is closed")
+	}
+
+	now := a.now()
+	if a.file != nil && a.dueLocked(now) {
+		if err := a.closeSegmentLocked(); err != nil {
+			return err
+		}
+	}
+	if a.file == nil {
+		if err := a.openSegmentLocked(now); err != nil {
+			return err
+		}
+	}
+
+	if err := a.seg.Encode(envelope); err != nil {
+		return err
+	}
+	a.dirty = true
+	if a.FlushInterval > 0 && now.Sub(a.lastFlush) >= a.FlushInterval {
+		return a.flushLocked(now)
+	}
+	return nil
+}
+
+// Flush writes out anything buffered in the current segment and syncs it.
+func (a *Archive) Flush() error {
+	a.Lock()
+	defer a.Unlock()
+	return a.flushLocked(a.now())
+}
+
+func (a *Archive) flushLocked(now time.Time) error {
+	if a.file == nil {
+		return nil
+	}
+	a.lastFlush = now
+	a.dirty = false
+	if err := a.seg.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Run checks every interval whether the current segment is due to be
+// flushed or rotated, so that a quiet archive is kept as fresh on disk as a
+// busy one. Errors are sent on the returned channel, which is closed once
+// ctx is done.
+func (a *Archive) Run(ctx context.Context, interval time.Duration) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := a.tick(); err != nil {
+				select {
+				case errs <- err:
+				default:
+				}
+			}
+		}
+	}()
+	return errs
+}
+
+// tick does what Write would have done by now had there been anything to
+// write.
+func (a *Archive) tick() error {
+	a.Lock()
+	defer a.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	now := a.now()
+	if a.dueLocked(now) {
+		return a.closeSegmentLocked()
+	}
+	if a.dirty && a.FlushInterval > 0 && now.Sub(a.lastFlush) >= a.FlushInterval {
+		return a.flushLocked(now)
+	}
+	return nil
+}
+
+// Rotate closes the current segment, if there is one. The next write
+// starts a new one.
+func (a *Archive) Rotate() error {
+	a.Lock()
+	defer a.Unlock()
+	return a.closeSegmentLocked()
+}
+
+// Close closes the current segment. Nothing may be written afterwards.
+func (a *Archive) Close() error {
+	a.Lock()
+	defer a.Unlock()
+	a.closed = true
+	return a.closeSegmentLocked()
+}
+
+// Segment returns the path of the segment being written, if any.
+func (a *Archive) Segment() string {
+	a.Lock()
+	defer a.Unlock()
+	return a.path
+}
+
+func (a *Archive) dueLocked(now time.Time) bool {
+	if a.Rotation.MaxSize > 0 && a.written.n >= a.Rotation.MaxSize {
+		return true
+	}
+	return !a.rotate.IsZero() && !now.Before(a.rotate)
+}
+
+func (a *Archive) openSegmentLocked(now time.Time) error {
+	now = now.UTC()
+
+	// Names only have to be unique, so on a clash try the next Seq.
+	for attempt := 0; ; attempt++ {
+		var name bytes.Buffer
+		if err := a.name.Execute(&name, SegmentName{Start: now, Seq: a.seq, Ext: a.Format.Ext()}); err != nil {
+			return fmt.Errorf("naming segment: %w", err)
+		}
+		a.seq++
+
+		segmentPath := filepath.Join(a.Dir, name.String())
+		if _, err := os.Stat(segmentPath); err == nil {
+			if attempt >= 100 {
+				return fmt.Errorf("segment %s already exists", segmentPath)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(segmentPath), 0755); err != nil {
+			return err
+		}
+		fp, err := os.OpenFile(segmentPath+PartialSuffix, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if errors.Is(err, os.ErrExist) && attempt < 100 {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		a.file = fp
+		a.path = segmentPath
+		break
+	}
+
+	a.written = &countingWriter{w: a.file}
+	seg, err := newSegment(a.Format, a.written)
+	if err != nil {
+		_ = a.file.Close()
+		_ = os.Remove(a.path + PartialSuffix)
+		a.file, a.path = nil, ""
+		return err
+	}
+	a.seg = seg
+	a.lastFlush = now
+	a.rotate = time.Time{}
+	if a.Rotation.Interval > 0 {
+		a.rotate = now.Truncate(a.Rotation.Interval).Add(a.Rotation.Interval)
+	}
+	return nil
+}
+
+// closeSegmentLocked flushes, syncs and closes the current segment, then
+// gives it its real name.
+func (a *Archive) closeSegmentLocked() error {
+	if a.file == nil {
+		return nil
+	}
+	fp, seg, segmentPath := a.file, a.seg, a.path
+	a.file, a.path, a.seg, a.written = nil, "", nil, nil
+
+	err := seg.Close()
+	if err == nil {
+		err = fp.Sync()
+	}
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("closing segment %s: %w", segmentPath, err)
+	}
+
+	if err := os.Rename(segmentPath+PartialSuffix, segmentPath); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(segmentPath))
+}
+
+// syncDir makes a rename durable. Not every platform can sync a directory,
+// so failing to open it isn't an error.
+func syncDir(dir string) error {
+	fp, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = fp.Close() }()
+	if err := fp.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
+
+// segment is the format-specific part of a segment. Close finishes the
+// format but leaves the file to the Archive.
+type segment interface {
+	Encode(envelope *streaming.Envelope) error
+	Flush() error
+	Close() error
+}
+
+func newSegment(format SegmentFormat, w io.Writer) (segment, error) {
+	switch format {
+	case FormatBlocks, "":
+		return archive.NewWriter(w)
+	case FormatGzip:
+		gz := gzip.NewWriter(w)
+		return &gzipSegment{Writer: gz, enc: streaming.NewEncoder(gz)}, nil
+	default:
+		return nil, fmt.Errorf("unknown segment format %q", format)
+	}
+}
+
+type gzipSegment struct {
+	*gzip.Writer
+	enc *streaming.Encoder
+}
+
+func (s *gzipSegment) Encode(envelope *streaming.Envelope) error {
+	return s.enc.Encode(envelope)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,162 @@
+package sink
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abreka/proboscideans/archive"
+	"github.com/abreka/proboscideans/streaming"
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func readSegment(t *testing.T, segmentPath string) []mastodon.ID {
+	fp, err := os.Open(segmentPath)
+	require.NoError(t, err)
+	defer func() { _ = fp.Close() }()
+
+	var dec interface {
+		Decode() (*streaming.Envelope, error)
+	}
+	if strings.HasSuffix(segmentPath, FormatGzip.Ext()) {
+		gz, err := gzip.NewReader(fp)
+		require.NoError(t, err)
+		dec = streaming.NewDecoder(gz)
+	} else {
+		dec, err = archive.NewReader(fp)
+		require.NoError(t, err)
+	}
+
+	var ids []mastodon.ID
+	for {
+		envelope, err := dec.Decode()
+		if err == io.EOF {
+			return ids
+		}
+		require.NoError(t, err)
+		ids = append(ids, envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+	}
+}
+
+func update(id string) *streaming.Envelope {
+	return &streaming.Envelope{
+		Server: "https://a.example",
+		Stream: streaming.PublicStream(true),
+		Event:  &mastodon.UpdateEvent{Status: &mastodon.Status{ID: mastodon.ID(id)}},
+	}
+}
+
+func TestArchive_RotatesOnInterval(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenArchive(dir, `{{.Start.Format "2006/01/02T15"}}.json.gz`, RotationPolicy{Interval: time.Hour})
+	require.NoError(t, err)
+	a.Format = FormatGzip
+
+	now := time.Date(2022, 11, 20, 9, 59, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	require.NoError(t, a.Write(update("1")))
+	require.NoError(t, a.Write(update("2")))
+	require.FileExists(t, filepath.Join(dir, "2022/11/20T09.json.gz"+PartialSuffix))
+
+	now = now.Add(time.Minute)
+	require.NoError(t, a.Write(update("3")))
+	require.NoError(t, a.Close())
+	require.Error(t, a.Write(update("4")))
+
+	require.Equal(t, []mastodon.ID{"1", "2"}, readSegment(t, filepath.Join(dir, "2022/11/20T09.json.gz")))
+	require.Equal(t, []mastodon.ID{"3"}, readSegment(t, filepath.Join(dir, "2022/11/20T10.json.gz")))
+
+	partials, err := filepath.Glob(filepath.Join(dir, "*/*/*"+PartialSuffix))
+	require.NoError(t, err)
+	require.Empty(t, partials)
+}
+
+func TestArchive_RotatesOnSize(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenArchive(dir, DefaultNameTemplate, RotationPolicy{MaxSize: 1})
+	require.NoError(t, err)
+
+	for _, id := range []string{"1", "2", "3"} {
+		require.NoError(t, a.Write(update(id)))
+		// Blocks are held in memory until full, so push them out to be counted.
+		require.NoError(t, a.seg.Flush())
+	}
+	require.NoError(t, a.Close())
+
+	segments, err := filepath.Glob(filepath.Join(dir, "stream-*.probo"))
+	require.NoError(t, err)
+	require.Len(t, segments, 3)
+	sort.Strings(segments)
+
+	var ids []mastodon.ID
+	for _, segment := range segments {
+		ids = append(ids, readSegment(t, segment)...)
+	}
+	require.ElementsMatch(t, []mastodon.ID{"1", "2", "3"}, ids)
+}
+
+func TestOpenArchive_BadTemplate(t *testing.T) {
+	_, err := OpenArchive(t.TempDir(), "{{.Nope", DefaultRotationPolicy)
+	require.Error(t, err)
+}
+
+func TestArchive_FlushedSegmentSurvivesACrash(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenArchive(dir, DefaultNameTemplate, DefaultRotationPolicy)
+	require.NoError(t, err)
+	a.FlushInterval = 0
+
+	require.NoError(t, a.Write(update("1")))
+	require.NoError(t, a.Write(update("2")))
+	require.NoError(t, a.Flush())
+	require.NoError(t, a.Write(update("3")))
+
+	// Never closed, as if probo had been killed.
+	partial := a.Segment() + PartialSuffix
+	fp, err := os.Open(partial)
+	require.NoError(t, err)
+	defer func() { _ = fp.Close() }()
+
+	repaired, err := os.Create(filepath.Join(dir, "repaired.probo"))
+	require.NoError(t, err)
+	defer func() { _ = repaired.Close() }()
+	w, err := archive.NewWriter(repaired)
+	require.NoError(t, err)
+
+	report, err := archive.Repair(fp, w)
+	require.NoError(t, err)
+	require.Equal(t, 2, report.Records)
+	require.Equal(t, []mastodon.ID{"1", "2"}, readSegment(t, repaired.Name()))
+}
+
+func TestArchive_TickFlushesAndRotates(t *testing.T) {
+	dir := t.TempDir()
+	a, err := OpenArchive(dir, `{{.Start.Format "15"}}.probo`, RotationPolicy{Interval: time.Hour})
+	require.NoError(t, err)
+
+	now := time.Date(2022, 11, 20, 9, 59, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	require.NoError(t, a.Write(update("1")))
+	require.NoError(t, a.tick())
+	require.True(t, a.dirty, "not due yet")
+
+	// Nothing else gets written, but it still reaches the disk...
+	now = now.Add(a.FlushInterval)
+	require.NoError(t, a.tick())
+	require.False(t, a.dirty)
+
+	// ...and the segment is finished on the hour.
+	now = time.Date(2022, 11, 20, 10, 0, 0, 0, time.UTC)
+	require.NoError(t, a.tick())
+	require.Empty(t, a.Segment())
+	require.Equal(t, []mastodon.ID{"1"}, readSegment(t, filepath.Join(dir, "09.probo")))
+	require.NoError(t, a.Close())
+}
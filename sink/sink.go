@@ -0,0 +1,62 @@
+// Package sink is where envelopes go once they've made it through the
+// streaming pipeline.
+package sink
+
+import (
+	"io"
+	"sync"
+
+	"github.com/abreka/proboscideans/streaming"
+)
+
+// Sink consumes envelopes. Close flushes anything buffered; nothing may be
+// written after it.
+type Sink interface {
+	Write(envelope *streaming.Envelope) error
+	Close() error
+}
+
+// Writer writes envelopes to w as newline-delimited JSON, e.g. to stdout.
+type Writer struct {
+	enc *streaming.Encoder
+	sync.Mutex
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: streaming.NewEncoder(w)}
+}
+
+func (w *Writer) Write(envelope *streaming.Envelope) error {
+	w.Lock()
+	defer w.Unlock()
+	return w.enc.Encode(envelope)
+}
+
+// Close does nothing; whoever made the io.Writer closes it.
+func (w *Writer) Close() error {
+	return nil
+}
+
+// Multi writes every envelope to all of its sinks, stopping at the first
+// error.
+type Multi []Sink
+
+func (m Multi) Write(envelope *streaming.Envelope) error {
+	for _, s := range m {
+		if err := s.Write(envelope); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every sink and returns the first error.
+func (m Multi) Close() error {
+	var first error
+	for _, s := range m {
+		if err := s.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,131 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoints_SaveAndOpen(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "checkpoints.json")
+
+	checkpoints, err := OpenCheckpoints(filePath)
+	require.NoError(t, err)
+	var flushed []string
+	flushErr := errors.New("disk full")
+	checkpoints.Flush = func() error {
+		flushed = append(flushed, "flush")
+		return flushErr
+	}
+	commit := func(id mastodon.ID) {
+		checkpoints.Commit(&Envelope{
+			Server: "https://a.example",
+			Stream: PublicStream(true),
+			Event:  &mastodon.UpdateEvent{Status: &mastodon.Status{ID: id}},
+		})
+	}
+	commit("99")
+	commit("100")
+	commit("98")
+	// Seen but not yet written anywhere, so it isn't saved.
+	checkpoints.Advance("https://a.example", PublicStream(true), "101")
+	checkpoints.Advance("https://a.example", PublicStream(false), "7")
+
+	// Nothing is saved unless the sink flushed what it covers.
+	require.ErrorIs(t, checkpoints.Save(), flushErr)
+	_, err = os.Stat(filePath)
+	require.True(t, os.IsNotExist(err))
+	flushErr = nil
+	require.NoError(t, checkpoints.Save())
+	require.Len(t, flushed, 2)
+
+	id, _ := checkpoints.Get("https://a.example", PublicStream(true))
+	require.Equal(t, mastodon.ID("101"), id)
+
+	reopened, err := OpenCheckpoints(filePath)
+	require.NoError(t, err)
+	id, ok := reopened.Get("https://a.example", PublicStream(true))
+	require.True(t, ok)
+	require.Equal(t, mastodon.ID("100"), id)
+
+	_, ok = reopened.Get("https://a.example", PublicStream(false))
+	require.False(t, ok)
+}
+
+func TestMux_backfill(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/timelines/public":
+			w.Header().Set("Content-Type", "application/json")
+			switch r.URL.Query().Get("min_id") {
+			case "5":
+				_, _ = fmt.Fprint(w, `[{"id":"7"},{"id":"6"}]`)
+			default:
+				_, _ = fmt.Fprint(w, `[]`)
+			}
+		case "/api/v1/streaming/public/local":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			_, _ = fmt.Fprint(w, "event: update\ndata: {\"id\":\"7\"}\n\n")
+			_, _ = fmt.Fprint(w, "event: update\ndata: {\"id\":\"8\"}\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+	mux.Checkpoints.Advance(server.URL, PublicStream(true), "5")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, _ := mux.StreamPublic(ctx, true)
+
+	for _, want := range []struct {
+		id         mastodon.ID
+		backfilled bool
+	}{{"6", true}, {"7", true}, {"8", false}} {
+		select {
+		case envelope := <-events:
+			require.Equal(t, want.id, envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+			require.Equal(t, want.backfilled, envelope.Backfilled)
+		case <-ctx.Done():
+			t.Fatalf("never received status %s", want.id)
+		}
+	}
+
+	id, _ := mux.Checkpoints.Get(server.URL, PublicStream(true))
+	require.Equal(t, mastodon.ID("8"), id)
+}
+
+func Test_fetchTimeline_throttled(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	// A 429 is for the breaker and ratelimit to deal with, not retried here.
+	client := mastodon.NewClient(&mastodon.Config{Server: server.URL})
+	_, err := fetchTimeline(context.Background(), client, PublicStream(true), mastodon.Pagination{})
+	var httpErr *HTTPError
+	require.True(t, errors.As(err, &httpErr))
+	require.Equal(t, FailureThrottled, ClassifyError(err))
+	require.Equal(t, 1, requests)
+}
@@ -0,0 +1,326 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abreka/proboscideans/ratelimit"
+)
+
+// FailureKind sorts stream failures by how we should react to them.
+type FailureKind int
+
+const (
+	// FailureTransient is anything that might fix itself shortly: gateway
+	// errors, timeouts, dropped connections.
+	FailureTransient FailureKind = iota
+	// FailureThrottled means the server asked us to slow down.
+	FailureThrottled
+	// FailurePermanent means retrying is pointless (and rude): the server
+	// doesn't exist, doesn't stream, or won't let us in.
+	FailurePermanent
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailureTransient:
+		return "transient"
+	case FailureThrottled:
+		return "throttled"
+	case FailurePermanent:
+		return "permanent"
+	default:
+		return fmt.Sprintf("FailureKind(%d)", int(k))
+	}
+}
+
+func (k FailureKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// go-mastodon flattens HTTP failures into strings like
+// "bad request: 404 Not Found: some message", so that's what we have to go on.
+var statusCodeInMessage = regexp.MustCompile(`: ([1-5][0-9]{2}) `)
+
+// statusCodeOf digs the HTTP status code out of err, if there is one.
+func statusCodeOf(err error) (int, bool) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode, true
+	}
+
+	m := statusCodeInMessage.FindStringSubmatch(err.Error() + " ")
+	if m == nil {
+		return 0, false
+	}
+	code, convErr := strconv.Atoi(m[1])
+	if convErr != nil {
+		return 0, false
+	}
+	return code, true
+}
+
+// ClassifyError decides whether a stream failure is worth retrying.
+func ClassifyError(err error) FailureKind {
+	if err == nil {
+		return FailureTransient
+	}
+
+	if code, ok := statusCodeOf(err); ok {
+		switch {
+		case code == http.StatusTooManyRequests:
+			return FailureThrottled
+		case code == http.StatusRequestTimeout:
+			return FailureTransient
+		case code >= 400 && code < 500:
+			// 401 is usually "streaming requires auth", 404 and 410 are
+			// servers that don't stream (or don't exist anymore).
+			return FailurePermanent
+		default:
+			return FailureTransient
+		}
+	}
+
+	var limitErr *ratelimit.Error
+	if errors.As(err, &limitErr) {
+		return FailureThrottled
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return FailurePermanent
+		}
+		return FailureTransient
+	}
+
+	// ErrorEvent only hands us the message so the type is usually gone.
+	if strings.Contains(err.Error(), "no such host") {
+		return FailurePermanent
+	}
+
+	return FailureTransient
+}
+
+// BreakerState is the usual closed/open/half-open circuit breaker state.
+type BreakerState int
+
+const (
+	// BreakerClosed lets connection attempts through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen blocks connection attempts until it times out.
+	BreakerOpen
+	// BreakerHalfOpen lets a single probe through to see if the server has
+	// recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return fmt.Sprintf("BreakerState(%d)", int(s))
+	}
+}
+
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// BreakerPolicy controls when a Breaker opens and for how long.
+type BreakerPolicy struct {
+	// FailureThreshold is the number of transient failures in a row that
+	// opens the breaker. Throttling and permanent failures open it at once.
+	FailureThreshold int
+
+	// OpenTimeout and ThrottleTimeout are how long the breaker stays open
+	// after too many transient failures or a 429. Zero keeps it closed.
+	OpenTimeout     time.Duration
+	ThrottleTimeout time.Duration
+
+	// PermanentTimeout is how long to wait before probing a server that
+	// failed permanently. Zero means never.
+	PermanentTimeout time.Duration
+}
+
+var DefaultBreakerPolicy = BreakerPolicy{
+	FailureThreshold: 3,
+	OpenTimeout:      5 * time.Minute,
+	ThrottleTimeout:  15 * time.Minute,
+	PermanentTimeout: 0,
+}
+
+// Breaker is a per-server circuit breaker. It outlives individual
+// connections so a server that keeps failing stays benched across
+// reconnects.
+type Breaker struct {
+	policy BreakerPolicy
+
+	state     BreakerState
+	failures  int
+	lastErr   error
+	openUntil time.Time // zero while open means forever
+	probing   bool
+
+	sync.Mutex
+}
+
+func NewBreaker(policy BreakerPolicy) *Breaker {
+	return &Breaker{policy: policy}
+}
+
+// State returns the current state, moving from open to half-open if the
+// open timeout has passed.
+func (b *Breaker) State() BreakerState {
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(time.Now())
+	return b.state
+}
+
+// OpenUntil returns when an open breaker will let a probe through. The zero
+// time means never.
+func (b *Breaker) OpenUntil() time.Time {
+	b.Lock()
+	defer b.Unlock()
+	return b.openUntil
+}
+
+// Allow reports whether a connection attempt may go ahead. In the half-open
+// state only one attempt at a time is allowed.
+func (b *Breaker) Allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(time.Now())
+
+	switch b.state {
+	case BreakerClosed:
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait blocks until the breaker allows an attempt. It returns false if ctx
+// is done first or the breaker is open forever.
+func (b *Breaker) Wait(ctx context.Context) bool {
+	for !b.Allow() {
+		b.Lock()
+		openUntil := b.openUntil
+		b.Unlock()
+
+		if openUntil.IsZero() {
+			return false
+		}
+
+		wait := time.Until(openUntil)
+		if wait <= 0 {
+			// Someone else is probing.
+			wait = time.Second
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// Success closes the breaker.
+func (b *Breaker) Success() {
+	b.Lock()
+	defer b.Unlock()
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+	b.openUntil = time.Time{}
+}
+
+// Failure records a failed attempt and returns how it was classified.
+func (b *Breaker) Failure(err error) FailureKind {
+	kind := ClassifyError(err)
+
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	b.refresh(now)
+	b.failures++
+	b.lastErr = err
+	b.probing = false
+
+	switch {
+	case kind == FailurePermanent:
+		b.state = BreakerOpen
+		b.openUntil = time.Time{}
+		if b.policy.PermanentTimeout > 0 {
+			b.openUntil = now.Add(b.policy.PermanentTimeout)
+		}
+	case kind == FailureThrottled:
+		b.open(now, b.policy.ThrottleTimeout)
+	case b.state == BreakerHalfOpen || b.failures >= b.policy.FailureThreshold:
+		b.open(now, b.policy.OpenTimeout)
+	}
+
+	return kind
+}
+
+// LastError returns the most recent failure, if any.
+func (b *Breaker) LastError() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.lastErr
+}
+
+// abort gives up a half-open probe without recording an outcome, e.g. when
+// the stream was cancelled.
+func (b *Breaker) abort() {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+}
+
+// IsDead reports whether the breaker is open for good.
+func (b *Breaker) IsDead() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.state == BreakerOpen && b.openUntil.IsZero()
+}
+
+func (b *Breaker) open(now time.Time, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	b.state = BreakerOpen
+	b.openUntil = now.Add(timeout)
+}
+
+func (b *Breaker) refresh(now time.Time) {
+	if b.state == BreakerOpen && !b.openUntil.IsZero() && !now.Before(b.openUntil) {
+		b.state = BreakerHalfOpen
+		b.probing = false
+	}
+}
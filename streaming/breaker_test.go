@@ -0,0 +1,75 @@
+package streaming
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		err  error
+		kind FailureKind
+	}{
+		{errors.New("bad request: 404 Not Found"), FailurePermanent},
+		{errors.New("bad request: 410 Gone"), FailurePermanent},
+		{errors.New("bad request: 401 Unauthorized: Streaming requires auth"), FailurePermanent},
+		{errors.New("bad request: 429 Too Many Requests"), FailureThrottled},
+		{errors.New("bad request: 502 Bad Gateway"), FailureTransient},
+		{errors.New("bad request: 503 Service Unavailable"), FailureTransient},
+		{errors.New("bad request: 504 Gateway Timeout"), FailureTransient},
+		{&net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}, FailurePermanent},
+		{errors.New("dial tcp: lookup nope.invalid: no such host"), FailurePermanent},
+		{&net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}, FailureTransient},
+		{errors.New("read tcp: i/o timeout"), FailureTransient},
+		{errors.New("unexpected EOF"), FailureTransient},
+	}
+
+	for _, testCase := range testCases {
+		require.Equal(t, testCase.kind, ClassifyError(testCase.err), testCase.err.Error())
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(BreakerPolicy{
+		FailureThreshold: 2,
+		OpenTimeout:      20 * time.Millisecond,
+		ThrottleTimeout:  20 * time.Millisecond,
+	})
+	transient := errors.New("bad request: 503 Service Unavailable")
+
+	require.True(t, b.Allow())
+	b.Failure(transient)
+	require.Equal(t, BreakerClosed, b.State())
+
+	b.Failure(transient)
+	require.Equal(t, BreakerOpen, b.State())
+	require.False(t, b.Allow())
+
+	// Only a single probe gets through once half-open.
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, BreakerHalfOpen, b.State())
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+
+	// A failed probe opens it straight back up.
+	b.Failure(transient)
+	require.Equal(t, BreakerOpen, b.State())
+
+	time.Sleep(30 * time.Millisecond)
+	require.True(t, b.Allow())
+	b.Success()
+	require.Equal(t, BreakerClosed, b.State())
+
+	b.Failure(errors.New("bad request: 429 Too Many Requests"))
+	require.Equal(t, BreakerOpen, b.State())
+	require.False(t, b.IsDead())
+
+	b.Failure(errors.New("bad request: 404 Not Found"))
+	require.True(t, b.IsDead())
+	time.Sleep(30 * time.Millisecond)
+	require.Equal(t, BreakerOpen, b.State())
+}
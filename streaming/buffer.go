@@ -0,0 +1,211 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// OverflowPolicy is what to do with an event when a buffer is full.
+type OverflowPolicy string
+
+const (
+	// OverflowBlock waits for room, which eventually stalls the server's
+	// stream. Nothing is lost on our side but the server may drop us.
+	OverflowBlock OverflowPolicy = "block"
+	// OverflowDropOldest throws away the oldest buffered event to make room.
+	OverflowDropOldest OverflowPolicy = "drop-oldest"
+	// OverflowDropNewest throws away the event that didn't fit.
+	OverflowDropNewest OverflowPolicy = "drop-newest"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(s); policy {
+	case OverflowBlock, OverflowDropOldest, OverflowDropNewest:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q (want block, drop-oldest or drop-newest)", s)
+	}
+}
+
+// BufferPolicy sizes the buffers between the servers and the consumer of a
+// Mux. Every server gets its own buffer of PerServer events, which is where
+// Overflow applies, so one busy server can only ever crowd out itself. All
+// servers then feed a shared buffer of Global events.
+//
+// Once a stream is stopped, whatever is left in its buffer gets Drain to
+// reach the shared one, and is dropped after that.
+//
+// The zero value has no buffers and blocks, so a slow consumer holds up
+// every server.
+type BufferPolicy struct {
+	PerServer int
+	Global    int
+	Overflow  OverflowPolicy
+	Drain     time.Duration
+}
+
+var DefaultBufferPolicy = BufferPolicy{
+	PerServer: 256,
+	Global:    4096,
+	Overflow:  OverflowBlock,
+	Drain:     5 * time.Second,
+}
+
+// outbox is a server's buffer in front of the shared output channel.
+type outbox struct {
+	server  string
+	policy  BufferPolicy
+	tracker *statusTracker
+
+	// queue is nil without a per-server buffer, in which case the policy
+	// applies directly to out.
+	queue chan *Envelope
+	out   chan *Envelope
+
+	// handed, if set, is called with every envelope that reaches out, so
+	// nothing that gets dropped on the way is taken as delivered.
+	handed func(*Envelope)
+}
+
+func newOutbox(server string, policy BufferPolicy, out chan *Envelope, tracker *statusTracker) *outbox {
+	o := &outbox{
+		server:  server,
+		policy:  policy,
+		tracker: tracker,
+		out:     out,
+	}
+	if policy.PerServer > 0 {
+		o.queue = make(chan *Envelope, policy.PerServer)
+	}
+	return o
+}
+
+// run moves buffered events to the shared channel until ctx is done. It
+// always blocks on the shared channel; dropping is done per server. It
+// returns the event it was holding when ctx was done, if any.
+func (o *outbox) run(ctx context.Context) *Envelope {
+	if o.queue == nil {
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case envelope := <-o.queue:
+			select {
+			case o.out <- envelope:
+				o.hand(envelope)
+			case <-ctx.Done():
+				return envelope
+			}
+		}
+	}
+}
+
+// drain hands over held, if any, and what's left in the queue once the
+// stream has stopped pushing. Whatever the consumer doesn't take within the
+// policy's Drain is dropped.
+func (o *outbox) drain(held *Envelope) {
+	if o.queue == nil {
+		return
+	}
+
+	var timeout <-chan time.Time
+	if o.policy.Drain > 0 {
+		timer := time.NewTimer(o.policy.Drain)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	give := func(envelope *Envelope) {
+		if timeout == nil {
+			o.tracker.drop(o.server)
+			return
+		}
+		select {
+		case o.out <- envelope:
+			o.hand(envelope)
+		case <-timeout:
+			timeout = nil
+			o.tracker.drop(o.server)
+		}
+	}
+
+	if held != nil {
+		give(held)
+	}
+	for {
+		select {
+		case envelope := <-o.queue:
+			give(envelope)
+		default:
+			return
+		}
+	}
+}
+
+// push hands an event over according to the overflow policy. It returns
+// false once ctx is done. Envelopes pushed into the per-server queue are
+// only handed on, and reported to handed, once they leave it.
+func (o *outbox) push(ctx context.Context, envelope *Envelope) bool {
+	ch := o.out
+	if o.queue != nil {
+		ch = o.queue
+	}
+	sent := func() {
+		if o.queue == nil {
+			o.hand(envelope)
+		}
+	}
+
+	overflow := o.policy.Overflow
+	if overflow == OverflowDropOldest && cap(ch) == 0 {
+		// There's never anything buffered to drop.
+		overflow = OverflowDropNewest
+	}
+
+	switch overflow {
+	case OverflowDropNewest:
+		select {
+		case ch <- envelope:
+			sent()
+		default:
+			o.tracker.drop(o.server)
+		}
+		return ctx.Err() == nil
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- envelope:
+				sent()
+				return ctx.Err() == nil
+			default:
+			}
+
+			// Make room. Without a per-server queue the oldest event may
+			// belong to someone else.
+			select {
+			case dropped := <-ch:
+				o.tracker.drop(dropped.Server)
+			default:
+			}
+		}
+
+	default:
+		select {
+		case ch <- envelope:
+			sent()
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (o *outbox) hand(envelope *Envelope) {
+	if o.handed != nil {
+		o.handed(envelope)
+	}
+}
@@ -0,0 +1,64 @@
+package streaming
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox_Overflow(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		overflow OverflowPolicy
+		kept     []uint64
+	}{
+		{OverflowDropOldest, []uint64{4, 5}},
+		{OverflowDropNewest, []uint64{1, 2}},
+	}
+
+	for _, testCase := range testCases {
+		tracker := newStatusTracker()
+		tracker.add("a")
+
+		// Nothing is reading so the per-server buffer fills up.
+		out := newOutbox("a", BufferPolicy{PerServer: 2, Overflow: testCase.overflow}, make(chan *Envelope), tracker)
+		for seq := uint64(1); seq <= 5; seq++ {
+			require.True(t, out.push(ctx, &Envelope{Server: "a", Seq: seq}))
+		}
+
+		var kept []uint64
+		for len(out.queue) > 0 {
+			kept = append(kept, (<-out.queue).Seq)
+		}
+		require.Equal(t, testCase.kept, kept, string(testCase.overflow))
+		require.Equal(t, int64(3), tracker.snapshot()[0].Dropped)
+	}
+}
+
+func TestOutbox_HandedOnlyWhenDelivered(t *testing.T) {
+	tracker := newStatusTracker()
+	tracker.add("a")
+
+	ch := make(chan *Envelope)
+	out := newOutbox("a", BufferPolicy{PerServer: 2, Overflow: OverflowDropNewest}, ch, tracker)
+	var handed []uint64
+	out.handed = func(envelope *Envelope) { handed = append(handed, envelope.Seq) }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	for seq := uint64(1); seq <= 3; seq++ {
+		require.True(t, out.push(ctx, &Envelope{Server: "a", Seq: seq}))
+	}
+	require.Empty(t, handed, "queued isn't delivered")
+
+	held := make(chan *Envelope, 1)
+	go func() { held <- out.run(ctx) }()
+	require.Equal(t, uint64(1), (<-ch).Seq)
+
+	// Nobody takes the rest, and without a drain they are dropped.
+	cancel()
+	out.drain(<-held)
+	require.Equal(t, []uint64{1}, handed)
+	require.Equal(t, int64(2), tracker.snapshot()[0].Dropped)
+}
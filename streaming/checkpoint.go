@@ -0,0 +1,202 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// Checkpoints remembers the newest status id seen on each of a server's
+// streams so gaps can be backfilled after a reconnect, or after a restart if
+// they are saved to a file.
+//
+// What a reconnect needs and what a restart needs differ: a status that has
+// been seen is still on its way to the sink, and is only safe from a crash
+// once the sink has made it durable. So Advance moves the checkpoints used
+// while running, and only those moved by Commit are ever saved.
+type Checkpoints struct {
+	// Flush, if set, is called before saving, so that the sink has made
+	// durable every status the saved checkpoints cover.
+	Flush func() error
+
+	path      string
+	ids       map[string]map[string]mastodon.ID
+	committed map[string]map[string]mastodon.ID
+	dirty     bool
+
+	// saving keeps an older save from being renamed over a newer one.
+	saving sync.Mutex
+
+	sync.Mutex
+}
+
+// NewCheckpoints returns checkpoints that are only kept in memory.
+func NewCheckpoints() *Checkpoints {
+	return &Checkpoints{
+		ids:       make(map[string]map[string]mastodon.ID),
+		committed: make(map[string]map[string]mastodon.ID),
+	}
+}
+
+// OpenCheckpoints loads checkpoints from a JSON file, which doesn't have to
+// exist yet. Save writes them back to it.
+func OpenCheckpoints(filePath string) (*Checkpoints, error) {
+	c := NewCheckpoints()
+	c.path = filePath
+
+	b, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &c.committed); err != nil {
+		return nil, err
+	}
+	for serverName, byStream := range c.committed {
+		c.ids[serverName] = make(map[string]mastodon.ID, len(byStream))
+		for stream, id := range byStream {
+			c.ids[serverName][stream] = id
+		}
+	}
+	return c, nil
+}
+
+// Get returns the newest status id seen on a stream.
+func (c *Checkpoints) Get(serverName string, spec StreamSpec) (mastodon.ID, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	id, ok := c.ids[serverName][spec.String()]
+	return id, ok
+}
+
+// Advance records a status id seen on a stream unless a newer one has been
+// seen already.
+func (c *Checkpoints) Advance(serverName string, spec StreamSpec, id mastodon.ID) {
+	c.Lock()
+	defer c.Unlock()
+	advance(c.ids, serverName, spec, id)
+}
+
+// Commit records that an envelope's status has been written to the sink, so
+// it can be saved once the sink is flushed. Anything but an update is
+// ignored.
+func (c *Checkpoints) Commit(envelope *Envelope) {
+	update, ok := envelope.Event.(*mastodon.UpdateEvent)
+	if !ok || update.Status == nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if advance(c.committed, envelope.Server, envelope.Stream, update.Status.ID) {
+		c.dirty = true
+	}
+}
+
+func advance(ids map[string]map[string]mastodon.ID, serverName string, spec StreamSpec, id mastodon.ID) bool {
+	byStream, ok := ids[serverName]
+	if !ok {
+		byStream = make(map[string]mastodon.ID)
+		ids[serverName] = byStream
+	}
+	if current, ok := byStream[spec.String()]; ok && !idLess(current, id) {
+		return false
+	}
+	byStream[spec.String()] = id
+	return true
+}
+
+// Save flushes the sink then writes the committed checkpoints to their file,
+// if any changed since the last save. In-memory checkpoints are never saved.
+func (c *Checkpoints) Save() error {
+	c.saving.Lock()
+	defer c.saving.Unlock()
+
+	c.Lock()
+	if c.path == "" || !c.dirty {
+		c.Unlock()
+		return nil
+	}
+	b, err := json.MarshalIndent(c.committed, "", "  ")
+	c.dirty = false
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Whatever was committed before the flush is covered by it, even if
+	// more is committed while it runs.
+	if err := c.save(b); err != nil {
+		c.Lock()
+		c.dirty = true
+		c.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (c *Checkpoints) save(b []byte) error {
+	if c.Flush != nil {
+		if err := c.Flush(); err != nil {
+			return err
+		}
+	}
+
+	// Write then rename so a crash never leaves half a file.
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// Run saves the checkpoints every interval, and once more when ctx is done.
+// Errors are sent on the returned channel, which is closed after the last
+// save.
+func (c *Checkpoints) Run(ctx context.Context, interval time.Duration) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		report := func(err error) {
+			if err == nil {
+				return
+			}
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				report(c.Save())
+				return
+			case <-ticker.C:
+				report(c.Save())
+			}
+		}
+	}()
+	return errs
+}
+
+// idLess orders status ids. Mastodon's are numbers and other servers' are
+// fixed length, so shorter ids are older and ids of the same length compare
+// as strings.
+func idLess(a, b mastodon.ID) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
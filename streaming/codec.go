@@ -0,0 +1,293 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// WireVersion is the version of the archive format written by Envelope's
+// MarshalJSON. Bump it whenever the format changes incompatibly.
+const WireVersion = 1
+
+// Event types, as named by the Mastodon streaming API.
+const (
+	TypeUpdate         = "update"
+	TypeStatusUpdate   = "status.update"
+	TypeDelete         = "delete"
+	TypeNotification   = "notification"
+	TypeFiltersChanged = "filters_changed"
+	TypeError          = "error"
+)
+
+// go-mastodon's Event interface is sealed, so event kinds it doesn't know
+// about embed one of its types to satisfy it. Nothing should read the
+// embedded value.
+type sealedEvent = mastodon.DeleteEvent
+
+// StatusUpdateEvent is an edited status.
+type StatusUpdateEvent struct {
+	mastodon.UpdateEvent
+}
+
+// FiltersChangedEvent tells clients to refetch their filters. It carries no
+// payload.
+type FiltersChangedEvent struct {
+	sealedEvent
+}
+
+// ErrorMessageEvent is an error event read back from an archive. Unlike
+// mastodon.ErrorEvent it can be built from just the message.
+type ErrorMessageEvent struct {
+	sealedEvent
+	Message string
+}
+
+func (e *ErrorMessageEvent) Error() string {
+	return e.Message
+}
+
+// EventType returns the wire type of an event.
+func EventType(event mastodon.Event) (string, error) {
+	switch event.(type) {
+	case *mastodon.UpdateEvent:
+		return TypeUpdate, nil
+	case *StatusUpdateEvent:
+		return TypeStatusUpdate, nil
+	case *mastodon.DeleteEvent:
+		return TypeDelete, nil
+	case *mastodon.NotificationEvent:
+		return TypeNotification, nil
+	case *FiltersChangedEvent:
+		return TypeFiltersChanged, nil
+	case *mastodon.ErrorEvent, *ErrorMessageEvent:
+		return TypeError, nil
+	default:
+		return "", fmt.Errorf("unknown event type %T", event)
+	}
+}
+
+// wireEnvelope is how an Envelope is laid out in archives. Payload depends
+// on Type: a status for update and status.update, a notification, the
+// deleted status id, {"error": message}, or null for filters_changed.
+type wireEnvelope struct {
+	Version    int             `json:"v"`
+	Type       string          `json:"type"`
+	Server     string          `json:"server"`
+	ReceivedAt time.Time       `json:"received_at"`
+	Stream     StreamSpec      `json:"stream"`
+	Conn       uint64          `json:"conn"`
+	Seq        uint64          `json:"seq"`
+	Payload    json.RawMessage `json:"payload"`
+	SeenBy     []string        `json:"seen_by,omitempty"`
+	Transport  string          `json:"transport,omitempty"`
+	Backfilled bool            `json:"backfilled,omitempty"`
+
+	Accounts map[string]AccountPrivacy `json:"accounts,omitempty"`
+}
+
+type wireError struct {
+	Error string `json:"error"`
+}
+
+func (e *Envelope) MarshalJSON() ([]byte, error) {
+	eventType, err := EventType(e.Event)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload interface{}
+	switch event := e.Event.(type) {
+	case *mastodon.UpdateEvent:
+		payload = event.Status
+	case *StatusUpdateEvent:
+		payload = event.Status
+	case *mastodon.DeleteEvent:
+		payload = event.ID
+	case *mastodon.NotificationEvent:
+		payload = event.Notification
+	case *FiltersChangedEvent:
+		payload = nil
+	case error:
+		payload = wireError{Error: event.Error()}
+	}
+
+	rawPayload, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(wireEnvelope{
+		Version:    WireVersion,
+		Type:       eventType,
+		Server:     e.Server,
+		ReceivedAt: e.ReceivedAt,
+		Stream:     e.Stream,
+		Conn:       e.Conn,
+		Seq:        e.Seq,
+		Payload:    rawPayload,
+		SeenBy:     e.SeenBy,
+		Transport:  e.Transport,
+		Backfilled: e.Backfilled,
+		Accounts:   e.Accounts,
+	})
+}
+
+func (e *Envelope) UnmarshalJSON(data []byte) error {
+	var wire wireEnvelope
+	if err := json.Unmarshal(data, &wire); err != nil {
+		return err
+	}
+
+	if wire.Version == 0 && wire.Type == "" {
+		return e.unmarshalLegacy(data)
+	}
+	if wire.Version > WireVersion {
+		return fmt.Errorf("unsupported wire version %d", wire.Version)
+	}
+
+	event, err := decodePayload(wire.Type, wire.Payload)
+	if err != nil {
+		return err
+	}
+
+	*e = Envelope{
+		Server:     wire.Server,
+		ReceivedAt: wire.ReceivedAt,
+		Stream:     wire.Stream,
+		Conn:       wire.Conn,
+		Seq:        wire.Seq,
+		Event:      event,
+		SeenBy:     wire.SeenBy,
+		Transport:  wire.Transport,
+		Backfilled: wire.Backfilled,
+		Accounts:   wire.Accounts,
+	}
+	return nil
+}
+
+func decodePayload(eventType string, payload json.RawMessage) (mastodon.Event, error) {
+	switch eventType {
+	case TypeUpdate, TypeStatusUpdate:
+		var status mastodon.Status
+		if err := json.Unmarshal(payload, &status); err != nil {
+			return nil, fmt.Errorf("bad %s payload: %w", eventType, err)
+		}
+		if eventType == TypeStatusUpdate {
+			return &StatusUpdateEvent{mastodon.UpdateEvent{Status: &status}}, nil
+		}
+		return &mastodon.UpdateEvent{Status: &status}, nil
+	case TypeDelete:
+		var id mastodon.ID
+		if err := json.Unmarshal(payload, &id); err != nil {
+			return nil, fmt.Errorf("bad delete payload: %w", err)
+		}
+		return &mastodon.DeleteEvent{ID: id}, nil
+	case TypeNotification:
+		var notification mastodon.Notification
+		if err := json.Unmarshal(payload, &notification); err != nil {
+			return nil, fmt.Errorf("bad notification payload: %w", err)
+		}
+		return &mastodon.NotificationEvent{Notification: &notification}, nil
+	case TypeFiltersChanged:
+		return &FiltersChangedEvent{}, nil
+	case TypeError:
+		var wireErr wireError
+		if err := json.Unmarshal(payload, &wireErr); err != nil {
+			return nil, fmt.Errorf("bad error payload: %w", err)
+		}
+		return &ErrorMessageEvent{Message: wireErr.Error}, nil
+	default:
+		return nil, fmt.Errorf("unknown event type %q", eventType)
+	}
+}
+
+// unmarshalLegacy reads the bare events that stream-distributed wrote before
+// it had envelopes. They don't say where they came from.
+func (e *Envelope) unmarshalLegacy(data []byte) error {
+	var legacy struct {
+		Status       *mastodon.Status       `json:"status"`
+		Notification *mastodon.Notification `json:"notification"`
+		ID           *mastodon.ID           `json:"ID"`
+	}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+
+	*e = Envelope{}
+	switch {
+	case legacy.Status != nil:
+		e.Event = &mastodon.UpdateEvent{Status: legacy.Status}
+	case legacy.Notification != nil:
+		e.Event = &mastodon.NotificationEvent{Notification: legacy.Notification}
+	case legacy.ID != nil:
+		e.Event = &mastodon.DeleteEvent{ID: *legacy.ID}
+	default:
+		return errors.New("unrecognized legacy event")
+	}
+	return nil
+}
+
+// Encoder writes envelopes as newline-delimited JSON.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+func (enc *Encoder) Encode(envelope *Envelope) error {
+	b, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = enc.w.Write(b)
+	return err
+}
+
+// maxLineSize bounds a single archived event. Statuses are small but the
+// accounts and cards hanging off them can add up.
+const maxLineSize = 16 * 1024 * 1024
+
+// Decoder reads envelopes written by an Encoder, one per line. Blank lines
+// and the "{}" lines older archives are full of are skipped.
+type Decoder struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	return &Decoder{scanner: scanner}
+}
+
+// Decode returns the next envelope, or io.EOF once there are none left.
+func (dec *Decoder) Decode() (*Envelope, error) {
+	for dec.scanner.Scan() {
+		dec.line++
+		line := bytes.TrimSpace(dec.scanner.Bytes())
+		if len(line) == 0 || bytes.Equal(line, []byte("{}")) {
+			continue
+		}
+
+		var envelope Envelope
+		if err := json.Unmarshal(line, &envelope); err != nil {
+			return nil, fmt.Errorf("line %d: %w", dec.line, err)
+		}
+		return &envelope, nil
+	}
+
+	if err := dec.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
@@ -0,0 +1,89 @@
+package streaming
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvelope_RoundTrip(t *testing.T) {
+	receivedAt := time.Date(2022, 11, 20, 12, 30, 0, 0, time.UTC)
+	status := &mastodon.Status{
+		ID:        "109",
+		URI:       "https://example.com/users/a/statuses/109",
+		Content:   "<p>hello</p>",
+		CreatedAt: time.Date(2022, 11, 20, 12, 29, 58, 0, time.UTC),
+		Account:   mastodon.Account{ID: "1", Acct: "a@example.com"},
+		Tags:      []mastodon.Tag{{Name: "fediverse"}},
+	}
+
+	events := []mastodon.Event{
+		&mastodon.UpdateEvent{Status: status},
+		&StatusUpdateEvent{mastodon.UpdateEvent{Status: status}},
+		&mastodon.DeleteEvent{ID: "109"},
+		&mastodon.NotificationEvent{Notification: &mastodon.Notification{ID: "7", Type: "mention", Status: status}},
+		&FiltersChangedEvent{},
+		&ErrorMessageEvent{Message: "bad request: 502 Bad Gateway"},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for i, event := range events {
+		require.NoError(t, enc.Encode(&Envelope{
+			Server:     "https://example.com",
+			ReceivedAt: receivedAt,
+			Stream:     PublicStream(false),
+			Conn:       2,
+			Seq:        uint64(i + 1),
+			Event:      event,
+		}))
+	}
+
+	dec := NewDecoder(&buf)
+	for i, event := range events {
+		envelope, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, "https://example.com", envelope.Server)
+		require.Equal(t, receivedAt, envelope.ReceivedAt)
+		require.Equal(t, PublicStream(false), envelope.Stream)
+		require.Equal(t, uint64(2), envelope.Conn)
+		require.Equal(t, uint64(i+1), envelope.Seq)
+		require.Equal(t, event, envelope.Event)
+	}
+
+	_, err := dec.Decode()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDecoder_Legacy(t *testing.T) {
+	archive := strings.Join([]string{
+		`{"status":{"id":"1","uri":"https://example.com/1"}}`,
+		`{}`,
+		`{"ID":"2"}`,
+		``,
+	}, "\n")
+
+	dec := NewDecoder(strings.NewReader(archive))
+
+	envelope, err := dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, mastodon.ID("1"), envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+
+	envelope, err = dec.Decode()
+	require.NoError(t, err)
+	require.Equal(t, mastodon.ID("2"), envelope.Event.(*mastodon.DeleteEvent).ID)
+
+	_, err = dec.Decode()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestDecoder_RejectsNewerVersions(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(`{"v":99,"type":"update","payload":{}}`))
+	_, err := dec.Decode()
+	require.ErrorContains(t, err, "unsupported wire version")
+}
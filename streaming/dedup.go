@@ -0,0 +1,198 @@
+package streaming
+
+import (
+	"container/list"
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// Deduplicator collapses the copies of a status that arrive from every
+// server federating it into a single envelope, keyed on the status URI.
+// Only update events are deduplicated; everything else passes straight
+// through.
+type Deduplicator struct {
+	// Hold is how long the first copy of a status is held back so the
+	// servers that also deliver it can be recorded in its SeenBy. With no
+	// hold statuses are emitted at once and later copies are only dropped.
+	Hold time.Duration
+
+	// Window is how long a status is remembered after it was first seen.
+	// Copies arriving after that are treated as new.
+	Window time.Duration
+
+	// MaxEntries bounds memory. Past it the oldest statuses are emitted (if
+	// still held) and forgotten early.
+	MaxEntries int
+
+	unique     int64
+	duplicates int64
+}
+
+// DedupStats counts what a Deduplicator has seen so far.
+type DedupStats struct {
+	Unique     int64 `json:"unique"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+func (d *Deduplicator) Stats() DedupStats {
+	return DedupStats{
+		Unique:     atomic.LoadInt64(&d.unique),
+		Duplicates: atomic.LoadInt64(&d.duplicates),
+	}
+}
+
+type dedupEntry struct {
+	uri       string
+	envelope  *Envelope
+	seenBy    []string
+	firstSeen time.Time
+	emitted   bool
+}
+
+// Run deduplicates envelopes from in until it is closed or ctx is done. When
+// in is closed any held statuses are flushed before the output closes.
+func (d *Deduplicator) Run(ctx context.Context, in <-chan *Envelope) <-chan *Envelope {
+	out := make(chan *Envelope)
+
+	window := d.Window
+	if window < d.Hold {
+		window = d.Hold
+	}
+
+	tick := d.Hold / 4
+	if tick <= 0 || tick > time.Second {
+		tick = time.Second
+	}
+
+	go func() {
+		defer close(out)
+
+		entries := make(map[string]*list.Element)
+		order := list.New()
+
+		send := func(envelope *Envelope) bool {
+			select {
+			case out <- envelope:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		emit := func(entry *dedupEntry) bool {
+			if entry.emitted {
+				return true
+			}
+			entry.emitted = true
+			entry.envelope.SeenBy = append([]string(nil), entry.seenBy...)
+			return send(entry.envelope)
+		}
+
+		// expire emits anything held for long enough and forgets anything
+		// older than the window, or everything if flush is set. Entries are
+		// in the order they were first seen so it can stop at the first one
+		// that is still being held.
+		expire := func(now time.Time, flush bool) bool {
+			for elem := order.Front(); elem != nil; {
+				entry := elem.Value.(*dedupEntry)
+				age := now.Sub(entry.firstSeen)
+				if !flush && age < d.Hold {
+					break
+				}
+				if !emit(entry) {
+					return false
+				}
+
+				next := elem.Next()
+				if flush || age >= window {
+					order.Remove(elem)
+					delete(entries, entry.uri)
+				}
+				elem = next
+			}
+			return true
+		}
+
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case now := <-ticker.C:
+				if !expire(now, false) {
+					return
+				}
+
+			case envelope, ok := <-in:
+				if !ok {
+					expire(time.Now(), true)
+					return
+				}
+
+				uri := dedupKey(envelope)
+				if uri == "" {
+					if !send(envelope) {
+						return
+					}
+					continue
+				}
+
+				if elem, ok := entries[uri]; ok {
+					atomic.AddInt64(&d.duplicates, 1)
+					entry := elem.Value.(*dedupEntry)
+					if !containsString(entry.seenBy, envelope.Server) {
+						entry.seenBy = append(entry.seenBy, envelope.Server)
+					}
+					continue
+				}
+
+				atomic.AddInt64(&d.unique, 1)
+				entry := &dedupEntry{
+					uri:       uri,
+					envelope:  envelope,
+					seenBy:    []string{envelope.Server},
+					firstSeen: time.Now(),
+				}
+				entries[uri] = order.PushBack(entry)
+
+				if d.Hold <= 0 && !emit(entry) {
+					return
+				}
+
+				for d.MaxEntries > 0 && order.Len() > d.MaxEntries {
+					oldest := order.Front()
+					if !emit(oldest.Value.(*dedupEntry)) {
+						return
+					}
+					order.Remove(oldest)
+					delete(entries, oldest.Value.(*dedupEntry).uri)
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+func dedupKey(envelope *Envelope) string {
+	update, ok := envelope.Event.(*mastodon.UpdateEvent)
+	if !ok || update.Status == nil {
+		return ""
+	}
+	return update.Status.URI
+}
+
+func containsString(haystack []string, needle string) bool {
+	for _, s := range haystack {
+		if s == needle {
+			return true
+		}
+	}
+	return false
+}
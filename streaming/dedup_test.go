@@ -0,0 +1,74 @@
+package streaming
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func updateFrom(server, uri string) *Envelope {
+	return &Envelope{
+		Server: server,
+		Event:  &mastodon.UpdateEvent{Status: &mastodon.Status{URI: uri}},
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Deduplicator{Hold: time.Hour, Window: time.Hour}
+	in := make(chan *Envelope)
+	out := d.Run(ctx, in)
+
+	go func() {
+		defer close(in)
+		in <- updateFrom("https://a.example", "https://origin.example/1")
+		in <- updateFrom("https://b.example", "https://origin.example/1")
+		in <- &Envelope{Server: "https://a.example", Event: &mastodon.DeleteEvent{ID: "5"}}
+		in <- updateFrom("https://c.example", "https://origin.example/2")
+		in <- updateFrom("https://c.example", "https://origin.example/1")
+		in <- updateFrom("https://b.example", "https://origin.example/1")
+	}()
+
+	var envelopes []*Envelope
+	for envelope := range out {
+		envelopes = append(envelopes, envelope)
+	}
+
+	// The delete isn't held back, the statuses are flushed when in closes.
+	require.Len(t, envelopes, 3)
+	require.IsType(t, &mastodon.DeleteEvent{}, envelopes[0].Event)
+	require.Equal(t, "https://a.example", envelopes[1].Server)
+	require.Equal(t, []string{"https://a.example", "https://b.example", "https://c.example"}, envelopes[1].SeenBy)
+	require.Equal(t, []string{"https://c.example"}, envelopes[2].SeenBy)
+
+	require.Equal(t, DedupStats{Unique: 2, Duplicates: 3}, d.Stats())
+}
+
+func TestDeduplicator_MaxEntries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	d := &Deduplicator{Window: time.Hour, MaxEntries: 1}
+	in := make(chan *Envelope, 3)
+	in <- updateFrom("https://a.example", "https://origin.example/1")
+	in <- updateFrom("https://a.example", "https://origin.example/2")
+	in <- updateFrom("https://b.example", "https://origin.example/1")
+	close(in)
+
+	var uris []string
+	for envelope := range d.Run(ctx, in) {
+		uris = append(uris, envelope.Event.(*mastodon.UpdateEvent).Status.URI)
+	}
+
+	// The first status was forgotten to make room, so its second copy is new.
+	require.Equal(t, []string{
+		"https://origin.example/1",
+		"https://origin.example/2",
+		"https://origin.example/1",
+	}, uris)
+}
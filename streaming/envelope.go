@@ -0,0 +1,152 @@
+package streaming
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// StreamKind is the timeline a stream follows.
+type StreamKind string
+
+const (
+	StreamLocal        StreamKind = "local"
+	StreamFederated    StreamKind = "federated"
+	StreamHashtag      StreamKind = "hashtag"
+	StreamHashtagLocal StreamKind = "hashtag-local"
+	StreamList         StreamKind = "list"
+	StreamUser         StreamKind = "user"
+)
+
+// StreamSpec names one stream on a server. Tag is only used by the hashtag
+// kinds and List only by StreamList.
+//
+// It is written as text in the form kind[:tag-or-list], e.g. "local",
+// "hashtag:fediverse" or "list:42".
+type StreamSpec struct {
+	Kind StreamKind
+	Tag  string
+	List string
+}
+
+// PublicStream is the local or federated public timeline.
+func PublicStream(isLocal bool) StreamSpec {
+	if isLocal {
+		return StreamSpec{Kind: StreamLocal}
+	}
+	return StreamSpec{Kind: StreamFederated}
+}
+
+// HashtagStream is the local or federated timeline of a hashtag.
+func HashtagStream(tag string, isLocal bool) StreamSpec {
+	tag = strings.TrimPrefix(tag, "#")
+	if isLocal {
+		return StreamSpec{Kind: StreamHashtagLocal, Tag: tag}
+	}
+	return StreamSpec{Kind: StreamHashtag, Tag: tag}
+}
+
+// ParseStreamSpec parses the text form of a StreamSpec.
+func ParseStreamSpec(s string) (StreamSpec, error) {
+	kind, arg, _ := strings.Cut(s, ":")
+	spec := StreamSpec{Kind: StreamKind(kind)}
+
+	switch spec.Kind {
+	case StreamLocal, StreamFederated, StreamUser:
+		if arg != "" {
+			return StreamSpec{}, fmt.Errorf("stream %q takes no argument", kind)
+		}
+	case StreamHashtag, StreamHashtagLocal:
+		spec.Tag = strings.TrimPrefix(arg, "#")
+		if spec.Tag == "" {
+			return StreamSpec{}, fmt.Errorf("stream %q needs a tag, e.g. %s:fediverse", kind, kind)
+		}
+	case StreamList:
+		spec.List = arg
+		if spec.List == "" {
+			return StreamSpec{}, fmt.Errorf("stream %q needs a list id, e.g. list:42", kind)
+		}
+	default:
+		return StreamSpec{}, fmt.Errorf("unknown stream kind %q", kind)
+	}
+
+	return spec, nil
+}
+
+func (s StreamSpec) String() string {
+	switch {
+	case s.Tag != "":
+		return string(s.Kind) + ":" + s.Tag
+	case s.List != "":
+		return string(s.Kind) + ":" + s.List
+	default:
+		return string(s.Kind)
+	}
+}
+
+func (s StreamSpec) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *StreamSpec) UnmarshalText(text []byte) error {
+	spec, err := ParseStreamSpec(string(text))
+	if err != nil {
+		return err
+	}
+	*s = spec
+	return nil
+}
+
+// needsToken reports whether the stream is only available to a logged in
+// user.
+func (s StreamSpec) needsToken() bool {
+	return s.Kind == StreamList || s.Kind == StreamUser
+}
+
+// Envelope wraps an event with where and when it came from, since once
+// streams are merged the event itself can't tell you.
+type Envelope struct {
+	Server     string     `json:"server"`
+	ReceivedAt time.Time  `json:"received_at"`
+	Stream     StreamSpec `json:"stream"`
+
+	// Conn counts the connections made to Server for this stream, starting
+	// at 1 and going up on every reconnect. Seq counts the events received
+	// on the current connection, also starting at 1.
+	Conn uint64 `json:"conn"`
+	Seq  uint64 `json:"seq"`
+
+	Event mastodon.Event `json:"event"`
+
+	// Transport names how the event was fetched when it wasn't streamed,
+	// e.g. "polling".
+	Transport string `json:"transport,omitempty"`
+
+	// Backfilled is set on statuses fetched from the timeline API to fill
+	// the gap before a reconnect. Their Seq is always 0.
+	Backfilled bool `json:"backfilled,omitempty"`
+
+	// SeenBy lists every server that delivered this status when the
+	// envelope has been through a Deduplicator.
+	SeenBy []string `json:"seen_by,omitempty"`
+
+	// Accounts holds what the accounts behind a status say about being
+	// indexed, by account URL. Everything but StreamingTransport, which
+	// goes through go-mastodon, decodes it.
+	Accounts map[string]AccountPrivacy `json:"accounts,omitempty"`
+}
+
+// Status returns the status an update or an edit carries, or nil for any
+// other event.
+func (e *Envelope) Status() *mastodon.Status {
+	return statusOf(e.Event)
+}
+
+// AccountPrivacy is the part of an account go-mastodon doesn't decode, or
+// decodes without telling null from false. Nil means the server didn't say.
+type AccountPrivacy struct {
+	Discoverable *bool `json:"discoverable,omitempty"`
+	Noindex      *bool `json:"noindex,omitempty"`
+}
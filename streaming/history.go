@@ -0,0 +1,275 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/mattn/go-mastodon"
+)
+
+// HistoryCursor is how far back a server's timeline has been paged.
+type HistoryCursor struct {
+	// MaxID is the oldest status fetched so far, which the next page
+	// starts below.
+	MaxID mastodon.ID `json:"max_id,omitempty"`
+
+	// Oldest is when that status was created.
+	Oldest time.Time `json:"oldest,omitempty"`
+
+	// Done is set once the timeline has been paged back to the cutoff or
+	// ran out.
+	Done bool `json:"done"`
+}
+
+// HistoryProgress keeps a cursor per server in a JSON file so an interrupted
+// backfill can pick up where it left off.
+type HistoryProgress struct {
+	path    string
+	cursors map[string]HistoryCursor
+
+	sync.Mutex
+}
+
+// OpenHistoryProgress loads progress from a file, which doesn't have to
+// exist yet. An empty path keeps progress in memory only.
+func OpenHistoryProgress(filePath string) (*HistoryProgress, error) {
+	p := &HistoryProgress{
+		path:    filePath,
+		cursors: make(map[string]HistoryCursor),
+	}
+	if filePath == "" {
+		return p, nil
+	}
+
+	b, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &p.cursors); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *HistoryProgress) Get(serverName string) HistoryCursor {
+	p.Lock()
+	defer p.Unlock()
+	return p.cursors[serverName]
+}
+
+// Set records a server's cursor and saves the file.
+func (p *HistoryProgress) Set(serverName string, cursor HistoryCursor) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.cursors[serverName] = cursor
+	if p.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(p.cursors, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves half a file.
+	tmpPath := p.path + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, p.path)
+}
+
+// History pages backwards through a timeline on every server with max_id,
+// down to statuses created at Until. Statuses come out newest first for each
+// server, marked as backfilled.
+type History struct {
+	Spec  StreamSpec
+	Until time.Time
+
+	// PageSize is the number of statuses asked for per request. Mastodon
+	// allows at most 40.
+	PageSize int64
+
+	// Interval is the least time between two requests to the same server.
+	// Mastodon allows 300 requests every 5 minutes, and requests are held
+	// back anyway when a server says its limit is nearly used up.
+	Interval time.Duration
+
+	// Concurrency is how many servers are paged at once.
+	Concurrency int
+
+	// Flush, if set, is called before progress is saved, so that the
+	// cursor never gets ahead of what emit has made durable.
+	Flush func() error
+
+	// Check, if set, is called before a server is paged through. An error
+	// skips the server and ends up in its result.
+	Check func(ctx context.Context, serverName string) error
+}
+
+// HistoryResult is what happened to one server's backfill.
+type HistoryResult struct {
+	Server   string        `json:"server"`
+	Statuses int           `json:"statuses"`
+	Cursor   HistoryCursor `json:"cursor"`
+	Err      error         `json:"-"`
+}
+
+// NewHistory returns a History of the local public timeline with polite
+// defaults.
+func NewHistory(until time.Time) *History {
+	return &History{
+		Spec:        PublicStream(true),
+		Until:       until,
+		PageSize:    40,
+		Interval:    time.Second,
+		Concurrency: 8,
+	}
+}
+
+// Run backfills every server in the store, resuming from progress, and
+// hands statuses to emit, which is never called concurrently. An error from
+// emit stops that server. A result for every server is sent on the returned
+// channel, which is closed once they have all finished or ctx is done.
+func (h *History) Run(ctx context.Context, store accounts.Store, progress *HistoryProgress, emit func(*Envelope) error) (<-chan HistoryResult, error) {
+	apps, err := store.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	tokens, _ := store.(accounts.TokenStore)
+
+	results := make(chan HistoryResult)
+	var emitMu sync.Mutex
+	serialEmit := func(envelope *Envelope) error {
+		emitMu.Lock()
+		defer emitMu.Unlock()
+		return emit(envelope)
+	}
+
+	concurrency := h.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+
+	var wg sync.WaitGroup
+	for serverName, app := range apps {
+		client := newClient(serverName, app)
+		if tokens != nil {
+			client.Config.AccessToken, _ = tokens.GetAccessToken(serverName)
+		}
+
+		wg.Add(1)
+		go func(serverName string, client *mastodon.Client) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			result := h.server(ctx, serverName, client, progress, serialEmit)
+			select {
+			case results <- result:
+			case <-ctx.Done():
+			}
+		}(serverName, client)
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results, nil
+}
+
+// server pages through one server's timeline.
+func (h *History) server(ctx context.Context, serverName string, client *mastodon.Client, progress *HistoryProgress, emit func(*Envelope) error) HistoryResult {
+	result := HistoryResult{Server: serverName, Cursor: progress.Get(serverName)}
+	if h.Check != nil && !result.Cursor.Done {
+		if result.Err = h.Check(ctx, serverName); result.Err != nil {
+			return result
+		}
+	}
+
+	var lastRequest time.Time
+	for !result.Cursor.Done {
+		if wait := h.Interval - time.Since(lastRequest); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				result.Err = ctx.Err()
+				return result
+			case <-timer.C:
+			}
+		}
+		lastRequest = time.Now()
+
+		statuses, err := fetchTimeline(ctx, client, h.Spec, mastodon.Pagination{MaxID: result.Cursor.MaxID, Limit: h.PageSize})
+		if err != nil {
+			result.Err = err
+			return result
+		}
+
+		cursor := result.Cursor
+		if len(statuses) == 0 {
+			cursor.Done = true
+		}
+		for _, status := range statuses {
+			if status.CreatedAt.Before(h.Until) {
+				cursor.Done = true
+				break
+			}
+
+			envelope := &Envelope{
+				Server:     serverName,
+				ReceivedAt: time.Now(),
+				Stream:     h.Spec,
+				Event:      &mastodon.UpdateEvent{Status: status.Status},
+				Accounts:   status.accounts,
+				Backfilled: true,
+			}
+			if err := emit(envelope); err != nil {
+				result.Cursor = cursor
+				result.Err = err
+				if h.flush() == nil {
+					_ = progress.Set(serverName, cursor)
+				}
+				return result
+			}
+			result.Statuses++
+			cursor.MaxID = status.ID
+			cursor.Oldest = status.CreatedAt
+		}
+
+		result.Cursor = cursor
+		if err := h.flush(); err != nil {
+			result.Err = err
+			return result
+		}
+		if err := progress.Set(serverName, cursor); err != nil {
+			result.Err = err
+			return result
+		}
+	}
+	return result
+}
+
+func (h *History) flush() error {
+	if h.Flush == nil {
+		return nil
+	}
+	return h.Flush()
+}
@@ -0,0 +1,130 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory_Run(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		require.Equal(t, "/api/v1/timelines/public", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Query().Get("max_id") {
+		case "":
+			_, _ = fmt.Fprint(w, `[{"id":"5","created_at":"2022-11-20T05:00:00Z"},{"id":"4","created_at":"2022-11-20T04:00:00Z"}]`)
+		case "4":
+			_, _ = fmt.Fprint(w, `[{"id":"3","created_at":"2022-11-20T03:00:00Z"},{"id":"2","created_at":"2022-11-19T23:00:00Z"}]`)
+		default:
+			t.Errorf("paged past the cutoff: %s", r.URL)
+		}
+	}))
+	defer server.Close()
+
+	store := newMemoryStore()
+	store.add(server.URL, &mastodon.Application{ClientID: "client-id"})
+
+	progressPath := filepath.Join(t.TempDir(), "progress.json")
+	progress, err := OpenHistoryProgress(progressPath)
+	require.NoError(t, err)
+
+	history := NewHistory(time.Date(2022, 11, 20, 0, 0, 0, 0, time.UTC))
+	history.Interval = time.Millisecond
+	flushes := 0
+	history.Flush = func() error {
+		flushes++
+		return nil
+	}
+
+	var ids []mastodon.ID
+	emit := func(envelope *Envelope) error {
+		require.True(t, envelope.Backfilled)
+		ids = append(ids, envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+		return nil
+	}
+
+	results, err := history.Run(context.Background(), store, progress, emit)
+	require.NoError(t, err)
+	for result := range results {
+		require.NoError(t, result.Err)
+		require.Equal(t, 3, result.Statuses)
+		require.True(t, result.Cursor.Done)
+		require.Equal(t, mastodon.ID("3"), result.Cursor.MaxID)
+	}
+	require.Equal(t, []mastodon.ID{"5", "4", "3"}, ids)
+	require.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	require.Equal(t, 2, flushes, "once for every page saved")
+
+	// Finished servers aren't fetched again.
+	progress, err = OpenHistoryProgress(progressPath)
+	require.NoError(t, err)
+	results, err = history.Run(context.Background(), store, progress, emit)
+	require.NoError(t, err)
+	for result := range results {
+		require.Equal(t, 0, result.Statuses)
+	}
+	require.Equal(t, int64(2), atomic.LoadInt64(&requests))
+}
+
+func TestHistory_Check(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		_, _ = fmt.Fprint(w, `[]`)
+	}))
+	defer server.Close()
+
+	store := newMemoryStore()
+	store.add(server.URL, &mastodon.Application{ClientID: "client-id"})
+	progress, err := OpenHistoryProgress(filepath.Join(t.TempDir(), "progress.json"))
+	require.NoError(t, err)
+
+	history := NewHistory(time.Date(2022, 11, 20, 0, 0, 0, 0, time.UTC))
+	history.Check = func(ctx context.Context, serverName string) error {
+		require.Equal(t, server.URL, serverName)
+		return errors.New("not allowed")
+	}
+	results, err := history.Run(context.Background(), store, progress, func(*Envelope) error { return nil })
+	require.NoError(t, err)
+	for result := range results {
+		require.EqualError(t, result.Err, "not allowed")
+	}
+	require.Equal(t, int64(0), atomic.LoadInt64(&requests))
+}
+
+func TestHistory_FlushFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `[{"id":"5","created_at":"2022-11-20T05:00:00Z"}]`)
+	}))
+	defer server.Close()
+
+	store := newMemoryStore()
+	store.add(server.URL, &mastodon.Application{ClientID: "client-id"})
+	progressPath := filepath.Join(t.TempDir(), "progress.json")
+	progress, err := OpenHistoryProgress(progressPath)
+	require.NoError(t, err)
+
+	history := NewHistory(time.Date(2022, 11, 20, 0, 0, 0, 0, time.UTC))
+	history.Flush = func() error { return errors.New("disk full") }
+	results, err := history.Run(context.Background(), store, progress, func(*Envelope) error { return nil })
+	require.NoError(t, err)
+	for result := range results {
+		require.EqualError(t, result.Err, "disk full")
+	}
+
+	// What never made it to disk is fetched again next time.
+	progress, err = OpenHistoryProgress(progressPath)
+	require.NoError(t, err)
+	require.Equal(t, HistoryCursor{}, progress.Get(server.URL))
+}
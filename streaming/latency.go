@@ -0,0 +1,273 @@
+package streaming
+
+import (
+	"container/list"
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/mattn/go-mastodon"
+)
+
+// LatencyTracker measures how long statuses take to federate by watching
+// the same status URI arrive from different servers. Latency is the time
+// between a status' created_at, by the origin's clock, and the first time a
+// receiving server delivered it to us.
+type LatencyTracker struct {
+	// Window is how long a status is tracked after it was first seen.
+	Window time.Duration
+
+	// MaxStatuses bounds how many statuses are tracked at once. Past it the
+	// oldest are forgotten early.
+	MaxStatuses int
+
+	// SamplesPerPair bounds the latencies kept for each origin/receiver
+	// pair. Past it a uniform sample is kept so the percentiles stay honest.
+	SamplesPerPair int
+
+	statuses map[string]*list.Element
+	order    *list.List
+	pairs    map[latencyPair]*latencySamples
+
+	sync.Mutex
+}
+
+// Delivery is when a server delivered a status to us. Last only differs
+// from First if the server sent it more than once, e.g. after a reconnect.
+type Delivery struct {
+	First time.Time `json:"first"`
+	Last  time.Time `json:"last"`
+}
+
+// Propagation is everything known about how one status spread.
+type Propagation struct {
+	URI        string               `json:"uri"`
+	Origin     string               `json:"origin"`
+	CreatedAt  time.Time            `json:"created_at"`
+	Deliveries map[string]*Delivery `json:"deliveries"`
+
+	firstSeen time.Time
+}
+
+// PairLatency summarizes the federation latency from one origin instance to
+// one receiving instance.
+type PairLatency struct {
+	Origin   string        `json:"origin"`
+	Receiver string        `json:"receiver"`
+	Count    int64         `json:"count"`
+	Min      time.Duration `json:"min"`
+	Mean     time.Duration `json:"mean"`
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P99      time.Duration `json:"p99"`
+	Max      time.Duration `json:"max"`
+}
+
+type latencyPair struct {
+	origin, receiver string
+}
+
+type latencySamples struct {
+	count    int64
+	sum      time.Duration
+	min, max time.Duration
+	samples  []time.Duration
+}
+
+func (s *latencySamples) add(latency time.Duration, limit int) {
+	if s.count == 0 || latency < s.min {
+		s.min = latency
+	}
+	if s.count == 0 || latency > s.max {
+		s.max = latency
+	}
+	s.count++
+	s.sum += latency
+
+	// Reservoir sampling.
+	if limit <= 0 || len(s.samples) < limit {
+		s.samples = append(s.samples, latency)
+	} else if i := rand.Int63n(s.count); i < int64(limit) {
+		s.samples[i] = latency
+	}
+}
+
+// NewLatencyTracker returns a tracker with sensible bounds for a few hours
+// of federated timelines.
+func NewLatencyTracker() *LatencyTracker {
+	return &LatencyTracker{
+		Window:         time.Hour,
+		MaxStatuses:    1000000,
+		SamplesPerPair: 1024,
+	}
+}
+
+// Observe records an envelope. Anything that isn't a status is ignored, as
+// are backfilled statuses since we didn't get them when the server did.
+func (t *LatencyTracker) Observe(envelope *Envelope) {
+	update, ok := envelope.Event.(*mastodon.UpdateEvent)
+	if !ok || update.Status == nil || update.Status.URI == "" || envelope.Backfilled {
+		return
+	}
+	status := update.Status
+
+	receiver := accounts.HostOf(envelope.Server)
+	at := envelope.ReceivedAt
+	if at.IsZero() {
+		at = time.Now()
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if t.statuses == nil {
+		t.statuses = make(map[string]*list.Element)
+		t.order = list.New()
+		t.pairs = make(map[latencyPair]*latencySamples)
+	}
+	t.expire(at)
+
+	var propagation *Propagation
+	if elem, ok := t.statuses[status.URI]; ok {
+		propagation = elem.Value.(*Propagation)
+	} else {
+		propagation = &Propagation{
+			URI:        status.URI,
+			Origin:     accounts.HostOf(status.URI),
+			CreatedAt:  status.CreatedAt,
+			Deliveries: make(map[string]*Delivery),
+			firstSeen:  at,
+		}
+		t.statuses[status.URI] = t.order.PushBack(propagation)
+
+		for t.MaxStatuses > 0 && t.order.Len() > t.MaxStatuses {
+			t.forget(t.order.Front())
+		}
+	}
+
+	if delivery, ok := propagation.Deliveries[receiver]; ok {
+		delivery.Last = at
+		return
+	}
+	propagation.Deliveries[receiver] = &Delivery{First: at, Last: at}
+
+	pair := latencyPair{origin: propagation.Origin, receiver: receiver}
+	samples, ok := t.pairs[pair]
+	if !ok {
+		samples = &latencySamples{}
+		t.pairs[pair] = samples
+	}
+	samples.add(at.Sub(propagation.CreatedAt), t.SamplesPerPair)
+}
+
+// Run observes every envelope from in and passes it along untouched.
+func (t *LatencyTracker) Run(ctx context.Context, in <-chan *Envelope) <-chan *Envelope {
+	out := make(chan *Envelope)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case envelope, ok := <-in:
+				if !ok {
+					return
+				}
+				t.Observe(envelope)
+				select {
+				case out <- envelope:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// Propagation returns a copy of what is known about a status, if it is
+// still being tracked.
+func (t *LatencyTracker) Propagation(uri string) (*Propagation, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	elem, ok := t.statuses[uri]
+	if !ok {
+		return nil, false
+	}
+	propagation := *elem.Value.(*Propagation)
+	propagation.Deliveries = make(map[string]*Delivery)
+	for receiver, delivery := range elem.Value.(*Propagation).Deliveries {
+		d := *delivery
+		propagation.Deliveries[receiver] = &d
+	}
+	return &propagation, true
+}
+
+// Report summarizes latency for every origin/receiver pair seen so far,
+// sorted by origin then receiver.
+func (t *LatencyTracker) Report() []PairLatency {
+	t.Lock()
+	defer t.Unlock()
+
+	report := make([]PairLatency, 0, len(t.pairs))
+	for pair, samples := range t.pairs {
+		sorted := append([]time.Duration(nil), samples.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		report = append(report, PairLatency{
+			Origin:   pair.origin,
+			Receiver: pair.receiver,
+			Count:    samples.count,
+			Min:      samples.min,
+			Mean:     samples.sum / time.Duration(samples.count),
+			P50:      percentile(sorted, 0.50),
+			P90:      percentile(sorted, 0.90),
+			P99:      percentile(sorted, 0.99),
+			Max:      samples.max,
+		})
+	}
+
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Origin != report[j].Origin {
+			return report[i].Origin < report[j].Origin
+		}
+		return report[i].Receiver < report[j].Receiver
+	})
+	return report
+}
+
+func (t *LatencyTracker) expire(now time.Time) {
+	if t.Window <= 0 {
+		return
+	}
+	for front := t.order.Front(); front != nil; front = t.order.Front() {
+		if now.Sub(front.Value.(*Propagation).firstSeen) < t.Window {
+			return
+		}
+		t.forget(front)
+	}
+}
+
+func (t *LatencyTracker) forget(elem *list.Element) {
+	t.order.Remove(elem)
+	delete(t.statuses, elem.Value.(*Propagation).URI)
+}
+
+// percentile picks the nearest-rank percentile from sorted samples.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
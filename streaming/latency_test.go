@@ -0,0 +1,48 @@
+package streaming
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := NewLatencyTracker()
+	createdAt := time.Date(2022, 11, 20, 12, 0, 0, 0, time.UTC)
+
+	deliver := func(server, uri string, after time.Duration) {
+		tracker.Observe(&Envelope{
+			Server:     server,
+			ReceivedAt: createdAt.Add(after),
+			Event: &mastodon.UpdateEvent{Status: &mastodon.Status{
+				URI:       uri,
+				CreatedAt: createdAt,
+			}},
+		})
+	}
+
+	deliver("https://a.example", "https://origin.example/users/x/statuses/1", 1*time.Second)
+	deliver("https://b.example", "https://origin.example/users/x/statuses/1", 4*time.Second)
+	deliver("https://a.example", "https://origin.example/users/x/statuses/1", 9*time.Second)
+	deliver("https://a.example", "https://origin.example/users/x/statuses/2", 3*time.Second)
+
+	propagation, ok := tracker.Propagation("https://origin.example/users/x/statuses/1")
+	require.True(t, ok)
+	require.Equal(t, "origin.example", propagation.Origin)
+	require.Equal(t, createdAt.Add(time.Second), propagation.Deliveries["a.example"].First)
+	require.Equal(t, createdAt.Add(9*time.Second), propagation.Deliveries["a.example"].Last)
+
+	report := tracker.Report()
+	require.Len(t, report, 2)
+
+	require.Equal(t, "a.example", report[0].Receiver)
+	require.Equal(t, int64(2), report[0].Count)
+	require.Equal(t, time.Second, report[0].Min)
+	require.Equal(t, 2*time.Second, report[0].Mean)
+	require.Equal(t, 3*time.Second, report[0].Max)
+
+	require.Equal(t, "b.example", report[1].Receiver)
+	require.Equal(t, 4*time.Second, report[1].P50)
+}
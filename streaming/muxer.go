@@ -3,12 +3,13 @@ package streaming
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/ratelimit"
 
 	"github.com/mattn/go-mastodon"
 )
@@ -16,6 +17,48 @@ import (
 type Mux struct {
 	apps    map[string]*mastodon.Application
 	clients map[string]*mastodon.Client
+
+	// RetryPolicy is applied independently to every stream.
+	RetryPolicy RetryPolicy
+
+	// BreakerPolicy is used for each stream's breaker the first time it is
+	// started. Breakers are kept for the life of the Mux.
+	BreakerPolicy BreakerPolicy
+
+	// BufferPolicy sizes the buffers of each Stream or Subscribe call.
+	BufferPolicy BufferPolicy
+
+	// StallPolicy decides when a silent stream is reconnected.
+	StallPolicy StallPolicy
+
+	// Transport is how streams are followed, and Fallback what they switch
+	// to after FallbackAfter consecutive attempts that received nothing, or
+	// straight away if the server refuses outright. A nil Fallback never
+	// falls back. Streams stay on the fallback until they are restarted.
+	Transport     Transport
+	Fallback      Transport
+	FallbackAfter int
+
+	// TransportFor, if set, picks the transport for each server instead,
+	// e.g. to use WebSockets only where they work. A nil result means
+	// Transport.
+	TransportFor func(serverName string) Transport
+
+	// Checkpoints track the newest status on every stream, and Backfill
+	// bounds how much is fetched from them after a reconnect. Nil
+	// Checkpoints disable backfilling.
+	Checkpoints *Checkpoints
+	Backfill    BackfillPolicy
+
+	breakers map[string]map[string]*Breaker
+	subs     map[*subscription]struct{}
+	removed  map[string]bool
+	tracker  *statusTracker
+
+	// subSpec is the spec followed by Subscribe.
+	subSpec *SubscriptionSpec
+
+	sync.Mutex
 }
 
 func NewMuxFromCredentialsDir(accountStore accounts.Store) (*Mux, error) {
@@ -24,66 +67,252 @@ func NewMuxFromCredentialsDir(accountStore accounts.Store) (*Mux, error) {
 		return nil, err
 	}
 
-	clients := make(map[string]*mastodon.Client)
+	tokens, _ := accountStore.(accounts.TokenStore)
+
+	m := NewMux()
 	for server, app := range apps {
-		clients[server] = mastodon.NewClient(&mastodon.Config{
-			Server:       server,
-			ClientID:     app.ClientID,
-			ClientSecret: app.ClientSecret,
-		})
+		m.apps[server] = app
+		m.clients[server] = newClient(server, app)
+		if tokens != nil {
+			m.clients[server].Config.AccessToken, _ = tokens.GetAccessToken(server)
+		}
+		m.tracker.add(server)
 	}
+	return m, nil
+}
 
+// NewMux returns a Mux without any servers, which can be added with
+// AddServer.
+func NewMux() *Mux {
 	return &Mux{
-		apps:    apps,
-		clients: clients,
-	}, nil
+		apps:          make(map[string]*mastodon.Application),
+		clients:       make(map[string]*mastodon.Client),
+		RetryPolicy:   DefaultRetryPolicy,
+		BreakerPolicy: DefaultBreakerPolicy,
+		BufferPolicy:  DefaultBufferPolicy,
+		StallPolicy:   DefaultStallPolicy,
+		Transport:     SSETransport,
+		Fallback:      DefaultPollingTransport,
+		FallbackAfter: 3,
+		Checkpoints:   NewCheckpoints(),
+		Backfill:      DefaultBackfillPolicy,
+		breakers:      make(map[string]map[string]*Breaker),
+		subs:          make(map[*subscription]struct{}),
+		tracker:       newStatusTracker(),
+	}
+}
+
+func newClient(server string, app *mastodon.Application) *mastodon.Client {
+	client := mastodon.NewClient(&mastodon.Config{
+		Server:       server,
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+	})
+	client.Client = *ratelimit.Client
+	return client
+}
+
+// Breaker returns the circuit breaker for one of a server's streams,
+// creating it if needed.
+func (m *Mux) Breaker(serverName string, spec StreamSpec) *Breaker {
+	m.Lock()
+	defer m.Unlock()
+	return m.breaker(serverName, spec)
+}
+
+func (m *Mux) breaker(serverName string, spec StreamSpec) *Breaker {
+	byStream, ok := m.breakers[serverName]
+	if !ok {
+		byStream = make(map[string]*Breaker)
+		m.breakers[serverName] = byStream
+	}
+
+	b, ok := byStream[spec.String()]
+	if !ok {
+		b = NewBreaker(m.BreakerPolicy)
+		byStream[spec.String()] = b
+	}
+	return b
+}
+
+// SetAccessToken gives the Mux a user's access token for a server, which
+// list and user streams need. It only affects streams started afterwards.
+func (m *Mux) SetAccessToken(serverName, token string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.clients[serverName]; !ok {
+		return fmt.Errorf("server %s is not in the mux", serverName)
+	}
+	// Running streams keep reading the old client's config, so it's
+	// replaced rather than changed.
+	client := newClient(serverName, m.apps[serverName])
+	client.Config.AccessToken = token
+	m.clients[serverName] = client
+	return nil
+}
+
+// subscription is a running Stream call. Servers added to the Mux while it
+// runs join it, and removed servers leave it.
+type subscription struct {
+	ctx    context.Context
+	ch     chan *Envelope
+	errCh  chan<- *StreamError
+	buffer BufferPolicy
+
+	// specsFor returns the streams to run for a server.
+	specsFor func(serverName string) []StreamSpec
+
+	// cancels stops each server's streams, by server and then stream.
+	cancels map[string]map[string]context.CancelFunc
+
+	// running counts the stream goroutines, which are the only senders on
+	// ch and errCh.
+	running sync.WaitGroup
+}
+
+// Stream follows the same stream on every server in the Mux until ctx is
+// done. List and user streams are only started on servers the Mux has an
+// access token for.
+//
+// Once ctx is done both channels are closed, after every stream has
+// stopped and handed over what it had buffered (see BufferPolicy.Drain).
+// Keep reading until then or those events are dropped.
+func (m *Mux) Stream(ctx context.Context, spec StreamSpec) (<-chan *Envelope, <-chan *StreamError) {
+	return m.stream(ctx, func(string) []StreamSpec {
+		return []StreamSpec{spec}
+	})
+}
+
+// StreamPublic streams the public timeline of every server in the Mux, local
+// only if isLocal is set, until ctx is done.
+func (m *Mux) StreamPublic(ctx context.Context, isLocal bool) (<-chan *Envelope, <-chan *StreamError) {
+	return m.Stream(ctx, PublicStream(isLocal))
 }
 
-type StreamError struct {
-	Server string `json:"server"`
-	Err    error  `json:"error"`
+// StreamHashtag follows a hashtag on every server in the Mux, only counting
+// each server's own posts if isLocal is set.
+func (m *Mux) StreamHashtag(ctx context.Context, tag string, isLocal bool) (<-chan *Envelope, <-chan *StreamError) {
+	return m.Stream(ctx, HashtagStream(tag, isLocal))
 }
 
-func (m *Mux) StreamPublic(ctx context.Context, isLocal bool) (<-chan mastodon.Event, <-chan *StreamError) {
-	ch := make(chan mastodon.Event)
+// StreamUser follows the home timeline and notifications of the user on
+// every server the Mux has an access token for.
+func (m *Mux) StreamUser(ctx context.Context) (<-chan *Envelope, <-chan *StreamError) {
+	return m.Stream(ctx, StreamSpec{Kind: StreamUser})
+}
+
+// StreamList follows lists, which belong to a user on a particular server,
+// so lists maps server names to list ids.
+func (m *Mux) StreamList(ctx context.Context, lists map[string]string) (<-chan *Envelope, <-chan *StreamError) {
+	return m.stream(ctx, func(serverName string) []StreamSpec {
+		listID, ok := lists[serverName]
+		if !ok {
+			return nil
+		}
+		return []StreamSpec{{Kind: StreamList, List: listID}}
+	})
+}
+
+func (m *Mux) stream(ctx context.Context, specsFor func(serverName string) []StreamSpec) (<-chan *Envelope, <-chan *StreamError) {
+	m.Lock()
+	defer m.Unlock()
+
+	ch := make(chan *Envelope, m.BufferPolicy.Global)
 	errCh := make(chan *StreamError)
 
-	// For each client, start a goroutine that streams public events
-	// and sends them to the channel.
-	for serverName, client := range m.clients {
-		// TODO: client has a Config.Server field
-		// TODO: better error handling and retries. right now this just dies which
-		// is good for not hammering but bad for working
-		go streamPublicSafely(ctx, serverName, client, isLocal, ch, errCh)
+	sub := &subscription{
+		ctx:      ctx,
+		ch:       ch,
+		errCh:    errCh,
+		buffer:   m.BufferPolicy,
+		specsFor: specsFor,
+		cancels:  make(map[string]map[string]context.CancelFunc),
+	}
+	m.subs[sub] = struct{}{}
+
+	// For each client, start a goroutine per stream that sends events to
+	// the channel.
+	for serverName := range m.clients {
+		m.startLocked(sub, serverName)
 	}
 
+	// Nothing starts once ctx is done, so after the streams have drained
+	// their buffers the channels can be closed.
+	go func() {
+		<-ctx.Done()
+		m.Lock()
+		delete(m.subs, sub)
+		m.Unlock()
+
+		sub.running.Wait()
+		close(ch)
+		close(errCh)
+	}()
+
 	return ch, errCh
 }
 
-func streamPublicSafely(ctx context.Context, serverName string, client *mastodon.Client, isLocal bool, ch chan<- mastodon.Event, errCh chan<- *StreamError) {
-	// TODO: this is a kludge to work around the fact that the client
-	// will keep hammering on an error in a tight loop.
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// startLocked starts a server's streams for a subscription. The caller must
+// hold the lock.
+func (m *Mux) startLocked(sub *subscription, serverName string) {
+	if sub.ctx.Err() != nil {
+		return
+	}
 
-	stream, err := client.StreamingPublic(ctx, isLocal)
-	if err != nil {
-		errCh <- &StreamError{Server: serverName, Err: err}
+	client := m.clients[serverName]
+	for _, spec := range sub.specsFor(serverName) {
+		if spec.needsToken() && client.Config.AccessToken == "" {
+			continue
+		}
+		m.startStreamLocked(sub, serverName, spec)
+	}
+}
+
+func (m *Mux) startStreamLocked(sub *subscription, serverName string, spec StreamSpec) {
+	cancels, ok := sub.cancels[serverName]
+	if !ok {
+		cancels = make(map[string]context.CancelFunc)
+		sub.cancels[serverName] = cancels
+	}
+	if _, running := cancels[spec.String()]; running {
 		return
 	}
 
-	for event := range stream {
-		switch event := event.(type) {
-		case *mastodon.ErrorEvent:
-			errCh <- &StreamError{
-				Server: serverName,
-				Err:    errors.New(event.Error()),
-			}
-			return
-		default:
-			ch <- event
+	ctx, cancel := context.WithCancel(sub.ctx)
+	cancels[spec.String()] = cancel
+
+	transport := m.Transport
+	if m.TransportFor != nil {
+		if t := m.TransportFor(serverName); t != nil {
+			transport = t
 		}
 	}
+	if transport == nil {
+		transport = SSETransport
+	}
+
+	// TODO: client has a Config.Server field
+	s := &serverStream{
+		server:        serverName,
+		client:        m.clients[serverName],
+		spec:          spec,
+		retry:         m.RetryPolicy,
+		transport:     transport,
+		fallback:      m.Fallback,
+		fallbackAfter: m.FallbackAfter,
+		checkpoints:   m.Checkpoints,
+		backfill:      m.Backfill,
+		breaker:       m.breaker(serverName, spec),
+		buffer:        sub.buffer,
+		tracker:       m.tracker,
+		stall:         stallMeter{policy: m.StallPolicy},
+	}
+	sub.running.Add(1)
+	go func() {
+		defer sub.running.Done()
+		streamSafely(ctx, s, sub.ch, sub.errCh)
+	}()
 }
 
 func ServerURIFromAppAuthURI(app *mastodon.Application) (string, error) {
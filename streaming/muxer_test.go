@@ -2,20 +2,25 @@ package streaming
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/abreka/proboscideans/accounts"
 	"github.com/mattn/go-mastodon"
 	"github.com/stretchr/testify/require"
 )
 
-func Test_streamPublicSafely(t *testing.T) {
+func Test_streamSafely(t *testing.T) {
 	type testCase struct {
 		hits       int
 		statusCode int
+		kind       FailureKind
 	}
 
 	currentTest := &testCase{hits: 0, statusCode: http.StatusNotFound}
@@ -32,13 +37,15 @@ func Test_streamPublicSafely(t *testing.T) {
 	defer cancel()
 
 	testCases := []testCase{
-		{hits: 0, statusCode: http.StatusBadGateway},
-		{hits: 0, statusCode: http.StatusNotFound},
-		{hits: 0, statusCode: http.StatusServiceUnavailable},
-		{hits: 0, statusCode: http.StatusGatewayTimeout},
-		{hits: 0, statusCode: http.StatusTooManyRequests},
-		{hits: 0, statusCode: http.StatusInternalServerError},
-		{hits: 0, statusCode: http.StatusBadRequest},
+		{hits: 0, statusCode: http.StatusBadGateway, kind: FailureTransient},
+		{hits: 0, statusCode: http.StatusNotFound, kind: FailurePermanent},
+		{hits: 0, statusCode: http.StatusServiceUnavailable, kind: FailureTransient},
+		{hits: 0, statusCode: http.StatusGatewayTimeout, kind: FailureTransient},
+		{hits: 0, statusCode: http.StatusTooManyRequests, kind: FailureThrottled},
+		{hits: 0, statusCode: http.StatusInternalServerError, kind: FailureTransient},
+		{hits: 0, statusCode: http.StatusBadRequest, kind: FailurePermanent},
+		{hits: 0, statusCode: http.StatusGone, kind: FailurePermanent},
+		{hits: 0, statusCode: http.StatusUnauthorized, kind: FailurePermanent},
 	}
 
 	for _, testCase := range testCases {
@@ -51,7 +58,7 @@ func Test_streamPublicSafely(t *testing.T) {
 		})
 
 		// Make two channels to receive events and errors.
-		ch := make(chan mastodon.Event)
+		ch := make(chan *Envelope)
 		errCh := make(chan *StreamError)
 
 		// Start a goroutine that streams public events.
@@ -65,7 +72,15 @@ func Test_streamPublicSafely(t *testing.T) {
 			// Only give CI 1 seconds
 			ctx, timeout := context.WithTimeout(ctx, time.Second*2)
 			defer timeout()
-			streamPublicSafely(ctx, "localhost", client, true, ch, errCh)
+			s := &serverStream{
+				server:    "localhost",
+				client:    client,
+				spec:      PublicStream(true),
+				transport: SSETransport,
+				retry:     RetryPolicy{MaxRetries: 0},
+				breaker:   NewBreaker(DefaultBreakerPolicy),
+			}
+			streamSafely(ctx, s, ch, errCh)
 		}()
 
 		// Consume all events.
@@ -79,10 +94,12 @@ func Test_streamPublicSafely(t *testing.T) {
 
 		// Consume all errors.
 		errorsReceived := 0
+		var lastErr *StreamError
 		go func() {
 			defer wg.Done()
-			for range errCh {
+			for err := range errCh {
 				errorsReceived++
+				lastErr = err
 			}
 		}()
 
@@ -93,5 +110,471 @@ func Test_streamPublicSafely(t *testing.T) {
 		require.LessOrEqual(t, currentTest.hits, 2)
 		require.Equal(t, 0, eventsReceived)
 		require.Equal(t, 1, errorsReceived)
+		require.Equal(t, testCase.kind, lastErr.Kind, "status %d", testCase.statusCode)
+		require.False(t, lastErr.Retrying)
+	}
+}
+
+func Test_streamSafely_retries(t *testing.T) {
+	var lock sync.Mutex
+	hits := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		hits++
+		lock.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := mastodon.NewClient(&mastodon.Config{
+		Server:   server.URL,
+		ClientID: "client-id",
+	})
+
+	policy := RetryPolicy{
+		MaxRetries:     2,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	tracker := newStatusTracker()
+	tracker.add("localhost")
+	changes := tracker.subscribe(ctx)
+
+	ch := make(chan *Envelope)
+	errCh := make(chan *StreamError)
+	go func() {
+		defer close(errCh)
+		s := &serverStream{
+			server:    "localhost",
+			client:    client,
+			spec:      PublicStream(true),
+			transport: SSETransport,
+			retry:     policy,
+			breaker:   NewBreaker(BreakerPolicy{FailureThreshold: 5, OpenTimeout: time.Millisecond}),
+			tracker:   tracker,
+		}
+		streamSafely(ctx, s, ch, errCh)
+	}()
+
+	var errs []*StreamError
+	for err := range errCh {
+		errs = append(errs, err)
+	}
+
+	require.NoError(t, ctx.Err(), "gave up before the retry budget ran out")
+	require.Len(t, errs, 3)
+	for i, err := range errs {
+		require.Equal(t, i+1, err.Attempt)
+		require.Equal(t, i < 2, err.Retrying)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.GreaterOrEqual(t, hits, 3)
+	require.LessOrEqual(t, hits, 6)
+
+	statuses := tracker.snapshot()
+	require.Len(t, statuses, 1)
+	require.Equal(t, StateDead, statuses[0].State)
+	require.Equal(t, int64(3), statuses[0].Errors)
+	require.Contains(t, statuses[0].LastError, "502")
+
+	var states []ServerState
+	for len(changes) > 0 {
+		states = append(states, (<-changes).To)
+	}
+	require.Equal(t, []ServerState{
+		StateConnecting, StateRetrying,
+		StateConnecting, StateRetrying,
+		StateConnecting, StateDead,
+	}, states)
+}
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	policy := RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+	}
+
+	require.Equal(t, time.Second, policy.Backoff(1))
+	require.Equal(t, 4*time.Second, policy.Backoff(3))
+	require.Equal(t, 10*time.Second, policy.Backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		backoff := policy.Backoff(2)
+		require.GreaterOrEqual(t, backoff, time.Second)
+		require.LessOrEqual(t, backoff, 2*time.Second)
+	}
+}
+
+type memoryStore struct {
+	apps map[string]*mastodon.Application
+	sync.Mutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{apps: make(map[string]*mastodon.Application)}
+}
+
+func (s *memoryStore) add(server string, app *mastodon.Application) {
+	s.Lock()
+	defer s.Unlock()
+	s.apps[server] = app
+}
+
+func (s *memoryStore) LoadByClientID(clientID string) (*accounts.NamedApplication, error) {
+	s.Lock()
+	defer s.Unlock()
+	for server, app := range s.apps {
+		if app.ClientID == clientID {
+			return &accounts.NamedApplication{ServerName: server, App: app}, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *memoryStore) GetByServerName(serverName string) (*mastodon.Application, error) {
+	s.Lock()
+	defer s.Unlock()
+	if app, ok := s.apps[serverName]; ok {
+		return app, nil
+	}
+	return nil, errors.New("not found")
+}
+
+func (s *memoryStore) GetAll() (map[string]*mastodon.Application, error) {
+	s.Lock()
+	defer s.Unlock()
+	apps := make(map[string]*mastodon.Application)
+	for server, app := range s.apps {
+		apps[server] = app
+	}
+	return apps, nil
+}
+
+// newStreamingServer serves a single update event for the given status id
+// and then holds the stream open until the client goes away.
+func newStreamingServer(statusID string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprintf(w, "event: update\ndata: {\"id\":%q,\"uri\":\"https://example.com/%s\"}\n\n", statusID, statusID)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+}
+
+func TestMux_AddRemoveServer(t *testing.T) {
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, _ := mux.StreamPublic(ctx, true)
+
+	server := newStreamingServer("1")
+	defer server.Close()
+
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+	require.Error(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	select {
+	case envelope := <-events:
+		require.Equal(t, server.URL, envelope.Server)
+		require.Equal(t, PublicStream(true), envelope.Stream)
+		require.Equal(t, uint64(1), envelope.Conn)
+		require.Equal(t, uint64(1), envelope.Seq)
+		require.Equal(t, mastodon.ID("1"), envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+	case <-ctx.Done():
+		t.Fatal("never received an event from the added server")
+	}
+
+	statuses := mux.Status()
+	require.Len(t, statuses, 1)
+	require.Equal(t, StateConnected, statuses[0].State)
+
+	require.NoError(t, mux.RemoveServer(server.URL))
+	require.Error(t, mux.RemoveServer(server.URL))
+	require.Empty(t, mux.Status())
+	require.Empty(t, mux.Servers())
+}
+
+func TestMux_SetAccessToken(t *testing.T) {
+	// Hangs up after every event, so the stream keeps reconnecting.
+	var mu sync.Mutex
+	var tokens []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = fmt.Fprint(w, "event: update\ndata: {\"id\":\"1\"}\n\n")
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	mux.RetryPolicy = RetryPolicy{MaxRetries: -1, MaxBackoff: time.Millisecond}
+	mux.Fallback = nil
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, errs := mux.StreamPublic(ctx, true)
+	go func() {
+		for range errs {
+		}
+	}()
+
+	// Running streams keep the client they started with, so this mustn't
+	// race with their reconnects.
+	for i := 0; i < 3; i++ {
+		<-events
+		require.NoError(t, mux.SetAccessToken(server.URL, fmt.Sprintf("token-%d", i)))
 	}
+	require.Error(t, mux.SetAccessToken("https://unknown.example", "token"))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotContains(t, tokens, "Bearer token-0")
+}
+
+func TestMux_WatchStore(t *testing.T) {
+	store := newMemoryStore()
+	mux, err := NewMuxFromCredentialsDir(store)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	updates := mux.WatchStore(ctx, store, 10*time.Millisecond)
+	store.add("https://new.example", &mastodon.Application{ClientID: "client-id"})
+
+	select {
+	case update := <-updates:
+		require.NoError(t, update.Err)
+		require.Equal(t, "https://new.example", update.Server)
+	case <-ctx.Done():
+		t.Fatal("watcher never picked up the new server")
+	}
+	require.True(t, mux.HasServer("https://new.example"))
+
+	// Removing a server is for good, even though it's still in the store.
+	require.NoError(t, mux.RemoveServer("https://new.example"))
+	store.add("https://newer.example", &mastodon.Application{ClientID: "client-id"})
+	select {
+	case update := <-updates:
+		require.Equal(t, "https://newer.example", update.Server)
+	case <-ctx.Done():
+		t.Fatal("watcher never picked up the newer server")
+	}
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, mux.HasServer("https://new.example"))
+	require.Equal(t, []string{"https://newer.example"}, mux.Servers())
+}
+
+func TestStoreUpdate_MarshalJSON(t *testing.T) {
+	b, err := json.Marshal(StoreUpdate{Err: errors.New("unexpected end of JSON input")})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"error":"unexpected end of JSON input"}`, string(b))
+
+	b, err = json.Marshal(StoreUpdate{Server: "https://a.example"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"server":"https://a.example"}`, string(b))
+}
+
+func Test_streamSafely_stalled(t *testing.T) {
+	server := newStreamingServer("1")
+	defer server.Close()
+
+	client := mastodon.NewClient(&mastodon.Config{
+		Server:   server.URL,
+		ClientID: "client-id",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := &serverStream{
+		server:    "localhost",
+		client:    client,
+		spec:      PublicStream(true),
+		transport: SSETransport,
+		retry:     RetryPolicy{MaxRetries: 0},
+		breaker:   NewBreaker(DefaultBreakerPolicy),
+		stall:     stallMeter{policy: StallPolicy{MaxIdle: 100 * time.Millisecond}},
+	}
+
+	ch := make(chan *Envelope, 10)
+	errCh := make(chan *StreamError, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		streamSafely(ctx, s, ch, errCh)
+	}()
+
+	// A stall after a working connection is no failure, so even without
+	// retries it keeps reconnecting.
+	for i := 0; i < 2; i++ {
+		streamErr := <-errCh
+		require.Equal(t, ReasonStalled, streamErr.Reason)
+		require.Equal(t, FailureTransient, streamErr.Kind)
+		require.ErrorIs(t, streamErr, ErrStalled)
+		require.True(t, streamErr.Retrying)
+		require.Equal(t, 0, streamErr.Attempt)
+	}
+	require.GreaterOrEqual(t, len(ch), 2)
+	require.False(t, s.breaker.IsDead())
+	cancel()
+	<-done
+
+	// One that never worked counts as a failed attempt.
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer silent.Close()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.client = mastodon.NewClient(&mastodon.Config{Server: silent.URL})
+	streamSafely(ctx, s, ch, errCh)
+
+	streamErr := <-errCh
+	require.Equal(t, ReasonStalled, streamErr.Reason)
+	require.Equal(t, 1, streamErr.Attempt)
+	require.False(t, streamErr.Retrying)
+}
+
+func Test_streamOnce_heartbeats(t *testing.T) {
+	// Nothing but heartbeats for a while, then nothing at all.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 10; i++ {
+			_, _ = fmt.Fprint(w, ":thump\n\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(30 * time.Millisecond)
+		}
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s := &serverStream{
+		server:    "localhost",
+		client:    mastodon.NewClient(&mastodon.Config{Server: server.URL}),
+		spec:      PublicStream(true),
+		transport: SSETransport,
+		stall:     stallMeter{policy: StallPolicy{MaxIdle: 100 * time.Millisecond}},
+	}
+	ch := make(chan *Envelope, 1)
+	out := newOutbox(s.server, BufferPolicy{}, ch, nil)
+
+	start := time.Now()
+	_, err := streamOnce(ctx, s, out, make(chan *StreamError, 1))
+	require.ErrorIs(t, err, ErrStalled)
+	require.GreaterOrEqual(t, time.Since(start), 300*time.Millisecond)
+	require.Empty(t, ch)
+}
+
+func TestParseStreamSpec(t *testing.T) {
+	for _, text := range []string{"local", "federated", "hashtag:fediverse", "hashtag-local:fediverse", "list:42", "user"} {
+		spec, err := ParseStreamSpec(text)
+		require.NoError(t, err, text)
+		require.Equal(t, text, spec.String())
+	}
+
+	spec, err := ParseStreamSpec("hashtag:#fediverse")
+	require.NoError(t, err)
+	require.Equal(t, HashtagStream("fediverse", false), spec)
+
+	for _, text := range []string{"", "public", "hashtag", "list:", "local:x"} {
+		_, err := ParseStreamSpec(text)
+		require.Error(t, err, text)
+	}
+}
+
+func TestMux_StreamHashtag(t *testing.T) {
+	var paths sync.Map
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths.Store(r.URL.Path+"?"+r.URL.RawQuery, true)
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprint(w, "event: update\ndata: {\"id\":\"1\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, _ := mux.StreamHashtag(ctx, "#fediverse", true)
+	select {
+	case envelope := <-events:
+		require.Equal(t, HashtagStream("fediverse", true), envelope.Stream)
+	case <-ctx.Done():
+		t.Fatal("never received a hashtag event")
+	}
+	_, ok := paths.Load("/api/v1/streaming/hashtag/local?tag=fediverse")
+	require.True(t, ok)
+
+	// User streams need a token, so nothing is started without one.
+	_, _ = mux.StreamUser(ctx)
+	require.Len(t, mux.Status()[0].Streams, 1)
+}
+
+func TestMux_DrainsOnCancel(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for i := 1; i <= 5; i++ {
+			_, _ = fmt.Fprintf(w, "event: update\ndata: {\"id\":\"%d\"}\n\n", i)
+		}
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	mux.BufferPolicy = BufferPolicy{PerServer: 8, Overflow: OverflowBlock, Drain: 5 * time.Second}
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, errs := mux.StreamPublic(ctx, true)
+
+	// Take one so we know the rest are sitting in the server's buffer.
+	first := <-events
+	require.Equal(t, mastodon.ID("1"), first.Event.(*mastodon.UpdateEvent).Status.ID)
+	require.Eventually(t, func() bool { return mux.Status()[0].Events == 5 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+
+	var ids []mastodon.ID
+	for envelope := range events {
+		ids = append(ids, envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+	}
+	require.Equal(t, []mastodon.ID{"2", "3", "4", "5"}, ids)
+
+	_, ok := <-errs
+	require.False(t, ok, "errors should be closed too")
 }
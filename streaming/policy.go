@@ -0,0 +1,546 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/ratelimit"
+	"github.com/mattn/go-mastodon"
+)
+
+// OptOutAction is what a Policy does with statuses from accounts that opted
+// out of being indexed.
+type OptOutAction string
+
+const (
+	// OptOutDrop throws the status away.
+	OptOutDrop OptOutAction = "drop"
+	// OptOutRedact keeps that a status existed, and when, but nothing
+	// that could identify the author or what they said.
+	OptOutRedact OptOutAction = "redact"
+)
+
+func ParseOptOutAction(s string) (OptOutAction, error) {
+	switch action := OptOutAction(s); action {
+	case OptOutDrop, OptOutRedact:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown opt-out action %q", s)
+	}
+}
+
+// OptOutReason says why a Policy dropped or redacted an event.
+type OptOutReason string
+
+const (
+	// OptOutNoindex is an account asking search engines to stay away.
+	OptOutNoindex OptOutReason = "noindex"
+	// OptOutNotDiscoverable is an account that explicitly turned off
+	// discoverability.
+	OptOutNotDiscoverable OptOutReason = "not-discoverable"
+	// OptOutBioTag is an account with one of the opt-out hashtags in its
+	// bio or profile fields.
+	OptOutBioTag OptOutReason = "bio-tag"
+	// OptOutServerRules is anything received from a server whose rules
+	// forbid collection.
+	OptOutServerRules OptOutReason = "server-rules"
+	// OptOutOriginRules is a status that was posted on an instance whose
+	// rules forbid collection, wherever it was received from.
+	OptOutOriginRules OptOutReason = "origin-rules"
+	// OptOutListed is anything received from, or posted on, an instance
+	// that is Excluded.
+	OptOutListed OptOutReason = "opt-out-list"
+)
+
+// DefaultOptOutTags are the hashtags that, in a bio, opt an account out.
+var DefaultOptOutTags = []string{"nobot", "noarchive"}
+
+// forbidsCollection matches instance rules about scraping, crawling, data
+// mining, archiving posts or research on them. Plenty of matching rules
+// allow some of it with consent, but we would rather skip a server than
+// misread its rules. Archiving and research only count when they are about
+// what's posted, not e.g. archiving reports or doing your own research.
+var forbidsCollection = regexp.MustCompile(`(?i)\b(` +
+	`scrap(e|es|ed|ing|ers?)|crawl(s|ed|ing|ers?)?|data[- ]?(mining|harvesting|collection)|` +
+	`harvest(s|ed|ing)? (of )?(data|posts|content|toots|statuses|accounts|profiles|users?)|` +
+	`archiv(e|es|ed|ing) (of )?(posts|content|toots|statuses|data|accounts|profiles|users?|this (server|instance))|` +
+	`(for|in|into|as) (academic |scientific )?research|research (use|purposes?|projects?|datasets?|data)|researchers|` +
+	`(ai|llm|machine[- ]learning) training|train(ing)? (ai|llms?|models?)` +
+	`)\b`)
+
+var htmlTag = regexp.MustCompile(`<[^>]*>`)
+
+// Policy is the stage between a Mux and the sinks that honours research
+// opt-outs. It drops everything from instances whose rules forbid
+// collection, and drops or redacts statuses from accounts that opted out.
+// Every event it drops or redacts is counted.
+//
+// Rules are only fetched for the servers events are received from, never
+// for wherever a status was posted; statuses posted elsewhere are checked
+// against the rules of those servers we happen to know. Fetching happens in
+// the background the first time a server is seen, and until its rules are
+// in, or if they can't be fetched, its events are let through and counted
+// as unchecked.
+type Policy struct {
+	Action OptOutAction
+
+	// OptOutTags are hashtags, without the #, that opt an account out when
+	// they appear in its bio or profile fields.
+	OptOutTags []string
+
+	// Rules returns an instance's rules, by host. Nil fetches them from
+	// /api/v1/instance/rules.
+	Rules func(ctx context.Context, host string) ([]string, error)
+
+	// RulesTTL is how long an instance's rules are trusted, and RulesRetry
+	// how long to wait before trying again when they couldn't be fetched.
+	RulesTTL     time.Duration
+	RulesRetry   time.Duration
+	RulesTimeout time.Duration
+
+	// Excluded, if set, reports whether an instance, by host, asked not to
+	// be crawled. Those are never contacted, not even for their rules.
+	Excluded func(host string) bool
+
+	// OnForbidden, if set, is called once for each server we receive from
+	// whose rules forbid collection, e.g. to stop streaming from it.
+	OnForbidden func(server string)
+
+	instances map[string]*instanceRules
+	fetching  map[string]chan struct{}
+	fetches   sync.WaitGroup
+	notified  map[string]bool
+	tags      *regexp.Regexp
+	stats     PolicyStats
+
+	sync.Mutex
+}
+
+// PolicyStats counts what a Policy let through and what it didn't.
+// Unchecked counts events let through because an instance's rules
+// weren't known yet or couldn't be fetched.
+type PolicyStats struct {
+	Passed    int64                  `json:"passed"`
+	Unchecked int64                  `json:"unchecked"`
+	Dropped   map[OptOutReason]int64 `json:"dropped"`
+	Redacted  map[OptOutReason]int64 `json:"redacted"`
+}
+
+type instanceRules struct {
+	forbidden bool
+	rule      string
+	err       error
+	expires   time.Time
+}
+
+func NewPolicy() *Policy {
+	return &Policy{
+		Action:       OptOutDrop,
+		OptOutTags:   DefaultOptOutTags,
+		RulesTTL:     24 * time.Hour,
+		RulesRetry:   10 * time.Minute,
+		RulesTimeout: 10 * time.Second,
+	}
+}
+
+func (p *Policy) Stats() PolicyStats {
+	p.Lock()
+	defer p.Unlock()
+
+	stats := PolicyStats{
+		Passed:    p.stats.Passed,
+		Unchecked: p.stats.Unchecked,
+		Dropped:   make(map[OptOutReason]int64),
+		Redacted:  make(map[OptOutReason]int64),
+	}
+	for reason, n := range p.stats.Dropped {
+		stats.Dropped[reason] = n
+	}
+	for reason, n := range p.stats.Redacted {
+		stats.Redacted[reason] = n
+	}
+	return stats
+}
+
+// Run applies the policy to envelopes from in until it is closed or ctx is
+// done.
+func (p *Policy) Run(ctx context.Context, in <-chan *Envelope) <-chan *Envelope {
+	out := make(chan *Envelope)
+
+	go func() {
+		defer close(out)
+		for {
+			var envelope *Envelope
+			var ok bool
+			select {
+			case envelope, ok = <-in:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			envelope = p.Apply(ctx, envelope)
+			if envelope == nil {
+				continue
+			}
+			select {
+			case out <- envelope:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// Apply returns the envelope as it may be kept: unchanged, redacted, or nil
+// if it has to be dropped.
+func (p *Policy) Apply(ctx context.Context, envelope *Envelope) *Envelope {
+	// Servers whose rules forbid collection tend to end up on the list as
+	// well, but the rules are the better reason.
+	host := accounts.HostOf(envelope.Server)
+	if p.excludes(host) && !p.knownToForbid(host) {
+		p.count(OptOutListed, true)
+		return nil
+	}
+	forbidden, checked := p.forbids(ctx, envelope.Server)
+	unchecked := !checked
+	if forbidden {
+		p.count(OptOutServerRules, true)
+		p.notify(envelope.Server)
+		return nil
+	}
+
+	status := statusOf(envelope.Event)
+	if status == nil {
+		// Deletes have to get through so they can be honoured.
+		p.pass(unchecked)
+		return envelope
+	}
+
+	for _, s := range []*mastodon.Status{status, status.Reblog} {
+		if s == nil {
+			continue
+		}
+		origin := accounts.HostOf(s.URI)
+		if origin == "" || origin == accounts.HostOf(envelope.Server) {
+			continue
+		}
+		if p.knownToForbid(origin) {
+			p.count(OptOutOriginRules, true)
+			return nil
+		}
+		if p.excludes(origin) {
+			p.count(OptOutListed, true)
+			return nil
+		}
+	}
+
+	reason, optedOut := p.optedOut(envelope, &status.Account)
+	if !optedOut && status.Reblog != nil {
+		// The booster is fine but whoever they boosted may not be.
+		if reblogReason, ok := p.optedOut(envelope, &status.Reblog.Account); ok {
+			p.count(reblogReason, p.Action == OptOutDrop)
+			if p.Action == OptOutDrop {
+				return nil
+			}
+			redacted := *status
+			redacted.Reblog = redactStatus(status.Reblog)
+			return withStatus(envelope, &redacted)
+		}
+	}
+	if optedOut {
+		p.count(reason, p.Action == OptOutDrop)
+		if p.Action == OptOutDrop {
+			return nil
+		}
+		return withStatus(envelope, redactStatus(status))
+	}
+
+	p.pass(unchecked)
+	return envelope
+}
+
+func (p *Policy) optedOut(envelope *Envelope, account *mastodon.Account) (OptOutReason, bool) {
+	if privacy, ok := envelope.Accounts[account.URL]; ok {
+		if privacy.Noindex != nil && *privacy.Noindex {
+			return OptOutNoindex, true
+		}
+		if privacy.Discoverable != nil && !*privacy.Discoverable {
+			return OptOutNotDiscoverable, true
+		}
+	}
+
+	tags := p.tagPattern()
+	if tags == nil {
+		return "", false
+	}
+	if tags.MatchString(htmlTag.ReplaceAllString(account.Note, "")) {
+		return OptOutBioTag, true
+	}
+	for _, field := range account.Fields {
+		if tags.MatchString(htmlTag.ReplaceAllString(field.Value, "")) {
+			return OptOutBioTag, true
+		}
+	}
+	return "", false
+}
+
+func (p *Policy) tagPattern() *regexp.Regexp {
+	p.Lock()
+	defer p.Unlock()
+	if p.tags == nil && len(p.OptOutTags) > 0 {
+		quoted := make([]string, len(p.OptOutTags))
+		for i, tag := range p.OptOutTags {
+			quoted[i] = regexp.QuoteMeta(strings.TrimPrefix(tag, "#"))
+		}
+		p.tags = regexp.MustCompile(`(?i)#(` + strings.Join(quoted, "|") + `)\b`)
+	}
+	return p.tags
+}
+
+// forbids reports whether a server's rules forbid collection, and whether
+// we actually know its rules. Rules that are missing or due for a refresh
+// are fetched in the background, unless the server is Excluded; until then
+// the old ones, if any, stand.
+func (p *Policy) forbids(ctx context.Context, server string) (forbidden bool, checked bool) {
+	host := accounts.HostOf(server)
+
+	p.Lock()
+	defer p.Unlock()
+	rules, ok := p.instances[host]
+	stale := !ok || !time.Now().Before(rules.expires)
+	if _, busy := p.fetching[host]; stale && !busy && !p.excludes(host) {
+		if p.fetching == nil {
+			p.fetching = make(map[string]chan struct{})
+		}
+		p.fetching[host] = make(chan struct{})
+		p.fetches.Add(1)
+		go p.fetchRules(ctx, server, host)
+	}
+	if !ok {
+		return false, false
+	}
+	return rules.forbidden, rules.err == nil
+}
+
+func (p *Policy) excludes(host string) bool {
+	return p.Excluded != nil && p.Excluded(host)
+}
+
+// Wait makes sure a server's rules are known, fetching them if need be,
+// for when there's no hurry. Afterwards ForbiddingRule has the answer. It
+// fails if the rules couldn't be fetched and nothing is known about the
+// server, or ctx is done first.
+func (p *Policy) Wait(ctx context.Context, server string) error {
+	host := accounts.HostOf(server)
+	p.forbids(ctx, server)
+
+	p.Lock()
+	done := p.fetching[host]
+	p.Unlock()
+	if done != nil {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	p.Lock()
+	defer p.Unlock()
+	rules, ok := p.instances[host]
+	switch {
+	case ok && rules.forbidden:
+		return nil
+	case ok && rules.err != nil:
+		return fmt.Errorf("unable to fetch its rules: %w", rules.err)
+	case !ok && p.excludes(host):
+		return fmt.Errorf("%s is on the opt-out list", host)
+	}
+	return nil
+}
+
+// knownToForbid reports whether we know an instance's rules to forbid
+// collection, without ever fetching them.
+func (p *Policy) knownToForbid(host string) bool {
+	p.Lock()
+	defer p.Unlock()
+	rules, ok := p.instances[host]
+	return ok && rules.forbidden
+}
+
+// fetchRules fetches a server's rules, and stops collecting from it if they
+// forbid it.
+func (p *Policy) fetchRules(ctx context.Context, server, host string) {
+	defer p.fetches.Done()
+	now := time.Now()
+
+	fetch := p.Rules
+	if fetch == nil {
+		fetch = fetchInstanceRules
+	}
+	timeout := p.RulesTimeout
+	if timeout <= 0 {
+		timeout = NewPolicy().RulesTimeout
+	}
+	fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+	texts, err := fetch(fetchCtx, host)
+	cancel()
+
+	rules := &instanceRules{err: err, expires: now.Add(p.RulesTTL)}
+	if err != nil {
+		rules.expires = now.Add(p.RulesRetry)
+	}
+	for _, text := range texts {
+		if forbidsCollection.MatchString(text) {
+			rules.forbidden = true
+			rules.rule = text
+			break
+		}
+	}
+
+	p.Lock()
+	if p.instances == nil {
+		p.instances = make(map[string]*instanceRules)
+	}
+	if err != nil {
+		if old, ok := p.instances[host]; ok && old.forbidden {
+			// A server doesn't get to collection by being unreachable.
+			rules.forbidden, rules.rule = true, old.rule
+		}
+	}
+	p.instances[host] = rules
+	close(p.fetching[host])
+	delete(p.fetching, host)
+	p.Unlock()
+
+	if rules.forbidden {
+		p.notify(server)
+	}
+}
+
+// ForbiddingRule returns the rule that got an instance skipped, if it was.
+func (p *Policy) ForbiddingRule(host string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	rules, ok := p.instances[accounts.HostOf(host)]
+	if !ok || !rules.forbidden {
+		return "", false
+	}
+	return rules.rule, true
+}
+
+func (p *Policy) notify(server string) {
+	p.Lock()
+	if p.notified == nil {
+		p.notified = make(map[string]bool)
+	}
+	first := !p.notified[server]
+	p.notified[server] = true
+	p.Unlock()
+
+	if first && p.OnForbidden != nil {
+		p.OnForbidden(server)
+	}
+}
+
+func (p *Policy) count(reason OptOutReason, dropped bool) {
+	p.Lock()
+	defer p.Unlock()
+	counts := &p.stats.Redacted
+	if dropped {
+		counts = &p.stats.Dropped
+	}
+	if *counts == nil {
+		*counts = make(map[OptOutReason]int64)
+	}
+	(*counts)[reason]++
+}
+
+func (p *Policy) pass(unchecked bool) {
+	p.Lock()
+	defer p.Unlock()
+	p.stats.Passed++
+	if unchecked {
+		p.stats.Unchecked++
+	}
+}
+
+func statusOf(event mastodon.Event) *mastodon.Status {
+	switch event := event.(type) {
+	case *mastodon.UpdateEvent:
+		return event.Status
+	case *StatusUpdateEvent:
+		return event.Status
+	default:
+		return nil
+	}
+}
+
+func withStatus(envelope *Envelope, status *mastodon.Status) *Envelope {
+	redacted := *envelope
+	redacted.Accounts = nil
+	if _, edit := envelope.Event.(*StatusUpdateEvent); edit {
+		redacted.Event = &StatusUpdateEvent{mastodon.UpdateEvent{Status: status}}
+	} else {
+		redacted.Event = &mastodon.UpdateEvent{Status: status}
+	}
+	return &redacted
+}
+
+// redactStatus keeps only what's needed to count a status and match it
+// up with its copies from other servers.
+func redactStatus(status *mastodon.Status) *mastodon.Status {
+	return &mastodon.Status{
+		ID:         status.ID,
+		URI:        status.URI,
+		CreatedAt:  status.CreatedAt,
+		Visibility: status.Visibility,
+		Language:   status.Language,
+	}
+}
+
+// fetchInstanceRules gets an instance's rules. Servers too old to have
+// rules have none.
+func fetchInstanceRules(ctx context.Context, host string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+host+"/api/v1/instance/rules", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ratelimit.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching rules for %s: %s", host, resp.Status)
+	}
+
+	var rules []struct {
+		Text string `json:"text"`
+		Hint string `json:"hint"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("fetching rules for %s: %w", host, err)
+	}
+	texts := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		texts = append(texts, strings.TrimSpace(rule.Text+" "+rule.Hint))
+	}
+	return texts, nil
+}
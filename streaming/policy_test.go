@@ -0,0 +1,242 @@
+package streaming
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rules := map[string][]string{
+		"a.example":          {"Be nice"},
+		"nocrawl.example":    {"No scraping or crawling of this server"},
+		"noresearch.example": {"Be nice", "Researchers must ask first"},
+	}
+	// Both are appended to from the background fetches.
+	var mu sync.Mutex
+	var forbidden, fetched []string
+	policy := NewPolicy()
+	policy.Rules = func(ctx context.Context, host string) ([]string, error) {
+		mu.Lock()
+		fetched = append(fetched, host)
+		mu.Unlock()
+		if host == "down.example" {
+			return nil, errors.New("connection refused")
+		}
+		return rules[host], nil
+	}
+	policy.OnForbidden = func(server string) {
+		mu.Lock()
+		forbidden = append(forbidden, server)
+		mu.Unlock()
+	}
+
+	no := false
+	yes := true
+	withAccount := func(envelope *Envelope, account mastodon.Account, privacy *AccountPrivacy) *Envelope {
+		envelope.Event.(*mastodon.UpdateEvent).Status.Account = account
+		if privacy != nil {
+			envelope.Accounts = map[string]AccountPrivacy{account.URL: *privacy}
+		}
+		return envelope
+	}
+
+	// Until a server's rules are in, what it sends is let through unchecked.
+	servers := []string{"https://a.example", "https://nocrawl.example", "https://noresearch.example", "https://down.example"}
+	for _, server := range servers {
+		require.NotNil(t, policy.Apply(ctx, updateFrom(server, server+"/0")))
+	}
+	policy.fetches.Wait()
+	require.ElementsMatch(t, []string{"a.example", "nocrawl.example", "noresearch.example", "down.example"}, fetched)
+	require.ElementsMatch(t, []string{"https://nocrawl.example", "https://noresearch.example"}, forbidden)
+
+	in := make(chan *Envelope)
+	out := policy.Run(ctx, in)
+	go func() {
+		defer close(in)
+		in <- updateFrom("https://a.example", "https://a.example/1")
+		in <- updateFrom("https://nocrawl.example", "https://nocrawl.example/1")
+		in <- updateFrom("https://nocrawl.example", "https://a.example/2")
+		in <- updateFrom("https://a.example", "https://noresearch.example/3")
+		in <- updateFrom("https://a.example", "https://down.example/4")
+		in <- withAccount(updateFrom("https://a.example", "https://a.example/5"),
+			mastodon.Account{URL: "https://a.example/@quiet"}, &AccountPrivacy{Noindex: &yes})
+		in <- withAccount(updateFrom("https://a.example", "https://a.example/6"),
+			mastodon.Account{URL: "https://a.example/@hidden"}, &AccountPrivacy{Discoverable: &no})
+		in <- withAccount(updateFrom("https://a.example", "https://a.example/7"),
+			mastodon.Account{URL: "https://a.example/@bot", Note: `<p>hi <a href="https://a.example/tags/nobot">#<span>NoBot</span></a></p>`}, nil)
+		in <- withAccount(updateFrom("https://a.example", "https://a.example/8"),
+			mastodon.Account{URL: "https://a.example/@open"}, &AccountPrivacy{Discoverable: &yes})
+		in <- &Envelope{Server: "https://a.example", Event: &mastodon.DeleteEvent{ID: "9"}}
+		in <- updateFrom("https://a.example", "https://elsewhere.example/10")
+	}()
+
+	var uris []string
+	for envelope := range out {
+		if status := statusOf(envelope.Event); status != nil {
+			uris = append(uris, status.URI)
+		} else {
+			uris = append(uris, "delete")
+		}
+	}
+
+	require.Equal(t, []string{"https://a.example/1", "https://down.example/4", "https://a.example/8", "delete", "https://elsewhere.example/10"}, uris)
+	require.Len(t, forbidden, 2)
+	// Origins aren't fetched, only looked up.
+	require.Len(t, fetched, 4)
+	require.Equal(t, PolicyStats{
+		Passed:    9,
+		Unchecked: 4,
+		Dropped: map[OptOutReason]int64{
+			OptOutServerRules:     2,
+			OptOutOriginRules:     1,
+			OptOutNoindex:         1,
+			OptOutNotDiscoverable: 1,
+			OptOutBioTag:          1,
+		},
+		Redacted: map[OptOutReason]int64{},
+	}, policy.Stats())
+
+	rule, ok := policy.ForbiddingRule("https://noresearch.example")
+	require.True(t, ok)
+	require.Equal(t, "Researchers must ask first", rule)
+}
+
+func TestPolicy_Excluded(t *testing.T) {
+	var fetched []string
+	policy := NewPolicy()
+	policy.Rules = func(ctx context.Context, host string) ([]string, error) {
+		fetched = append(fetched, host)
+		return nil, nil
+	}
+	policy.Excluded = func(host string) bool { return host == "optedout.example" }
+
+	ctx := context.Background()
+	require.Nil(t, policy.Apply(ctx, updateFrom("https://optedout.example", "https://optedout.example/1")))
+	require.Nil(t, policy.Apply(ctx, updateFrom("https://a.example", "https://optedout.example/2")))
+	require.NotNil(t, policy.Apply(ctx, updateFrom("https://a.example", "https://a.example/3")))
+	policy.fetches.Wait()
+
+	require.Equal(t, []string{"a.example"}, fetched)
+	require.Equal(t, map[OptOutReason]int64{OptOutListed: 2}, policy.Stats().Dropped)
+}
+
+func TestPolicy_Wait(t *testing.T) {
+	policy := NewPolicy()
+	policy.Rules = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"No crawling"}, nil
+	}
+
+	_, ok := policy.ForbiddingRule("https://a.example")
+	require.False(t, ok)
+	require.NoError(t, policy.Wait(context.Background(), "https://a.example"))
+	rule, ok := policy.ForbiddingRule("https://a.example")
+	require.True(t, ok)
+	require.Equal(t, "No crawling", rule)
+}
+
+func TestPolicy_WaitFails(t *testing.T) {
+	fetchErr := errors.New("503 Service Unavailable")
+	policy := NewPolicy()
+	policy.RulesTTL = 0
+	policy.Excluded = func(host string) bool { return host == "quiet.example" }
+	policy.Rules = func(ctx context.Context, host string) ([]string, error) {
+		if host == "a.example" {
+			return []string{"No crawling"}, nil
+		}
+		return nil, fetchErr
+	}
+
+	// Rules we couldn't get aren't rules that allow collection.
+	require.ErrorIs(t, policy.Wait(context.Background(), "https://b.example"), fetchErr)
+	_, ok := policy.ForbiddingRule("https://b.example")
+	require.False(t, ok)
+
+	require.ErrorContains(t, policy.Wait(context.Background(), "https://quiet.example"), "opt-out list")
+
+	// Rules we already know still stand when a refresh fails.
+	require.NoError(t, policy.Wait(context.Background(), "https://a.example"))
+	policy.Rules = func(ctx context.Context, host string) ([]string, error) { return nil, fetchErr }
+	require.NoError(t, policy.Wait(context.Background(), "https://a.example"))
+	_, ok = policy.ForbiddingRule("https://a.example")
+	require.True(t, ok)
+}
+
+func TestPolicy_Redact(t *testing.T) {
+	policy := NewPolicy()
+	policy.Action = OptOutRedact
+	policy.Rules = func(ctx context.Context, host string) ([]string, error) { return nil, nil }
+
+	no := false
+	booster := mastodon.Account{URL: "https://a.example/@booster", Note: "hello"}
+	author := mastodon.Account{URL: "https://b.example/@hidden", DisplayName: "Hidden"}
+	original := &mastodon.Status{ID: "2", URI: "https://b.example/2", Account: author, Content: "secret"}
+	envelope := &Envelope{
+		Server: "https://a.example",
+		Event: &mastodon.UpdateEvent{Status: &mastodon.Status{
+			ID: "1", URI: "https://a.example/1", Account: booster, Reblog: original,
+		}},
+		Accounts: map[string]AccountPrivacy{author.URL: {Discoverable: &no}},
+	}
+
+	kept := policy.Apply(context.Background(), envelope)
+	require.NotNil(t, kept)
+	status := statusOf(kept.Event)
+	require.Equal(t, booster, status.Account)
+	require.Equal(t, &mastodon.Status{ID: "2", URI: "https://b.example/2"}, status.Reblog)
+	require.Nil(t, kept.Accounts)
+	require.Equal(t, "secret", original.Content, "the original envelope must not be touched")
+	require.Equal(t, map[OptOutReason]int64{OptOutNotDiscoverable: 1}, policy.Stats().Redacted)
+}
+
+func TestDecodeStreamEvent_AccountPrivacy(t *testing.T) {
+	event, ok, err := decodeStreamEvent(TypeUpdate, `{"id":"1","account":{"url":"https://a.example/@x","noindex":true,"discoverable":null},"reblog":{"id":"2","account":{"url":"https://b.example/@y","discoverable":false}}}`)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	annotated, ok := event.(*annotatedEvent)
+	require.True(t, ok)
+	require.Equal(t, mastodon.ID("1"), annotated.event.(*mastodon.UpdateEvent).Status.ID)
+
+	yes, no := true, false
+	require.Equal(t, map[string]AccountPrivacy{
+		"https://a.example/@x": {Noindex: &yes},
+		"https://b.example/@y": {Discoverable: &no},
+	}, annotated.accounts)
+}
+
+func Test_forbidsCollection(t *testing.T) {
+	for _, rule := range []string{
+		"No scraping",
+		"No scraping or crawling of this server",
+		"Not for research",
+		"Posts may not be used for research purposes without consent",
+		"Researchers must ask first",
+		"No data mining",
+		"No datamining or harvesting of posts",
+		"Do not archive posts or profiles",
+		"Content here may not be used for AI training",
+	} {
+		require.True(t, forbidsCollection.MatchString(rule), rule)
+	}
+
+	// Moderation rules that happen to use the same words.
+	for _, rule := range []string{
+		"Do your own research before posting medical claims",
+		"We archive reports for moderation",
+		"Research your sources and link them",
+		"Archived threads are read-only",
+		"No doxxing or harvesting personal information",
+		"Be nice",
+	} {
+		require.False(t, forbidsCollection.MatchString(rule), rule)
+	}
+}
@@ -0,0 +1,124 @@
+package streaming
+
+import (
+	"context"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// PollingTransport follows a stream by polling the matching timeline with
+// since_id, for servers that don't allow streaming or sit behind proxies
+// that cut long responses short. Only new statuses can be seen this way;
+// deletes, edits and notifications are never delivered.
+//
+// The interval adapts to the server: it drops to MinInterval whenever a
+// full page comes back, since statuses may have been missed, and doubles up
+// to MaxInterval whenever nothing does. An unset MinInterval is taken from
+// DefaultPollingTransport, and a MaxInterval below it is raised to it, so
+// that polling never runs in a tight loop.
+type PollingTransport struct {
+	MinInterval time.Duration
+	MaxInterval time.Duration
+
+	// Limit is the page size asked for. Mastodon allows at most 40.
+	Limit int64
+}
+
+var DefaultPollingTransport = &PollingTransport{
+	MinInterval: 15 * time.Second,
+	MaxInterval: 5 * time.Minute,
+	Limit:       40,
+}
+
+func (p *PollingTransport) String() string {
+	return "polling"
+}
+
+// Open fetches the newest page to find where to start from, so errors come
+// back straight away as they would from the streaming API. Statuses already
+// on that page aren't sent.
+func (p *PollingTransport) Open(ctx context.Context, client *mastodon.Client, spec StreamSpec) (<-chan mastodon.Event, error) {
+	statuses, err := p.fetch(ctx, client, spec, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var sinceID mastodon.ID
+	if len(statuses) > 0 {
+		sinceID = statuses[0].ID
+	}
+
+	ch := make(chan mastodon.Event)
+	go func() {
+		defer close(ch)
+
+		minInterval, maxInterval := p.intervals()
+		interval := minInterval
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+
+			statuses, err := p.fetch(ctx, client, spec, sinceID)
+			if err != nil {
+				select {
+				case ch <- &errorEvent{err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			// Pages are newest first.
+			for i := len(statuses) - 1; i >= 0; i-- {
+				var event mastodon.Event = &mastodon.UpdateEvent{Status: statuses[i].Status}
+				if len(statuses[i].accounts) > 0 {
+					event = &annotatedEvent{event: event, accounts: statuses[i].accounts}
+				}
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if len(statuses) > 0 {
+				sinceID = statuses[0].ID
+			}
+
+			switch {
+			case p.Limit > 0 && int64(len(statuses)) >= p.Limit:
+				interval = minInterval
+			case len(statuses) == 0:
+				interval *= 2
+				if interval > maxInterval {
+					interval = maxInterval
+				}
+			}
+			timer.Reset(interval)
+		}
+	}()
+
+	return ch, nil
+}
+
+// intervals returns the bounds of the polling interval with the floor
+// applied.
+func (p *PollingTransport) intervals() (time.Duration, time.Duration) {
+	minInterval, maxInterval := p.MinInterval, p.MaxInterval
+	if minInterval <= 0 {
+		minInterval = DefaultPollingTransport.MinInterval
+	}
+	if maxInterval < minInterval {
+		maxInterval = minInterval
+	}
+	return minInterval, maxInterval
+}
+
+func (p *PollingTransport) fetch(ctx context.Context, client *mastodon.Client, spec StreamSpec, sinceID mastodon.ID) ([]timelineStatus, error) {
+	return fetchTimeline(ctx, client, spec, mastodon.Pagination{SinceID: sinceID, Limit: p.Limit})
+}
@@ -0,0 +1,101 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMux_pollingFallback(t *testing.T) {
+	var mu sync.Mutex
+	var sinceIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/api/v1/streaming/") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, "/api/v1/timelines/public", r.URL.Path)
+		require.NotEmpty(t, r.URL.Query().Get("local"))
+
+		mu.Lock()
+		sinceID := r.URL.Query().Get("since_id")
+		sinceIDs = append(sinceIDs, sinceID)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch sinceID {
+		case "":
+			_, _ = fmt.Fprint(w, `[{"id":"2"},{"id":"1"}]`)
+		case "2":
+			_, _ = fmt.Fprint(w, `[{"id":"4","account":{"url":"https://example.com/@quiet","noindex":true}},{"id":"3"}]`)
+		default:
+			_, _ = fmt.Fprint(w, `[]`)
+		}
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	mux.Fallback = &PollingTransport{MinInterval: 10 * time.Millisecond, MaxInterval: 50 * time.Millisecond, Limit: 40}
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, errs := mux.StreamPublic(ctx, true)
+
+	select {
+	case streamErr := <-errs:
+		require.Equal(t, ReasonFallback, streamErr.Reason)
+		require.Equal(t, "sse", streamErr.Transport)
+		require.Equal(t, FailurePermanent, streamErr.Kind)
+	case <-ctx.Done():
+		t.Fatal("never fell back")
+	}
+
+	yes := true
+	for _, want := range []mastodon.ID{"3", "4"} {
+		select {
+		case envelope := <-events:
+			require.Equal(t, want, envelope.Event.(*mastodon.UpdateEvent).Status.ID)
+			require.Equal(t, "polling", envelope.Transport)
+			if want == "4" {
+				// What go-mastodon doesn't decode survives polling too.
+				require.Equal(t, map[string]AccountPrivacy{"https://example.com/@quiet": {Noindex: &yes}}, envelope.Accounts)
+			}
+		case <-ctx.Done():
+			t.Fatal("never received a polled status")
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(sinceIDs) >= 3 && sinceIDs[len(sinceIDs)-1] == "4"
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func TestPollingTransport_intervals(t *testing.T) {
+	for _, tc := range []struct {
+		p        PollingTransport
+		min, max time.Duration
+	}{
+		{PollingTransport{MinInterval: time.Second, MaxInterval: time.Minute}, time.Second, time.Minute},
+		// Zero would otherwise poll as fast as the server answers, forever.
+		{PollingTransport{}, DefaultPollingTransport.MinInterval, DefaultPollingTransport.MinInterval},
+		{PollingTransport{MinInterval: -time.Second, MaxInterval: time.Hour}, DefaultPollingTransport.MinInterval, time.Hour},
+		{PollingTransport{MinInterval: time.Minute, MaxInterval: time.Second}, time.Minute, time.Minute},
+	} {
+		minInterval, maxInterval := tc.p.intervals()
+		require.Equal(t, tc.min, minInterval)
+		require.Equal(t, tc.max, maxInterval)
+	}
+}
@@ -0,0 +1,78 @@
+package streaming
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how a server's stream is reconnected after it fails.
+type RetryPolicy struct {
+	// MaxRetries is the number of consecutive failures tolerated before a
+	// server is given up on. Negative means retry forever.
+	MaxRetries int
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Jitter is the fraction of each backoff that is randomized, from 0 (none)
+	// to 1 (anywhere between zero and the full backoff).
+	Jitter float64
+}
+
+// DefaultRetryPolicy is deliberately slow. We would much rather miss a few
+// minutes of a server than hammer it.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries:     10,
+	InitialBackoff: 5 * time.Second,
+	MaxBackoff:     10 * time.Minute,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+// GivesUp reports whether the given (1-indexed) consecutive failure is the
+// last one.
+func (p RetryPolicy) GivesUp(attempt int) bool {
+	return p.MaxRetries >= 0 && attempt > p.MaxRetries
+}
+
+// Backoff returns how long to wait after the given (1-indexed) consecutive
+// failure before reconnecting.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		backoff -= backoff * jitter * randFloat64()
+	}
+
+	return time.Duration(backoff)
+}
+
+var (
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	jitterLock sync.Mutex
+)
+
+func randFloat64() float64 {
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return jitterRand.Float64()
+}
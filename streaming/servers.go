@@ -0,0 +1,171 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// Servers returns the names of every server in the Mux, sorted.
+func (m *Mux) Servers() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	servers := make([]string, 0, len(m.clients))
+	for server := range m.clients {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+// HasServer reports whether a server is in the Mux.
+func (m *Mux) HasServer(serverName string) bool {
+	m.Lock()
+	defer m.Unlock()
+	_, ok := m.clients[serverName]
+	return ok
+}
+
+// AddServer adds a server to the Mux and starts streaming it on every
+// running subscription, even if it was removed before.
+func (m *Mux) AddServer(serverName string, app *mastodon.Application) error {
+	return m.addServer(serverName, app, "", true)
+}
+
+// addServer adds a server unless it's already there or, without force, it
+// was removed.
+func (m *Mux) addServer(serverName string, app *mastodon.Application, token string, force bool) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.clients[serverName]; ok {
+		return fmt.Errorf("server %s is already in the mux", serverName)
+	}
+	if m.removed[serverName] && !force {
+		return fmt.Errorf("server %s was removed from the mux", serverName)
+	}
+	delete(m.removed, serverName)
+
+	m.apps[serverName] = app
+	m.clients[serverName] = newClient(serverName, app)
+	m.clients[serverName].Config.AccessToken = token
+	m.tracker.add(serverName)
+
+	for sub := range m.subs {
+		m.startLocked(sub, serverName)
+	}
+
+	return nil
+}
+
+// RemoveServer stops streaming a server and forgets about it, including its
+// breaker and status. WatchStore won't add it back; only AddServer does.
+func (m *Mux) RemoveServer(serverName string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.clients[serverName]; !ok {
+		return fmt.Errorf("server %s is not in the mux", serverName)
+	}
+
+	for sub := range m.subs {
+		for _, cancel := range sub.cancels[serverName] {
+			cancel()
+		}
+		delete(sub.cancels, serverName)
+	}
+
+	delete(m.apps, serverName)
+	delete(m.clients, serverName)
+	delete(m.breakers, serverName)
+	m.tracker.remove(serverName)
+	if m.removed == nil {
+		m.removed = make(map[string]bool)
+	}
+	m.removed[serverName] = true
+
+	return nil
+}
+
+// StoreUpdate is sent by WatchStore for every server it adds, or with Err
+// set when the store couldn't be read.
+type StoreUpdate struct {
+	Server string
+	Err    error
+}
+
+func (u StoreUpdate) MarshalJSON() ([]byte, error) {
+	var errMsg string
+	if u.Err != nil {
+		errMsg = u.Err.Error()
+	}
+	return json.Marshal(struct {
+		Server string `json:"server,omitempty"`
+		Err    string `json:"error,omitempty"`
+	}{u.Server, errMsg})
+}
+
+// WatchStore polls the store every interval and adds any servers the Mux
+// doesn't have yet, e.g. ones registered by a concurrent register-all.
+// Servers taken out with RemoveServer stay out. The returned channel is
+// closed once ctx is done.
+func (m *Mux) WatchStore(ctx context.Context, store accounts.Store, interval time.Duration) <-chan StoreUpdate {
+	ch := make(chan StoreUpdate)
+
+	tokens, _ := store.(accounts.TokenStore)
+
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			// A credentials file that is still being written fails to parse
+			// so errors here are usually gone by the next tick.
+			apps, err := store.GetAll()
+			if err != nil {
+				select {
+				case ch <- StoreUpdate{Err: err}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			for server, app := range apps {
+				if m.HasServer(server) {
+					continue
+				}
+				var token string
+				if tokens != nil {
+					token, _ = tokens.GetAccessToken(server)
+				}
+				if err := m.addServer(server, app, token, false); err != nil {
+					continue
+				}
+
+				select {
+				case ch <- StoreUpdate{Server: server}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,320 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// sseEvent is one event from a text/event-stream.
+type sseEvent struct {
+	Type string
+	Data string
+	ID   string
+
+	// Comment is set, and nothing else, for a comment line such as
+	// Mastodon's ":thump" heartbeat.
+	Comment bool
+}
+
+// sseParser reads events from a text/event-stream as the HTML spec says to,
+// except that it refuses rather than repairs: invalid UTF-8, lines longer
+// than maxLineSize and events bigger than that are errors.
+type sseParser struct {
+	r       *bufio.Reader
+	started bool
+	lastID  string
+
+	line []byte
+}
+
+func newSSEParser(r io.Reader) *sseParser {
+	return &sseParser{r: bufio.NewReader(r)}
+}
+
+var (
+	errSSELineTooLong = errors.New("sse: line too long")
+	errSSEEventTooBig = errors.New("sse: event too big")
+	errSSEInvalidUTF8 = errors.New("sse: invalid utf-8")
+)
+
+// Next returns the next event, or a Comment event for a comment between
+// events. Events without data are skipped. At the end of the stream it
+// returns io.EOF, dropping any event that wasn't finished with a blank line.
+func (p *sseParser) Next() (*sseEvent, error) {
+	var event sseEvent
+	var data bytes.Buffer
+	hasData := false
+
+	for {
+		line, err := p.readLine()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 {
+			if !hasData {
+				event = sseEvent{}
+				continue
+			}
+			event.Data = data.String()
+			event.ID = p.lastID
+			return &event, nil
+		}
+		if line[0] == ':' {
+			// Comments between events are how servers show they're still
+			// there, so they're passed on. Within an event they're noise.
+			if !hasData && event.Type == "" {
+				return &sseEvent{Comment: true}, nil
+			}
+			continue
+		}
+
+		field, value := line, []byte(nil)
+		if i := bytes.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], line[i+1:]
+			value = bytes.TrimPrefix(value, []byte(" "))
+		}
+
+		switch string(field) {
+		case "event":
+			event.Type = string(value)
+		case "data":
+			if hasData {
+				data.WriteByte('\n')
+			}
+			hasData = true
+			if data.Len()+len(value) > maxLineSize {
+				return nil, errSSEEventTooBig
+			}
+			data.Write(value)
+		case "id":
+			// Ids with NUL are ignored.
+			if bytes.IndexByte(value, 0) < 0 {
+				p.lastID = string(value)
+			}
+		default:
+			// retry and unknown fields have nothing to tell us.
+		}
+	}
+}
+
+// readLine returns the next line without its CR, LF or CRLF ending. The
+// slice is only valid until the next call.
+func (p *sseParser) readLine() ([]byte, error) {
+	p.line = p.line[:0]
+	for {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(p.line) > 0 {
+				// An unterminated line can't finish an event.
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+
+		switch b {
+		case '\n':
+			return p.checkLine()
+		case '\r':
+			if next, err := p.r.Peek(1); err == nil && next[0] == '\n' {
+				_, _ = p.r.ReadByte()
+			}
+			return p.checkLine()
+		}
+
+		if len(p.line) >= maxLineSize {
+			return nil, errSSELineTooLong
+		}
+		p.line = append(p.line, b)
+	}
+}
+
+func (p *sseParser) checkLine() ([]byte, error) {
+	line := p.line
+	if !p.started {
+		p.started = true
+		line = bytes.TrimPrefix(line, []byte("\xef\xbb\xbf"))
+	}
+	if !utf8.Valid(line) {
+		return nil, fmt.Errorf("%w: %q", errSSEInvalidUTF8, line)
+	}
+	return line, nil
+}
+
+// HTTPError is a request that didn't get a 200, with everything the server
+// said about why.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	Status     string
+	Header     http.Header
+
+	// Body is the start of the response body.
+	Body string
+}
+
+// maxErrorBody bounds how much of an error response is kept.
+const maxErrorBody = 4096
+
+func (e *HTTPError) Error() string {
+	body := strings.TrimSpace(e.Body)
+	if body == "" {
+		return fmt.Sprintf("%s: %s", e.URL, e.Status)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.URL, e.Status, body)
+}
+
+func newHTTPError(resp *http.Response) *HTTPError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &HTTPError{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Header:     resp.Header,
+		Body:       string(body),
+	}
+}
+
+// SSETransport follows streams with our own server-sent events client. It
+// makes exactly one request per Open and never retries on its own; every
+// failure, including the server hanging up, is reported and left to the
+// Mux.
+var SSETransport Transport = sseTransport{}
+
+type sseTransport struct{}
+
+func (sseTransport) String() string {
+	return "sse"
+}
+
+func (sseTransport) Open(ctx context.Context, client *mastodon.Client, spec StreamSpec) (<-chan mastodon.Event, error) {
+	endpoint, err := sseEndpoint(client.Config.Server, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Cache-Control", "no-cache")
+	if client.Config.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+client.Config.AccessToken)
+	}
+
+	// The client's timeout, if any, is for API calls, not streams.
+	httpClient := client.Client
+	httpClient.Timeout = 0
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+		return nil, newHTTPError(resp)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/event-stream" {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("%s: unexpected content type %q", endpoint, resp.Header.Get("Content-Type"))
+	}
+
+	ch := make(chan mastodon.Event)
+	go func() {
+		defer close(ch)
+		defer func() { _ = resp.Body.Close() }()
+
+		parser := newSSEParser(resp.Body)
+		for {
+			sse, err := parser.Next()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if err == io.EOF {
+					err = errors.New("stream closed by server")
+				}
+				select {
+				case ch <- &errorEvent{err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			if sse.Comment {
+				select {
+				case ch <- &heartbeatEvent{}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			event, ok, err := decodeStreamEvent(sse.Type, sse.Data)
+			if err != nil {
+				err = fmt.Errorf("bad %s event: %w", sse.Type, err)
+				select {
+				case ch <- &errorEvent{err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+			if !ok {
+				continue
+			}
+
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
+
+func sseEndpoint(server string, spec StreamSpec) (string, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	var path string
+	switch spec.Kind {
+	case StreamLocal:
+		path = "public/local"
+	case StreamFederated:
+		path = "public"
+	case StreamHashtag:
+		path = "hashtag"
+		params.Set("tag", spec.Tag)
+	case StreamHashtagLocal:
+		path = "hashtag/local"
+		params.Set("tag", spec.Tag)
+	case StreamList:
+		path = "list"
+		params.Set("list", spec.List)
+	case StreamUser:
+		path = "user"
+	default:
+		return "", fmt.Errorf("unknown stream kind %q", spec.Kind)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/streaming/" + path
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
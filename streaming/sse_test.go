@@ -0,0 +1,134 @@
+package streaming
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func parseAllSSE(data []byte) ([]*sseEvent, error) {
+	parser := newSSEParser(bytes.NewReader(data))
+	var events []*sseEvent
+	for {
+		event, err := parser.Next()
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+func TestSSEParser(t *testing.T) {
+	events, err := parseAllSSE([]byte("\xef\xbb\xbf:thump\n" +
+		"event: update\r\ndata: {\"id\":\"1\"}\r\n\r\n" +
+		"event: delete\rdata:2\rid: 7\r\r" +
+		"data: multi\ndata:line\n\n" +
+		"event: ignored\n\n" +
+		"retry: 1000\nfield-only\ndata\n\n" +
+		"event: unfinished\ndata: x\n"))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, []*sseEvent{
+		{Comment: true},
+		{Type: "update", Data: `{"id":"1"}`},
+		{Type: "delete", Data: "2", ID: "7"},
+		{Data: "multi\nline", ID: "7"},
+		{Data: "", ID: "7"},
+	}, events)
+
+	_, err = parseAllSSE([]byte("data: \xff\n\n"))
+	require.True(t, errors.Is(err, errSSEInvalidUTF8))
+
+	_, err = parseAllSSE([]byte("data: cut off"))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func FuzzParseSSE(f *testing.F) {
+	f.Add([]byte("event: update\ndata: {}\n\n"))
+	f.Add([]byte(":thump\r\n\r\ndata: a\rdata: b\r\r"))
+	f.Add([]byte("\xef\xbb\xbfid: 1\ndata\n\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		events, _ := parseAllSSE(data)
+
+		// Whatever came out has to survive being written and read again.
+		var buf bytes.Buffer
+		for _, event := range events {
+			if event.Comment {
+				buf.WriteString(":\n")
+				continue
+			}
+			if !utf8.ValidString(event.Type) || !utf8.ValidString(event.Data) {
+				t.Fatalf("invalid utf-8 in %#v", event)
+			}
+			if strings.ContainsAny(event.Type, "\r\n") || strings.ContainsAny(event.ID, "\r\n\x00") {
+				t.Fatalf("line break in %#v", event)
+			}
+			fmt.Fprintf(&buf, "id: %s\nevent: %s\n", event.ID, event.Type)
+			for _, line := range strings.Split(event.Data, "\n") {
+				fmt.Fprintf(&buf, "data: %s\n", line)
+			}
+			buf.WriteString("\n")
+		}
+
+		again, err := parseAllSSE(buf.Bytes())
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, events, again)
+	})
+}
+
+func TestSSETransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/streaming/hashtag/local":
+			require.Equal(t, "fediverse", r.URL.Query().Get("tag"))
+			require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+			_, _ = fmt.Fprint(w, ":)\n\nevent: update\ndata: {\"id\":\"1\"}\n\nevent: delete\ndata: 2\n\n")
+		case "/api/v1/streaming/public":
+			w.Header().Set("Content-Type", "text/html")
+		default:
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+			_, _ = fmt.Fprint(w, `{"error":"Too many requests"}`)
+		}
+	}))
+	defer server.Close()
+
+	client := mastodon.NewClient(&mastodon.Config{Server: server.URL, AccessToken: "token"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, err := SSETransport.Open(ctx, client, HashtagStream("fediverse", true))
+	require.NoError(t, err)
+	require.IsType(t, &heartbeatEvent{}, <-events)
+	require.Equal(t, mastodon.ID("1"), (<-events).(*mastodon.UpdateEvent).Status.ID)
+	require.Equal(t, mastodon.ID("2"), (<-events).(*mastodon.DeleteEvent).ID)
+
+	// Hanging up is an error, not a silent reconnect.
+	last := <-events
+	require.EqualError(t, last.(*errorEvent).err, "stream closed by server")
+	_, ok := <-events
+	require.False(t, ok)
+
+	_, err = SSETransport.Open(ctx, client, PublicStream(false))
+	require.ErrorContains(t, err, "unexpected content type")
+
+	_, err = SSETransport.Open(ctx, client, PublicStream(true))
+	var httpErr *HTTPError
+	require.True(t, errors.As(err, &httpErr))
+	require.Equal(t, http.StatusTooManyRequests, httpErr.StatusCode)
+	require.Equal(t, "120", httpErr.Header.Get("Retry-After"))
+	require.Contains(t, httpErr.Body, "Too many requests")
+	require.Equal(t, FailureThrottled, ClassifyError(err))
+}
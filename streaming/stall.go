@@ -0,0 +1,78 @@
+package streaming
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStalled is returned (wrapped) when a stream stays open but goes quiet
+// for longer than its idle timeout.
+var ErrStalled = errors.New("stream stalled")
+
+// StallPolicy decides how long a stream may stay silent before it is torn
+// down and reconnected. Over SSE, Mastodon's ":thump" heartbeats keep it
+// alive too, so there a stall means the connection itself went away. Other
+// transports only have the events, and no events at all is perfectly normal
+// for the local timeline of a small server. Hence the adaptive timeout.
+type StallPolicy struct {
+	// MaxIdle caps how long a stream may be silent. Zero disables the
+	// watchdog.
+	MaxIdle time.Duration
+
+	// If Factor is positive, once a stream has delivered enough events the
+	// timeout becomes Factor times its average gap between events, clamped
+	// to [MinIdle, MaxIdle].
+	Factor  float64
+	MinIdle time.Duration
+}
+
+var DefaultStallPolicy = StallPolicy{
+	MaxIdle: 30 * time.Minute,
+	Factor:  20,
+	MinIdle: 2 * time.Minute,
+}
+
+// stallMinSamples is how many gaps we want to have seen before trusting the
+// average.
+const stallMinSamples = 20
+
+// stallMeter tracks a server's average gap between events. It is kept for
+// the life of the stream so the estimate survives reconnects.
+type stallMeter struct {
+	policy  StallPolicy
+	meanGap time.Duration
+	samples int
+}
+
+// observe folds a gap between two events into the moving average.
+func (m *stallMeter) observe(gap time.Duration) {
+	m.samples++
+	if m.samples == 1 {
+		m.meanGap = gap
+		return
+	}
+
+	// Exponentially weighted so it follows the daily cycle.
+	const alpha = 0.05
+	m.meanGap = time.Duration(alpha*float64(gap) + (1-alpha)*float64(m.meanGap))
+}
+
+// timeout returns the current idle timeout, or zero if there is none.
+func (m *stallMeter) timeout() time.Duration {
+	p := m.policy
+	if p.MaxIdle <= 0 {
+		return 0
+	}
+	if p.Factor <= 0 || m.samples < stallMinSamples {
+		return p.MaxIdle
+	}
+
+	timeout := time.Duration(p.Factor * float64(m.meanGap))
+	if timeout < p.MinIdle {
+		timeout = p.MinIdle
+	}
+	if timeout > p.MaxIdle {
+		timeout = p.MaxIdle
+	}
+	return timeout
+}
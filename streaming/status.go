@@ -0,0 +1,270 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ServerState is where a server's stream is in its lifecycle.
+type ServerState int
+
+const (
+	// StateIdle servers are registered but not being streamed.
+	StateIdle ServerState = iota
+	// StateConnecting servers have a request in flight but haven't sent
+	// anything yet.
+	StateConnecting
+	// StateConnected servers are delivering events.
+	StateConnected
+	// StateRetrying servers failed and are waiting to reconnect.
+	StateRetrying
+	// StateDead servers failed and have been given up on.
+	StateDead
+)
+
+func (s ServerState) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateRetrying:
+		return "retrying"
+	case StateDead:
+		return "dead"
+	default:
+		return fmt.Sprintf("ServerState(%d)", int(s))
+	}
+}
+
+func (s ServerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// ServerStatus is a snapshot of a single server. A server with several
+// streams takes the state of its healthiest one; Streams has the rest.
+type ServerStatus struct {
+	Server      string                 `json:"server"`
+	State       ServerState            `json:"state"`
+	Streams     map[string]ServerState `json:"streams,omitempty"`
+	ConnectedAt time.Time              `json:"connected_at"`
+	LastEventAt time.Time              `json:"last_event_at"`
+	Events      int64                  `json:"events"`
+	Errors      int64                  `json:"errors"`
+	Dropped     int64                  `json:"dropped"`
+	LastError   string                 `json:"last_error,omitempty"`
+}
+
+// StateChange is sent on the change feed whenever a server moves between
+// states. Stream is the stream whose change caused it.
+type StateChange struct {
+	Server string      `json:"server"`
+	Stream string      `json:"stream,omitempty"`
+	From   ServerState `json:"from"`
+	To     ServerState `json:"to"`
+	At     time.Time   `json:"at"`
+	Err    string      `json:"error,omitempty"`
+}
+
+// stateRank orders states from least to most healthy for picking a
+// server's overall state.
+var stateRank = map[ServerState]int{
+	StateIdle:       0,
+	StateDead:       1,
+	StateRetrying:   2,
+	StateConnecting: 3,
+	StateConnected:  4,
+}
+
+// stateChangeBuffer is how many changes a slow subscriber can fall behind
+// before it starts missing them. Streams never wait on subscribers.
+const stateChangeBuffer = 256
+
+// statusTracker keeps the live status of every server in a Mux. All methods
+// are safe to call on a nil tracker so streams can run without one.
+type statusTracker struct {
+	servers     map[string]*ServerStatus
+	subscribers map[chan StateChange]struct{}
+
+	sync.Mutex
+}
+
+func newStatusTracker() *statusTracker {
+	return &statusTracker{
+		servers:     make(map[string]*ServerStatus),
+		subscribers: make(map[chan StateChange]struct{}),
+	}
+}
+
+// add registers a server as idle if it isn't known yet.
+func (t *statusTracker) add(server string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.servers[server]; !ok {
+		t.servers[server] = &ServerStatus{
+			Server:  server,
+			State:   StateIdle,
+			Streams: make(map[string]ServerState),
+		}
+	}
+}
+
+// remove forgets a server entirely.
+func (t *statusTracker) remove(server string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	delete(t.servers, server)
+}
+
+// setState moves one of a server's streams to a new state. Streams that go
+// idle are forgotten.
+func (t *statusTracker) setState(server, stream string, state ServerState, err error) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	// Streams of removed servers can still be winding down.
+	status, ok := t.servers[server]
+	if !ok {
+		return
+	}
+	now := time.Now()
+
+	change := StateChange{Server: server, Stream: stream, From: status.State, At: now}
+	if err != nil {
+		status.Errors++
+		status.LastError = err.Error()
+		change.Err = err.Error()
+	}
+
+	if state == StateIdle {
+		delete(status.Streams, stream)
+	} else {
+		status.Streams[stream] = state
+	}
+
+	overall := StateIdle
+	for _, streamState := range status.Streams {
+		if stateRank[streamState] > stateRank[overall] {
+			overall = streamState
+		}
+	}
+
+	if status.State == overall {
+		return
+	}
+	status.State = overall
+	if overall == StateConnected {
+		status.ConnectedAt = now
+	}
+
+	change.To = overall
+	for sub := range t.subscribers {
+		select {
+		case sub <- change:
+		default:
+		}
+	}
+}
+
+// event records a delivered event, marking the stream connected if this is
+// the first one since (re)connecting. go-mastodon doesn't tell us when the
+// response headers arrive so the first event is the best signal we have.
+func (t *statusTracker) event(server, stream string, at time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	status, ok := t.servers[server]
+	if !ok {
+		t.Unlock()
+		return
+	}
+	status.Events++
+	status.LastEventAt = at
+	connected := status.Streams[stream] == StateConnected
+	t.Unlock()
+
+	if !connected {
+		t.setState(server, stream, StateConnected, nil)
+	}
+}
+
+// drop records an event thrown away because a buffer was full.
+func (t *statusTracker) drop(server string) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if status, ok := t.servers[server]; ok {
+		status.Dropped++
+	}
+}
+
+func (t *statusTracker) snapshot() []ServerStatus {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+
+	statuses := make([]ServerStatus, 0, len(t.servers))
+	for _, status := range t.servers {
+		snapshot := *status
+		snapshot.Streams = make(map[string]ServerState, len(status.Streams))
+		for stream, state := range status.Streams {
+			snapshot.Streams[stream] = state
+		}
+		statuses = append(statuses, snapshot)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Server < statuses[j].Server
+	})
+	return statuses
+}
+
+func (t *statusTracker) subscribe(ctx context.Context) <-chan StateChange {
+	ch := make(chan StateChange, stateChangeBuffer)
+
+	t.Lock()
+	t.subscribers[ch] = struct{}{}
+	t.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		t.Lock()
+		delete(t.subscribers, ch)
+		t.Unlock()
+		close(ch)
+	}()
+
+	return ch
+}
+
+// Status returns a snapshot of every server's stream, sorted by server name.
+func (m *Mux) Status() []ServerStatus {
+	return m.tracker.snapshot()
+}
+
+// StateChanges returns a feed of server state transitions until ctx is done.
+// The feed is buffered but never blocks the streams, so a subscriber that
+// falls too far behind will miss changes; Status is always authoritative.
+func (m *Mux) StateChanges(ctx context.Context) <-chan StateChange {
+	return m.tracker.subscribe(ctx)
+}
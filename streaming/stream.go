@@ -0,0 +1,410 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// FailureReason says how a stream ended.
+type FailureReason string
+
+const (
+	// ReasonError means the server or the connection reported an error.
+	ReasonError FailureReason = "error"
+	// ReasonStalled means the stream went silent and we hung up on it.
+	ReasonStalled FailureReason = "stalled"
+	// ReasonCircuitOpen means the server wasn't tried because its breaker
+	// is open for good.
+	ReasonCircuitOpen FailureReason = "circuit-open"
+	// ReasonFallback means streaming kept failing so the stream is moving
+	// to the fallback transport.
+	ReasonFallback FailureReason = "fallback"
+	// ReasonBackfill means the stream reconnected but the gap before it
+	// couldn't be filled. The stream itself carries on.
+	ReasonBackfill FailureReason = "backfill"
+)
+
+// StreamError reports a failed connection to a server. If Retrying is set
+// the server will be reconnected at RetryAt, otherwise it has been given up.
+type StreamError struct {
+	Server    string        `json:"server"`
+	Stream    StreamSpec    `json:"stream"`
+	Transport string        `json:"transport"`
+	Err       error         `json:"error"`
+	Reason    FailureReason `json:"reason"`
+	Kind      FailureKind   `json:"kind"`
+	Attempt   int           `json:"attempt"`
+	Retrying  bool          `json:"retrying"`
+	RetryAt   time.Time     `json:"retry_at"`
+}
+
+func (e *StreamError) Error() string {
+	if e.Reason == ReasonBackfill {
+		return fmt.Sprintf("%s: backfill failed: %v (%s, streaming anyway)", e.Server, e.Err, e.Kind)
+	}
+	if e.Retrying {
+		return fmt.Sprintf("%s: %v (%s, attempt %d, retrying at %s)", e.Server, e.Err, e.Kind, e.Attempt, e.RetryAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s: %v (%s, attempt %d, giving up)", e.Server, e.Err, e.Kind, e.Attempt)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// MarshalJSON writes Err as its message since most errors marshal to "{}".
+func (e *StreamError) MarshalJSON() ([]byte, error) {
+	var errMsg string
+	if e.Err != nil {
+		errMsg = e.Err.Error()
+	}
+
+	var retryAt *time.Time
+	if e.Retrying {
+		retryAt = &e.RetryAt
+	}
+
+	return json.Marshal(struct {
+		Server    string        `json:"server"`
+		Stream    StreamSpec    `json:"stream"`
+		Transport string        `json:"transport"`
+		Err       string        `json:"error"`
+		Reason    FailureReason `json:"reason"`
+		Kind      FailureKind   `json:"kind"`
+		Attempt   int           `json:"attempt"`
+		Retrying  bool          `json:"retrying"`
+		RetryAt   *time.Time    `json:"retry_at,omitempty"`
+	}{e.Server, e.Stream, e.Transport, errMsg, e.Reason, e.Kind, e.Attempt, e.Retrying, retryAt})
+}
+
+// Envelope wraps the error as an error event so it can be archived
+// alongside the events it interrupted.
+func (e *StreamError) Envelope() *Envelope {
+	return &Envelope{
+		Server:     e.Server,
+		ReceivedAt: time.Now(),
+		Stream:     e.Stream,
+		Event:      &ErrorMessageEvent{Message: e.Error()},
+	}
+}
+
+// serverStream is everything needed to keep one server's stream going.
+type serverStream struct {
+	server string
+	client *mastodon.Client
+	spec   StreamSpec
+	retry  RetryPolicy
+
+	// transport is switched to fallback once it has failed fallbackAfter
+	// times in a row without receiving anything, or failed permanently.
+	transport     Transport
+	fallback      Transport
+	fallbackAfter int
+	onFallback    bool
+
+	// checkpoints, if set, are used to backfill the gap before every
+	// connection.
+	checkpoints *Checkpoints
+	backfill    BackfillPolicy
+
+	breaker *Breaker
+	buffer  BufferPolicy
+	tracker *statusTracker
+	stall   stallMeter
+
+	// conn counts connection attempts for envelopes.
+	conn uint64
+}
+
+// streamSafely streams from a single server until ctx is done,
+// reconnecting according to its retry policy whenever the stream fails. The
+// breaker decides which failures are worth retrying at all.
+func streamSafely(ctx context.Context, s *serverStream, ch chan *Envelope, errCh chan<- *StreamError) {
+	out := newOutbox(s.server, s.buffer, ch, s.tracker)
+	if s.checkpoints != nil {
+		// Only what actually made it out counts as seen, so whatever gets
+		// dropped is backfilled on the next connection. What gets saved for
+		// a restart is up to the sink, with Commit.
+		out.handed = func(envelope *Envelope) {
+			if update, ok := envelope.Event.(*mastodon.UpdateEvent); ok && update.Status != nil {
+				s.checkpoints.Advance(s.server, s.spec, update.Status.ID)
+			}
+		}
+	}
+	held := make(chan *Envelope, 1)
+	go func() {
+		held <- out.run(ctx)
+	}()
+	defer func() {
+		out.drain(<-held)
+	}()
+
+	defer func() {
+		if ctx.Err() != nil {
+			s.tracker.setState(s.server, s.spec.String(), StateIdle, nil)
+		}
+	}()
+
+	attempt := 0
+	for {
+		if s.breaker.IsDead() {
+			streamErr := &StreamError{
+				Server:    s.server,
+				Stream:    s.spec,
+				Transport: s.transport.String(),
+				Err:       fmt.Errorf("circuit open: %v", s.breaker.LastError()),
+				Reason:    ReasonCircuitOpen,
+				Kind:      FailurePermanent,
+			}
+			s.tracker.setState(s.server, s.spec.String(), StateDead, streamErr.Err)
+			sendError(ctx, errCh, streamErr)
+			return
+		}
+		if !s.breaker.Wait(ctx) {
+			return
+		}
+
+		s.tracker.setState(s.server, s.spec.String(), StateConnecting, nil)
+		received, err := streamOnce(ctx, s, out, errCh)
+		if ctx.Err() != nil {
+			s.breaker.abort()
+			return
+		}
+
+		// Only consecutive failures count against the retry budget.
+		if received {
+			attempt = 0
+			s.breaker.Success()
+		}
+
+		reason := ReasonError
+		if errors.Is(err, ErrStalled) {
+			reason = ReasonStalled
+			if received {
+				// The connection was fine until it went quiet. That's no
+				// failed attempt, neither for the breaker nor for falling
+				// back, so just reconnect.
+				s.tracker.setState(s.server, s.spec.String(), StateRetrying, err)
+				sendError(ctx, errCh, &StreamError{
+					Server:    s.server,
+					Stream:    s.spec,
+					Transport: s.transport.String(),
+					Err:       err,
+					Reason:    reason,
+					Kind:      FailureTransient,
+					Retrying:  true,
+					RetryAt:   time.Now(),
+				})
+				continue
+			}
+		}
+		attempt++
+
+		kind := s.breaker.Failure(err)
+		streamErr := &StreamError{
+			Server:    s.server,
+			Stream:    s.spec,
+			Transport: s.transport.String(),
+			Err:       err,
+			Reason:    reason,
+			Kind:      kind,
+			Attempt:   attempt,
+		}
+
+		if s.shouldFallBack(received, kind, attempt) {
+			s.transport = s.fallback
+			s.onFallback = true
+			attempt = 0
+			s.breaker.Success()
+
+			streamErr.Reason = ReasonFallback
+			streamErr.Retrying = true
+			streamErr.RetryAt = time.Now()
+			s.tracker.setState(s.server, s.spec.String(), StateRetrying, err)
+			sendError(ctx, errCh, streamErr)
+			continue
+		}
+		if s.breaker.IsDead() || s.retry.GivesUp(attempt) {
+			s.tracker.setState(s.server, s.spec.String(), StateDead, err)
+			sendError(ctx, errCh, streamErr)
+			return
+		}
+
+		wait := s.retry.Backoff(attempt)
+		if openUntil := s.breaker.OpenUntil(); time.Until(openUntil) > wait {
+			wait = time.Until(openUntil)
+		}
+		streamErr.Retrying = true
+		streamErr.RetryAt = time.Now().Add(wait)
+		s.tracker.setState(s.server, s.spec.String(), StateRetrying, err)
+		sendError(ctx, errCh, streamErr)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *serverStream) shouldFallBack(received bool, kind FailureKind, attempt int) bool {
+	if s.fallback == nil || s.onFallback || received || kind == FailureThrottled {
+		return false
+	}
+	return kind == FailurePermanent || (s.fallbackAfter > 0 && attempt >= s.fallbackAfter)
+}
+
+// streamOnce makes a single connection attempt and reports whether the
+// server sent anything, events or heartbeats, before it failed.
+func streamOnce(ctx context.Context, s *serverStream, out *outbox, errCh chan<- *StreamError) (bool, error) {
+	// The client will keep hammering on an error in a tight loop, so every
+	// attempt gets its own context which is cancelled on the first error.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := s.transport.Open(ctx, s.client, s.spec)
+	if err != nil {
+		return false, err
+	}
+
+	// Whatever the client sends after we stop listening would otherwise
+	// block its goroutine forever.
+	defer func() {
+		cancel()
+		go func() {
+			for range stream {
+			}
+		}()
+	}()
+
+	s.conn++
+
+	// Whatever was posted while we were away. The stream is already open so
+	// nothing falls between the two, but the newest statuses may come
+	// through both.
+	backfilled, err := backfill(ctx, s)
+	if err != nil {
+		sendError(ctx, errCh, &StreamError{
+			Server:    s.server,
+			Stream:    s.spec,
+			Transport: s.transport.String(),
+			Err:       err,
+			Reason:    ReasonBackfill,
+			Kind:      ClassifyError(err),
+		})
+	}
+	var backfilledTo mastodon.ID
+	for _, envelope := range backfilled {
+		envelope.ReceivedAt = time.Now()
+		if !out.push(ctx, envelope) {
+			return false, ctx.Err()
+		}
+		backfilledTo = envelope.Event.(*mastodon.UpdateEvent).Status.ID
+	}
+
+	// The stall timer only runs while we're waiting on the server, not
+	// while we're waiting on our own consumer. Polling can't stall.
+	idle := s.stall.timeout()
+	if _, polling := s.transport.(*PollingTransport); polling {
+		idle = 0
+	}
+	var stalled <-chan time.Time
+	var timer *time.Timer
+	if idle > 0 {
+		timer = time.NewTimer(idle)
+		defer timer.Stop()
+		stalled = timer.C
+	}
+	resetStall := func() {
+		if timer == nil {
+			return
+		}
+		idle = s.stall.timeout()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(idle)
+	}
+
+	var seq uint64
+	var lastEvent time.Time
+	received := false
+	for {
+		var event mastodon.Event
+		var ok bool
+		select {
+		case event, ok = <-stream:
+			if !ok {
+				return received, ctx.Err()
+			}
+		case <-stalled:
+			return received, fmt.Errorf("%w: no events for %s", ErrStalled, idle)
+		}
+
+		var accounts map[string]AccountPrivacy
+		if annotated, ok := event.(*annotatedEvent); ok {
+			event, accounts = annotated.event, annotated.accounts
+		}
+
+		switch event := event.(type) {
+		case *mastodon.ErrorEvent:
+			return received, errors.New(event.Error())
+		case *errorEvent:
+			return received, event.err
+		case *heartbeatEvent:
+			// The server is there, just quiet. That says nothing about
+			// the gaps between events.
+			received = true
+			resetStall()
+		default:
+			update, isUpdate := event.(*mastodon.UpdateEvent)
+			if isUpdate && update.Status != nil && backfilledTo != "" && !idLess(backfilledTo, update.Status.ID) {
+				// Already sent by the backfill.
+				received = true
+				continue
+			}
+
+			received = true
+			seq++
+			envelope := &Envelope{
+				Server:     s.server,
+				ReceivedAt: time.Now(),
+				Stream:     s.spec,
+				Conn:       s.conn,
+				Seq:        seq,
+				Event:      event,
+				Accounts:   accounts,
+			}
+			if s.onFallback {
+				envelope.Transport = s.transport.String()
+			}
+			s.tracker.event(s.server, s.spec.String(), envelope.ReceivedAt)
+			if !lastEvent.IsZero() {
+				s.stall.observe(envelope.ReceivedAt.Sub(lastEvent))
+			}
+			lastEvent = envelope.ReceivedAt
+
+			if !out.push(ctx, envelope) {
+				return received, ctx.Err()
+			}
+			resetStall()
+		}
+	}
+}
+
+func sendError(ctx context.Context, errCh chan<- *StreamError, err *StreamError) {
+	select {
+	case errCh <- err:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,145 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/abreka/proboscideans/accounts"
+)
+
+// SubscriptionRule gives the streams to follow on servers whose host matches
+// one of its globs, e.g. "*.social" or "mastodon.example".
+type SubscriptionRule struct {
+	Servers []string     `json:"servers"`
+	Streams []StreamSpec `json:"streams"`
+}
+
+// SubscriptionSpec decides what to stream from each server. Rules are tried
+// in order and the first one matching a server wins, so put catch-alls like
+// "*" last. Servers no rule matches aren't streamed at all.
+//
+// In JSON it looks like:
+//
+//	{"rules": [
+//	  {"servers": ["mastodon.social"], "streams": ["federated"]},
+//	  {"servers": ["*"], "streams": ["local", "hashtag:fediverse"]}
+//	]}
+type SubscriptionSpec struct {
+	Rules []SubscriptionRule `json:"rules"`
+}
+
+// ParseSubscriptionSpec reads a spec as JSON and checks its globs.
+func ParseSubscriptionSpec(r io.Reader) (*SubscriptionSpec, error) {
+	var spec SubscriptionSpec
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		return nil, fmt.Errorf("bad subscription spec: %w", err)
+	}
+
+	for i, rule := range spec.Rules {
+		if len(rule.Servers) == 0 {
+			return nil, fmt.Errorf("bad subscription spec: rule %d has no servers", i)
+		}
+		for _, pattern := range rule.Servers {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("bad subscription spec: rule %d: %q: %w", i, pattern, err)
+			}
+		}
+	}
+
+	return &spec, nil
+}
+
+// LoadSubscriptionSpec reads a spec from a JSON file.
+func LoadSubscriptionSpec(filePath string) (*SubscriptionSpec, error) {
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = fp.Close() }()
+
+	return ParseSubscriptionSpec(fp)
+}
+
+// StreamsFor returns the streams to follow on a server, with duplicates
+// removed.
+func (s *SubscriptionSpec) StreamsFor(serverName string) []StreamSpec {
+	for _, rule := range s.Rules {
+		if !accounts.MatchHost(rule.Servers, serverName) {
+			continue
+		}
+
+		var streams []StreamSpec
+		seen := make(map[StreamSpec]bool)
+		for _, stream := range rule.Streams {
+			if !seen[stream] {
+				seen[stream] = true
+				streams = append(streams, stream)
+			}
+		}
+		return streams
+	}
+	return nil
+}
+
+// Subscribe streams from every server in the Mux according to spec until ctx
+// is done. The spec can be swapped out later with UpdateSubscriptions.
+func (m *Mux) Subscribe(ctx context.Context, spec *SubscriptionSpec) (<-chan *Envelope, <-chan *StreamError) {
+	m.Lock()
+	m.subSpec = spec
+	m.Unlock()
+
+	return m.stream(ctx, m.specsFromSubscriptions)
+}
+
+// UpdateSubscriptions replaces the spec used by Subscribe and reconciles the
+// running streams against it: streams that are no longer wanted are stopped
+// and new ones are started. Streams that are still wanted keep running.
+func (m *Mux) UpdateSubscriptions(spec *SubscriptionSpec) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.subSpec = spec
+	for sub := range m.subs {
+		m.reconcileLocked(sub)
+	}
+}
+
+// specsFromSubscriptions is the specsFor of subscriptions started by
+// Subscribe. It is only called with the lock held.
+func (m *Mux) specsFromSubscriptions(serverName string) []StreamSpec {
+	if m.subSpec == nil {
+		return nil
+	}
+	return m.subSpec.StreamsFor(serverName)
+}
+
+// reconcileLocked stops a subscription's streams that its specsFor no
+// longer returns and starts the ones it doesn't have yet. The caller must
+// hold the lock.
+func (m *Mux) reconcileLocked(sub *subscription) {
+	for serverName, cancels := range sub.cancels {
+		wanted := make(map[string]bool)
+		if _, ok := m.clients[serverName]; ok {
+			for _, spec := range sub.specsFor(serverName) {
+				wanted[spec.String()] = true
+			}
+		}
+
+		for key, cancel := range cancels {
+			if !wanted[key] {
+				cancel()
+				delete(cancels, key)
+			}
+		}
+	}
+
+	for serverName := range m.clients {
+		m.startLocked(sub, serverName)
+	}
+}
@@ -0,0 +1,97 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSubscriptionSpec(t *testing.T) {
+	spec, err := ParseSubscriptionSpec(strings.NewReader(`{"rules": [
+		{"servers": ["mastodon.social", "*.hub"], "streams": ["federated"]},
+		{"servers": ["*"], "streams": ["local", "hashtag:fediverse", "local"]}
+	]}`))
+	require.NoError(t, err)
+
+	require.Equal(t, []StreamSpec{PublicStream(false)}, spec.StreamsFor("https://mastodon.social"))
+	require.Equal(t, []StreamSpec{PublicStream(false)}, spec.StreamsFor("https://big.hub"))
+	require.Equal(t, []StreamSpec{PublicStream(true), HashtagStream("fediverse", false)}, spec.StreamsFor("https://small.town"))
+
+	for _, bad := range []string{
+		`{"rules": [{"servers": ["["], "streams": ["local"]}]}`,
+		`{"rules": [{"servers": [], "streams": ["local"]}]}`,
+		`{"rules": [{"servers": ["*"], "streams": ["public"]}]}`,
+		`{"rule": []}`,
+	} {
+		_, err := ParseSubscriptionSpec(strings.NewReader(bad))
+		require.Error(t, err, bad)
+	}
+}
+
+func TestMux_UpdateSubscriptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		_, _ = fmt.Fprint(w, "event: update\ndata: {\"id\":\"1\"}\n\n")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streams := func() map[string]ServerState {
+		return mux.Status()[0].Streams
+	}
+	waitFor := func(want ...string) {
+		require.Eventually(t, func() bool {
+			got := streams()
+			if len(got) != len(want) {
+				return false
+			}
+			for _, stream := range want {
+				if got[stream] != StateConnected {
+					return false
+				}
+			}
+			return true
+		}, 3*time.Second, 10*time.Millisecond, "want %v, got %v", want, streams())
+	}
+
+	events, _ := mux.Subscribe(ctx, &SubscriptionSpec{Rules: []SubscriptionRule{
+		{Servers: []string{"*"}, Streams: []StreamSpec{PublicStream(true)}},
+	}})
+	go func() {
+		for range events {
+		}
+	}()
+	waitFor("local")
+
+	mux.UpdateSubscriptions(&SubscriptionSpec{Rules: []SubscriptionRule{
+		{Servers: []string{"*"}, Streams: []StreamSpec{PublicStream(true), HashtagStream("fediverse", true)}},
+	}})
+	waitFor("local", "hashtag-local:fediverse")
+
+	mux.UpdateSubscriptions(&SubscriptionSpec{Rules: []SubscriptionRule{
+		{Servers: []string{"*"}, Streams: []StreamSpec{HashtagStream("fediverse", true)}},
+	}})
+	waitFor("hashtag-local:fediverse")
+
+	// Nothing matches, so everything stops.
+	mux.UpdateSubscriptions(&SubscriptionSpec{Rules: []SubscriptionRule{
+		{Servers: []string{"other.example"}, Streams: []StreamSpec{PublicStream(true)}},
+	}})
+	waitFor()
+}
@@ -0,0 +1,66 @@
+package streaming
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/mattn/go-mastodon"
+)
+
+// Transport is a way of following a stream on a server. Open returns a
+// channel of events that is closed once ctx is done. A failure after Open
+// has returned is sent as an error event, after which the caller cancels ctx
+// and opens it again.
+type Transport interface {
+	Open(ctx context.Context, client *mastodon.Client, spec StreamSpec) (<-chan mastodon.Event, error)
+	String() string
+}
+
+// StreamingTransport uses the streaming API through go-mastodon.
+var StreamingTransport Transport = streamingTransport{}
+
+type streamingTransport struct{}
+
+func (streamingTransport) String() string {
+	return "streaming"
+}
+
+func (streamingTransport) Open(ctx context.Context, client *mastodon.Client, spec StreamSpec) (<-chan mastodon.Event, error) {
+	switch spec.Kind {
+	case StreamLocal, StreamFederated:
+		return client.StreamingPublic(ctx, spec.Kind == StreamLocal)
+	case StreamHashtag, StreamHashtagLocal:
+		return client.StreamingHashtag(ctx, spec.Tag, spec.Kind == StreamHashtagLocal)
+	case StreamList:
+		return client.StreamingList(ctx, mastodon.ID(spec.List))
+	case StreamUser:
+		return client.StreamingUser(ctx)
+	default:
+		return nil, fmt.Errorf("unknown stream kind %q", spec.Kind)
+	}
+}
+
+// errorEvent carries an error from one of our own transports. Unlike
+// mastodon.ErrorEvent it keeps the original error.
+type errorEvent struct {
+	sealedEvent
+	err error
+}
+
+func (e *errorEvent) Error() string {
+	return e.err.Error()
+}
+
+// heartbeatEvent tells the stream that the server is still there even
+// though it has nothing to send. It never leaves the stream.
+type heartbeatEvent struct {
+	sealedEvent
+}
+
+// annotatedEvent is an update from one of our own transports along with the
+// account flags go-mastodon threw away.
+type annotatedEvent struct {
+	sealedEvent
+	event    mastodon.Event
+	accounts map[string]AccountPrivacy
+}
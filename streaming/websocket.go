@@ -0,0 +1,489 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/abreka/proboscideans/accounts"
+	"github.com/abreka/proboscideans/identity"
+	"github.com/abreka/proboscideans/ratelimit"
+	"github.com/gorilla/websocket"
+	"github.com/mattn/go-mastodon"
+)
+
+// wsWriteTimeout bounds how long a subscribe or unsubscribe message may take
+// to send.
+const wsWriteTimeout = 10 * time.Second
+
+// WebSocketTransport follows streams over the streaming API's WebSocket
+// endpoint. All the streams opened on a server with the same token share one
+// connection, subscribing and unsubscribing as they come and go, and the
+// connection is closed when the last one leaves.
+//
+// A slow consumer of one stream holds up the others on its connection.
+type WebSocketTransport struct {
+	Dialer *websocket.Dialer
+
+	conns map[string]*wsConn
+	sync.Mutex
+}
+
+func NewWebSocketTransport() *WebSocketTransport {
+	return &WebSocketTransport{Dialer: websocket.DefaultDialer}
+}
+
+func (t *WebSocketTransport) String() string {
+	return "websocket"
+}
+
+// wsConn is one connection and the streams riding on it.
+type wsConn struct {
+	key string
+
+	// ws and err are set once ready is closed.
+	ws    *websocket.Conn
+	err   error
+	ready chan struct{}
+
+	// subs holds the subscribers of each stream, by wsStreamKey. Guarded
+	// by the transport's lock, as is closing.
+	subs    map[string]map[*wsSub]struct{}
+	closing bool
+
+	writeMu sync.Mutex
+}
+
+// wsSub is one Open call. The reader and Open's cleanup both close ch, so
+// sends and the close happen under mu.
+type wsSub struct {
+	ctx    context.Context
+	ch     chan mastodon.Event
+	closed bool
+	seen   bool
+	mu     sync.Mutex
+}
+
+func (s *wsSub) send(event mastodon.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.ch <- event:
+	case <-s.ctx.Done():
+	}
+}
+
+func (s *wsSub) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+func (t *WebSocketTransport) Open(ctx context.Context, client *mastodon.Client, spec StreamSpec) (<-chan mastodon.Event, error) {
+	conn, err := t.conn(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &wsSub{ctx: ctx, ch: make(chan mastodon.Event)}
+	key := wsStreamKey(spec)
+
+	t.Lock()
+	if conn.closing {
+		t.Unlock()
+		return nil, errors.New("websocket connection closed")
+	}
+	first := len(conn.subs[key]) == 0
+	if first {
+		conn.subs[key] = make(map[*wsSub]struct{})
+	}
+	conn.subs[key][sub] = struct{}{}
+	t.Unlock()
+
+	if first {
+		if err := conn.write(wsCommand("subscribe", spec)); err != nil {
+			t.leave(conn, key, sub, spec)
+			return nil, err
+		}
+	}
+
+	go func() {
+		<-ctx.Done()
+		t.leave(conn, key, sub, spec)
+		sub.close()
+	}()
+
+	return sub.ch, nil
+}
+
+// leave removes a subscriber, unsubscribing from the stream if it was the
+// last one and closing the connection if nothing is left on it.
+func (t *WebSocketTransport) leave(conn *wsConn, key string, sub *wsSub, spec StreamSpec) {
+	t.Lock()
+	subs, ok := conn.subs[key]
+	if !ok {
+		t.Unlock()
+		return
+	}
+	delete(subs, sub)
+	last := len(subs) == 0
+	if last {
+		delete(conn.subs, key)
+	}
+	empty := len(conn.subs) == 0
+	if empty {
+		t.forgetLocked(conn)
+	}
+	t.Unlock()
+
+	if empty {
+		_ = conn.ws.Close()
+	} else if last {
+		_ = conn.write(wsCommand("unsubscribe", spec))
+	}
+}
+
+func (t *WebSocketTransport) forgetLocked(conn *wsConn) {
+	conn.closing = true
+	if t.conns[conn.key] == conn {
+		delete(t.conns, conn.key)
+	}
+}
+
+// conn returns the connection for a client, dialing one if there isn't one
+// yet. Streams opened while it is being dialed wait for it.
+func (t *WebSocketTransport) conn(ctx context.Context, client *mastodon.Client) (*wsConn, error) {
+	key := client.Config.Server + " " + client.Config.AccessToken
+
+	t.Lock()
+	if conn, ok := t.conns[key]; ok {
+		t.Unlock()
+		select {
+		case <-conn.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if conn.err != nil {
+			return nil, conn.err
+		}
+		return conn, nil
+	}
+	if t.conns == nil {
+		t.conns = make(map[string]*wsConn)
+	}
+	conn := &wsConn{
+		key:   key,
+		subs:  make(map[string]map[*wsSub]struct{}),
+		ready: make(chan struct{}),
+	}
+	t.conns[key] = conn
+	t.Unlock()
+
+	conn.ws, conn.err = t.dial(ctx, client)
+	if conn.err != nil {
+		t.Lock()
+		t.forgetLocked(conn)
+		t.Unlock()
+		close(conn.ready)
+		return nil, conn.err
+	}
+	close(conn.ready)
+
+	go t.read(conn)
+	return conn, nil
+}
+
+func (t *WebSocketTransport) dial(ctx context.Context, client *mastodon.Client) (*websocket.Conn, error) {
+	endpoint, err := streamingEndpoint(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	header.Set("User-Agent", identity.Current().UserAgent())
+	if client.Config.AccessToken != "" {
+		header.Set("Authorization", "Bearer "+client.Config.AccessToken)
+	}
+
+	dialer := t.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	// The handshake doesn't go through an http.Client.
+	host := accounts.HostOf(endpoint)
+	if err := ratelimit.Default.Wait(ctx, host); err != nil {
+		return nil, err
+	}
+	ws, resp, err := dialer.DialContext(ctx, endpoint, header)
+	if resp != nil {
+		ratelimit.Default.Observe(host, resp)
+		if resp.Body != nil {
+			_ = resp.Body.Close()
+		}
+	}
+	if err != nil {
+		if resp != nil {
+			// Worded like go-mastodon's errors so they classify the same.
+			return nil, fmt.Errorf("bad handshake: %s", resp.Status)
+		}
+		return nil, err
+	}
+	return ws, nil
+}
+
+// streamingEndpoint finds the WebSocket URL for a server. Big instances
+// often serve streaming from a separate host, which they advertise.
+func streamingEndpoint(ctx context.Context, client *mastodon.Client) (string, error) {
+	base := client.Config.Server
+	if advertised := advertisedStreamingAPI(ctx, client); advertised != "" {
+		base = advertised
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/streaming"
+	return u.String(), nil
+}
+
+// advertisedStreamingAPI returns the streaming URL from a server's instance
+// info, or "" if it doesn't say or couldn't be asked. The request is made
+// once, through the client's rate-limited transport, unlike go-mastodon's
+// GetInstance which waits out 429s by itself.
+func advertisedStreamingAPI(ctx context.Context, client *mastodon.Client) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(client.Config.Server, "/")+"/api/v1/instance", nil)
+	if err != nil {
+		return ""
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return ""
+	}
+
+	var instance struct {
+		URLs map[string]string `json:"urls"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&instance); err != nil {
+		return ""
+	}
+	return instance.URLs["streaming_api"]
+}
+
+func (c *wsConn) write(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.ws.WriteJSON(v)
+}
+
+// wsMessage is anything the server sends. Payload is itself JSON, as a
+// string, except for deletes where it is the bare id.
+type wsMessage struct {
+	Stream  []string `json:"stream"`
+	Event   string   `json:"event"`
+	Payload string   `json:"payload"`
+	Error   string   `json:"error"`
+	Status  int      `json:"status"`
+}
+
+// read routes messages to subscribers until the connection fails, then
+// hands every remaining subscriber the error.
+func (t *WebSocketTransport) read(conn *wsConn) {
+	var err error
+	for {
+		var msg wsMessage
+		if err = conn.ws.ReadJSON(&msg); err != nil {
+			break
+		}
+
+		if msg.Error != "" {
+			// Errors don't say which subscription they are about, so they
+			// go to every stream that hasn't worked yet.
+			msgErr := fmt.Errorf("websocket error: %d %s", msg.Status, msg.Error)
+			for _, sub := range t.subscribers(conn, "", true) {
+				sub.send(&errorEvent{err: msgErr})
+			}
+			continue
+		}
+
+		event, ok, decodeErr := decodeStreamEvent(msg.Event, msg.Payload)
+		if decodeErr != nil {
+			// As over SSE, the streams it was meant for reconnect, and the
+			// backfill picks up whatever was lost.
+			decodeErr = fmt.Errorf("bad %s event: %w", msg.Event, decodeErr)
+			for _, sub := range t.subscribers(conn, wsMessageKey(msg.Stream), false) {
+				sub.send(&errorEvent{err: decodeErr})
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for _, sub := range t.subscribers(conn, wsMessageKey(msg.Stream), false) {
+			sub.send(event)
+		}
+	}
+
+	t.Lock()
+	t.forgetLocked(conn)
+	var subs []*wsSub
+	for _, byKey := range conn.subs {
+		for sub := range byKey {
+			subs = append(subs, sub)
+		}
+	}
+	conn.subs = make(map[string]map[*wsSub]struct{})
+	t.Unlock()
+	_ = conn.ws.Close()
+
+	for _, sub := range subs {
+		sub.send(&errorEvent{err: err})
+		sub.close()
+	}
+}
+
+// subscribers returns the subscribers of a stream, or with unseen set the
+// subscribers of any stream that hasn't sent an event yet. Returned
+// subscribers are marked as seen unless unseen is set.
+func (t *WebSocketTransport) subscribers(conn *wsConn, key string, unseen bool) []*wsSub {
+	t.Lock()
+	defer t.Unlock()
+
+	var subs []*wsSub
+	for subKey, byKey := range conn.subs {
+		if !unseen && subKey != key {
+			continue
+		}
+		for sub := range byKey {
+			if unseen && sub.seen {
+				continue
+			}
+			if !unseen {
+				sub.seen = true
+			}
+			subs = append(subs, sub)
+		}
+	}
+	return subs
+}
+
+// decodeStreamEvent turns an event as the streaming API sends it, over SSE or
+// WebSocket, into a go-mastodon one. Events we don't know are skipped.
+func decodeStreamEvent(eventType, payload string) (mastodon.Event, bool, error) {
+	switch eventType {
+	case TypeUpdate, TypeStatusUpdate:
+		var status mastodon.Status
+		if err := json.Unmarshal([]byte(payload), &status); err != nil {
+			return nil, false, err
+		}
+		var event mastodon.Event = &mastodon.UpdateEvent{Status: &status}
+		if eventType == TypeStatusUpdate {
+			event = &StatusUpdateEvent{mastodon.UpdateEvent{Status: &status}}
+		}
+		if accounts := decodeAccountPrivacy(payload); len(accounts) > 0 {
+			event = &annotatedEvent{event: event, accounts: accounts}
+		}
+		return event, true, nil
+	case TypeDelete:
+		return &mastodon.DeleteEvent{ID: mastodon.ID(payload)}, true, nil
+	case TypeNotification:
+		var notification mastodon.Notification
+		if err := json.Unmarshal([]byte(payload), &notification); err != nil {
+			return nil, false, err
+		}
+		return &mastodon.NotificationEvent{Notification: &notification}, true, nil
+	case TypeFiltersChanged:
+		return &FiltersChangedEvent{}, true, nil
+	default:
+		// Announcements, conversations and whatever comes next.
+		return nil, false, nil
+	}
+}
+
+// decodeAccountPrivacy picks the indexing flags of a status' author, and
+// of the reblogged author, out of its JSON.
+func decodeAccountPrivacy(payload string) map[string]AccountPrivacy {
+	type account struct {
+		URL string `json:"url"`
+		AccountPrivacy
+	}
+	var status struct {
+		Account account `json:"account"`
+		Reblog  *struct {
+			Account account `json:"account"`
+		} `json:"reblog"`
+	}
+	if err := json.Unmarshal([]byte(payload), &status); err != nil {
+		return nil
+	}
+
+	accounts := make(map[string]AccountPrivacy)
+	add := func(a account) {
+		if a.URL != "" && (a.Discoverable != nil || a.Noindex != nil) {
+			accounts[a.URL] = a.AccountPrivacy
+		}
+	}
+	add(status.Account)
+	if status.Reblog != nil {
+		add(status.Reblog.Account)
+	}
+	return accounts
+}
+
+// wsCommand is a subscribe or unsubscribe message for a stream.
+func wsCommand(command string, spec StreamSpec) map[string]string {
+	msg := map[string]string{"type": command}
+	switch spec.Kind {
+	case StreamLocal:
+		msg["stream"] = "public:local"
+	case StreamFederated:
+		msg["stream"] = "public"
+	case StreamHashtag:
+		msg["stream"] = "hashtag"
+		msg["tag"] = spec.Tag
+	case StreamHashtagLocal:
+		msg["stream"] = "hashtag:local"
+		msg["tag"] = spec.Tag
+	case StreamList:
+		msg["stream"] = "list"
+		msg["list"] = spec.List
+	case StreamUser:
+		msg["stream"] = "user"
+	}
+	return msg
+}
+
+// wsStreamKey is how the server names a stream in the messages it sends.
+// Tags are compared without case since the server normalizes them.
+func wsStreamKey(spec StreamSpec) string {
+	msg := wsCommand("", spec)
+	return wsMessageKey([]string{msg["stream"], msg["tag"] + msg["list"]})
+}
+
+func wsMessageKey(stream []string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.Join(stream, " "), " "))
+}
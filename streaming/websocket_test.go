@@ -0,0 +1,153 @@
+package streaming
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mattn/go-mastodon"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebSocketTransport_multiplexes(t *testing.T) {
+	var mu sync.Mutex
+	var connections int
+	var commands []map[string]string
+
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/streaming" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = ws.Close() }()
+
+		mu.Lock()
+		connections++
+		mu.Unlock()
+
+		for {
+			var command map[string]string
+			if err := ws.ReadJSON(&command); err != nil {
+				return
+			}
+			mu.Lock()
+			commands = append(commands, command)
+			mu.Unlock()
+			if command["type"] != "subscribe" {
+				continue
+			}
+
+			stream := []string{command["stream"]}
+			if command["tag"] != "" {
+				// The server lowercases tags.
+				stream = append(stream, "fediverse")
+			}
+			payload, _ := json.Marshal(mastodon.Status{ID: mastodon.ID(command["stream"])})
+			_ = ws.WriteJSON(map[string]interface{}{"stream": stream, "event": "update", "payload": string(payload)})
+		}
+	}))
+	defer server.Close()
+
+	mux, err := NewMuxFromCredentialsDir(newMemoryStore())
+	require.NoError(t, err)
+	ws := NewWebSocketTransport()
+	mux.TransportFor = func(string) Transport { return ws }
+	require.NoError(t, mux.AddServer(server.URL, &mastodon.Application{ClientID: "client-id"}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	events, _ := mux.Subscribe(ctx, &SubscriptionSpec{Rules: []SubscriptionRule{
+		{Servers: []string{"*"}, Streams: []StreamSpec{PublicStream(true), HashtagStream("Fediverse", false)}},
+	}})
+
+	got := make(map[string]mastodon.ID)
+	for len(got) < 2 {
+		select {
+		case envelope := <-events:
+			got[envelope.Stream.String()] = envelope.Event.(*mastodon.UpdateEvent).Status.ID
+		case <-ctx.Done():
+			t.Fatalf("only got %v", got)
+		}
+	}
+	require.Equal(t, map[string]mastodon.ID{"local": "public:local", "hashtag:Fediverse": "hashtag"}, got)
+
+	mux.UpdateSubscriptions(&SubscriptionSpec{Rules: []SubscriptionRule{
+		{Servers: []string{"*"}, Streams: []StreamSpec{PublicStream(true)}},
+	}})
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(commands) == 3
+	}, 3*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 1, connections)
+	require.Equal(t, map[string]string{"type": "unsubscribe", "stream": "hashtag", "tag": "Fediverse"}, commands[2])
+}
+
+func TestWebSocketTransport_badPayload(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/instance":
+			// Streaming is served elsewhere, as on big instances.
+			_, _ = fmt.Fprintf(w, `{"urls":{"streaming_api":"ws://%s/elsewhere"}}`, r.Host)
+			return
+		case "/elsewhere/api/v1/streaming":
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer func() { _ = ws.Close() }()
+
+		for subscribed := 0; subscribed < 2; {
+			var command map[string]string
+			if err := ws.ReadJSON(&command); err != nil {
+				return
+			}
+			if command["type"] == "subscribe" {
+				subscribed++
+			}
+		}
+		_ = ws.WriteJSON(map[string]interface{}{"stream": []string{"public:local"}, "event": "update", "payload": `{"id":`})
+		_ = ws.WriteJSON(map[string]interface{}{"stream": []string{"public"}, "event": "update", "payload": `{"id":"1"}`})
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client := mastodon.NewClient(&mastodon.Config{Server: server.URL})
+	transport := NewWebSocketTransport()
+	local, err := transport.Open(ctx, client, PublicStream(true))
+	require.NoError(t, err)
+	federated, err := transport.Open(ctx, client, PublicStream(false))
+	require.NoError(t, err)
+
+	// Only the stream the bad payload was meant for hears about it.
+	event := <-local
+	require.IsType(t, &errorEvent{}, event)
+	require.ErrorContains(t, event.(*errorEvent).err, "bad update event")
+	require.Equal(t, mastodon.ID("1"), (<-federated).(*mastodon.UpdateEvent).Status.ID)
+}